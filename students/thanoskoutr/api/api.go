@@ -0,0 +1,368 @@
+// Package api implements a JSON HTTP API for managing the links of a
+// database.Store:
+//
+//     GET    /api/links          list the links
+//     POST   /api/links          create a link
+//     GET    /api/links/{path}   get a link
+//     PUT    /api/links/{path}   create or replace a link
+//     PATCH  /api/links/{path}   change some fields of a link
+//     DELETE /api/links/{path}   delete a link
+//
+// With a database.Database, the clicks of the links are served by
+// Clicks, as JSON or, with format=csv, as CSV:
+//
+//     GET    /api/clicks          the click counters of the links
+//     GET    /api/clicks/series   the clicks per hour, day or week of a range
+//     GET    /api/clicks/top      the top links, referrers or user agent classes
+//     GET    /api/clicks/export   the clicks of a range, as CSV
+//
+// Links are encoded as database.Record. A link scoped to a host is
+// addressed with the host query parameter, e.g. /api/links/pkg?host=go.example.com.
+// Errors are returned with their status code and a JSON body:
+//
+//     {"error": "path \"/gh\": key not found"}
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/generator"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/urlshort"
+)
+
+// Prefix is the path the links are served under.
+const Prefix = "/api/links"
+
+// maxBodySize is the maximum size of a request body.
+const maxBodySize = 1 << 20
+
+// API is an http.Handler that serves the links of a Store.
+type API struct {
+	store database.Store
+	gen   *generator.Generator
+}
+
+// New will return an API for the links of the Store.
+//
+// If gen is not nil and the Store is a database.KeyGenerator, links
+// created without a path get a generated one.
+func New(store database.Store, gen *generator.Generator) *API {
+	return &API{store: store, gen: gen}
+}
+
+// httpError is an error with the status code to return it with.
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+// errorf will return an error with the status code.
+func errorf(status int, format string, a ...interface{}) error {
+	return &httpError{status: status, err: fmt.Errorf(format, a...)}
+}
+
+// ServeHTTP will route the request to the handler of its method.
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch path := strings.TrimPrefix(r.URL.Path, Prefix); {
+	case path == r.URL.Path:
+		err = errorf(http.StatusNotFound, "path %q is not served by the API", r.URL.Path)
+	case path == "" || path == "/":
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			err = a.list(w, r)
+		case http.MethodPost:
+			err = a.create(w, r)
+		default:
+			err = methodNotAllowed(w, "GET, HEAD, POST")
+		}
+	default:
+		key := database.HostKey(r.URL.Query().Get("host"), path)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			err = a.get(w, r, key)
+		case http.MethodPut:
+			err = a.put(w, r, key)
+		case http.MethodPatch:
+			err = a.patch(w, r, key)
+		case http.MethodDelete:
+			err = a.delete(w, r, key)
+		default:
+			err = methodNotAllowed(w, "GET, HEAD, PUT, PATCH, DELETE")
+		}
+	}
+	if err != nil {
+		writeError(w, r, err)
+	}
+}
+
+// list will return all the links, sorted by key.
+func (a *API) list(w http.ResponseWriter, r *http.Request) error {
+	records, err := a.store.List(r.Context())
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	links := make([]database.Record, 0, len(keys))
+	for _, key := range keys {
+		links = append(links, records[key])
+	}
+	return writeJSON(w, http.StatusOK, links)
+}
+
+// create will add a new link, with the path of the body or a generated
+// one, and fail if the path already exists.
+func (a *API) create(w http.ResponseWriter, r *http.Request) error {
+	var rec database.Record
+	if err := readJSON(r, &rec); err != nil {
+		return err
+	}
+	var key string
+	if rec.Path == "" {
+		kg, ok := a.store.(database.KeyGenerator)
+		if a.gen == nil || !ok {
+			return errorf(http.StatusBadRequest, "path is required")
+		}
+		// Validate the record with a placeholder path, before it is generated
+		if err := check(a.gen.Path("x"), rec); err != nil {
+			return err
+		}
+		var err error
+		key, err = kg.PutGenerated(r.Context(), a.gen, rec)
+		if err != nil {
+			return err
+		}
+	} else {
+		key = database.HostKey(rec.Host, rec.Path)
+		if err := check(key, rec); err != nil {
+			return err
+		}
+		err := a.store.Insert(r.Context(), key, rec)
+		if errors.Is(err, database.ErrExists) {
+			return errorf(http.StatusConflict, "path %q already exists", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return a.writeRecord(w, r, key, http.StatusCreated)
+}
+
+// get will return the link of the key.
+func (a *API) get(w http.ResponseWriter, r *http.Request, key string) error {
+	return a.writeRecord(w, r, key, http.StatusOK)
+}
+
+// put will create or replace the link of the key.
+func (a *API) put(w http.ResponseWriter, r *http.Request, key string) error {
+	var rec database.Record
+	if err := readJSON(r, &rec); err != nil {
+		return err
+	}
+	if err := checkKey(key, rec); err != nil {
+		return err
+	}
+	if err := check(key, rec); err != nil {
+		return err
+	}
+	// Replace the link, or else create it, again if it is created or
+	// deleted in between
+	for {
+		err := a.store.Replace(r.Context(), key, rec)
+		if err == nil {
+			return a.writeRecord(w, r, key, http.StatusOK)
+		}
+		if !errors.Is(err, database.ErrNotFound) {
+			return err
+		}
+		err = a.store.Insert(r.Context(), key, rec)
+		if err == nil {
+			return a.writeRecord(w, r, key, http.StatusCreated)
+		}
+		if !errors.Is(err, database.ErrExists) {
+			return err
+		}
+	}
+}
+
+// patch will change the fields of the link of the key that are set in
+// the body, as a JSON merge patch: fields set to null are cleared. The
+// link is read, changed and written atomically, see database.Store.Update.
+func (a *API) patch(w http.ResponseWriter, r *http.Request, key string) error {
+	var changes map[string]json.RawMessage
+	if err := readJSON(r, &changes); err != nil {
+		return err
+	}
+	err := a.store.Update(r.Context(), key, func(rec *database.Record) error {
+		patched, err := mergePatch(*rec, changes)
+		if err != nil {
+			return err
+		}
+		if err := checkKey(key, patched); err != nil {
+			return err
+		}
+		if err := check(key, patched); err != nil {
+			return err
+		}
+		*rec = patched
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return a.writeRecord(w, r, key, http.StatusOK)
+}
+
+// mergePatch will return the link with the changes of a JSON merge
+// patch.
+func mergePatch(rec database.Record, changes map[string]json.RawMessage) (database.Record, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return rec, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return rec, err
+	}
+	for name, value := range changes {
+		if string(value) == "null" {
+			delete(fields, name)
+		} else {
+			fields[name] = value
+		}
+	}
+	if data, err = json.Marshal(fields); err != nil {
+		return rec, err
+	}
+	var patched database.Record
+	if err := json.Unmarshal(data, &patched); err != nil {
+		return rec, errorf(http.StatusBadRequest, "invalid JSON body: %v", err)
+	}
+	return patched, nil
+}
+
+// delete will remove the link of the key.
+func (a *API) delete(w http.ResponseWriter, r *http.Request, key string) error {
+	if err := a.store.Delete(r.Context(), key); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// writeRecord will read the link of the key back from the Store and
+// write it, with its location for a created link.
+func (a *API) writeRecord(w http.ResponseWriter, r *http.Request, key string, status int) error {
+	rec, err := a.store.Get(r.Context(), key)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusCreated {
+		w.Header().Set("Location", Location(key))
+	}
+	return writeJSON(w, status, rec)
+}
+
+// Location will return the API path of the link of the key.
+func Location(key string) string {
+	host, path := database.SplitHostKey(key)
+	loc := Prefix + path
+	if host != "" {
+		loc += "?host=" + url.QueryEscape(host)
+	}
+	return loc
+}
+
+// checkKey will return an error if the path or the host of the link
+// are set, and are not the ones of the key of the URL.
+func checkKey(key string, rec database.Record) error {
+	host, path := database.SplitHostKey(key)
+	if rec.Path != "" && rec.Path != path {
+		return errorf(http.StatusUnprocessableEntity, "path %q does not match the path %q of the URL", rec.Path, path)
+	}
+	if rec.Host != "" && strings.ToLower(rec.Host) != host {
+		return errorf(http.StatusUnprocessableEntity, "host %q does not match the host %q of the URL", rec.Host, host)
+	}
+	return nil
+}
+
+// check will validate the link, see urlshort.CheckRecord.
+func check(key string, rec database.Record) error {
+	if err := urlshort.CheckRecord(key, rec); err != nil {
+		return &httpError{status: http.StatusUnprocessableEntity, err: err}
+	}
+	return nil
+}
+
+// readJSON will decode the JSON body of the request.
+func readJSON(r *http.Request, v interface{}) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/json") {
+		return errorf(http.StatusUnsupportedMediaType, "content type %q is not application/json", ct)
+	}
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxBodySize))
+	if err := dec.Decode(v); err != nil {
+		return errorf(http.StatusBadRequest, "invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+// writeJSON will write the value as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// methodNotAllowed will return the error for an unsupported method,
+// with the allowed ones.
+func methodNotAllowed(w http.ResponseWriter, allow string) error {
+	w.Header().Set("Allow", allow)
+	return errorf(http.StatusMethodNotAllowed, "method not allowed, use %s", allow)
+}
+
+// writeError will write the error as a JSON body, with the status code
+// of the error. Unexpected errors are logged, and not shown to the client.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var herr *httpError
+	status := http.StatusInternalServerError
+	msg := http.StatusText(status)
+	switch {
+	case errors.As(err, &herr):
+		status, msg = herr.status, herr.Error()
+	case errors.Is(err, database.ErrNotFound):
+		status, msg = http.StatusNotFound, err.Error()
+	case errors.Is(err, database.ErrExists):
+		status, msg = http.StatusConflict, err.Error()
+	case errors.Is(err, generator.ErrExhausted):
+		status, msg = http.StatusConflict, err.Error()
+	case errors.Is(err, database.ErrReadOnly):
+		status, msg = http.StatusServiceUnavailable, err.Error()
+	case errors.Is(err, database.ErrInvalidQuery):
+		status, msg = http.StatusBadRequest, err.Error()
+	default:
+		log.Printf("api: %s %s: %v", r.Method, r.URL.Path, err)
+	}
+	writeJSON(w, status, map[string]string{"error": msg})
+}
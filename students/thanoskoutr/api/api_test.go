@@ -0,0 +1,332 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/generator"
+)
+
+func TestAPI(t *testing.T) {
+	a := New(database.NewMemStore(), &generator.Generator{Strategy: generator.Sequence{}, Prefix: "/s/"})
+	tests := []struct {
+		method   string
+		path     string
+		body     string
+		status   int
+		location string
+		url      string
+	}{
+		// Create, with a path and with a generated one
+		{"POST", "/api/links", `{"path":"/gh","url":"https://github.com"}`, http.StatusCreated, "/api/links/gh", "https://github.com"},
+		{"POST", "/api/links", `{"path":"/gh","url":"https://github.com"}`, http.StatusConflict, "", ""},
+		{"POST", "/api/links", `{"url":"https://example.com/long"}`, http.StatusCreated, "/api/links/s/3", "https://example.com/long"},
+		{"POST", "/api/links", `{"path":"/pkg","host":"Go.Example.com","url":"https://pkg.go.dev"}`, http.StatusCreated, "/api/links/pkg?host=go.example.com", "https://pkg.go.dev"},
+		// Validation
+		{"POST", "/api/links", `{"path":"/bad","url":"example.com"}`, http.StatusUnprocessableEntity, "", ""},
+		{"POST", "/api/links", `{"path":"/bad","url":"https://example.com","status":200}`, http.StatusUnprocessableEntity, "", ""},
+		{"POST", "/api/links", `{"path":"/bad",`, http.StatusBadRequest, "", ""},
+		{"POST", "/api/links", `{"path":"gh/x","url":"https://github.com"}`, http.StatusUnprocessableEntity, "", ""},
+		{"POST", "/api/links", `{"path":"/x","host":"example.com/a","url":"https://github.com"}`, http.StatusUnprocessableEntity, "", ""},
+		// Get, replace and change
+		{"GET", "/api/links/gh", "", http.StatusOK, "", "https://github.com"},
+		{"GET", "/api/links/pkg?host=go.example.com", "", http.StatusOK, "", "https://pkg.go.dev"},
+		{"GET", "/api/links/pkg", "", http.StatusNotFound, "", ""},
+		{"PUT", "/api/links/gh", `{"url":"https://github.com/golang","status":301}`, http.StatusOK, "", "https://github.com/golang"},
+		{"PUT", "/api/links/gl", `{"url":"https://gitlab.com"}`, http.StatusCreated, "/api/links/gl", "https://gitlab.com"},
+		{"PATCH", "/api/links/gh", `{"description":"Go on GitHub","status":null}`, http.StatusOK, "", "https://github.com/golang"},
+		{"PATCH", "/api/links/missing", `{"description":"none"}`, http.StatusNotFound, "", ""},
+		{"PATCH", "/api/links/gh", `{"query":"sometimes"}`, http.StatusUnprocessableEntity, "", ""},
+		// The path and the host of the body are the ones of the URL
+		{"PUT", "/api/links/pkg?host=go.example.com", `{"path":"/pkg","host":"Go.Example.com","url":"https://pkg.go.dev/std"}`, http.StatusOK, "", "https://pkg.go.dev/std"},
+		{"PUT", "/api/links/gh", `{"path":"/github","url":"https://github.com"}`, http.StatusUnprocessableEntity, "", ""},
+		{"PUT", "/api/links/gh", `{"host":"go.example.com","url":"https://github.com"}`, http.StatusUnprocessableEntity, "", ""},
+		{"PATCH", "/api/links/gh", `{"path":"/github"}`, http.StatusUnprocessableEntity, "", ""},
+		{"PATCH", "/api/links/pkg?host=go.example.com", `{"host":"example.com"}`, http.StatusUnprocessableEntity, "", ""},
+		// Delete
+		{"DELETE", "/api/links/gl", "", http.StatusNoContent, "", ""},
+		{"DELETE", "/api/links/gl", "", http.StatusNotFound, "", ""},
+		{"POST", "/api/links/gh", "", http.StatusMethodNotAllowed, "", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		rr := httptest.NewRecorder()
+		a.ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("%s %s: wrong status code: got %v want %v (%s)",
+				tt.method, tt.path, rr.Code, tt.status, rr.Body)
+			continue
+		}
+		if location := rr.Header().Get("Location"); location != tt.location {
+			t.Errorf("%s %s: wrong location: got %v want %v", tt.method, tt.path, location, tt.location)
+		}
+		if rr.Code == http.StatusNoContent {
+			continue
+		}
+		var body struct {
+			Url   string `json:"url"`
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s %s: invalid JSON body: %v", tt.method, tt.path, err)
+		}
+		if body.Url != tt.url {
+			t.Errorf("%s %s: wrong url: got %v want %v", tt.method, tt.path, body.Url, tt.url)
+		}
+		if (rr.Code >= 400) != (body.Error != "") {
+			t.Errorf("%s %s: wrong error: %q", tt.method, tt.path, body.Error)
+		}
+	}
+
+	// The patched fields are changed, the others are kept
+	req := httptest.NewRequest("GET", "/api/links/gh", nil)
+	rr := httptest.NewRecorder()
+	a.ServeHTTP(rr, req)
+	var rec database.Record
+	json.Unmarshal(rr.Body.Bytes(), &rec)
+	if rec.Description != "Go on GitHub" || rec.Status != 0 || rec.Path != "/gh" {
+		t.Errorf("wrong patched record: %+v", rec)
+	}
+
+	// The links are listed by key
+	req = httptest.NewRequest("GET", "/api/links", nil)
+	rr = httptest.NewRecorder()
+	a.ServeHTTP(rr, req)
+	var links []database.Record
+	if err := json.Unmarshal(rr.Body.Bytes(), &links); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, link := range links {
+		paths = append(paths, link.Host+link.Path)
+	}
+	if got, want := strings.Join(paths, " "), "/gh /s/3 go.example.com/pkg"; got != want {
+		t.Errorf("wrong links: got %v want %v", got, want)
+	}
+}
+
+// barrierStore is a Store whose first n calls wait for each other,
+// reads after reading and writes before writing, so that concurrent
+// requests all check the link before any of them writes it.
+type barrierStore struct {
+	database.Store
+	n       int32
+	arrived sync.WaitGroup
+}
+
+func newBarrierStore(store database.Store, n int) *barrierStore {
+	s := &barrierStore{Store: store, n: int32(n)}
+	s.arrived.Add(n)
+	return s
+}
+
+func (s *barrierStore) wait() {
+	if atomic.AddInt32(&s.n, -1) >= 0 {
+		s.arrived.Done()
+		s.arrived.Wait()
+	}
+}
+
+func (s *barrierStore) Get(ctx context.Context, key string) (database.Record, error) {
+	rec, err := s.Store.Get(ctx, key)
+	s.wait()
+	return rec, err
+}
+
+func (s *barrierStore) Put(ctx context.Context, key string, rec database.Record) error {
+	s.wait()
+	return s.Store.Put(ctx, key, rec)
+}
+
+func (s *barrierStore) Insert(ctx context.Context, key string, rec database.Record) error {
+	s.wait()
+	return s.Store.Insert(ctx, key, rec)
+}
+
+func (s *barrierStore) Replace(ctx context.Context, key string, rec database.Record) error {
+	s.wait()
+	return s.Store.Replace(ctx, key, rec)
+}
+
+func (s *barrierStore) Update(ctx context.Context, key string, fn func(rec *database.Record) error) error {
+	s.wait()
+	return s.Store.Update(ctx, key, fn)
+}
+
+func TestAPIConcurrentCreate(t *testing.T) {
+	db, err := database.SetupDB(filepath.Join(t.TempDir(), "urls.db"), "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Only one of the requests creates the link, for POST and for PUT
+	const requests = 10
+	for _, method := range []string{"POST", "PUT"} {
+		a := New(newBarrierStore(db, requests), nil)
+		var wg sync.WaitGroup
+		codes := make(chan int, requests)
+		for i := 0; i < requests; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				body := fmt.Sprintf(`{"path":"/race-%s","url":"https://example.com/%d"}`, method, i)
+				req := httptest.NewRequest(method, "/api/links/race-"+method, strings.NewReader(body))
+				if method == "POST" {
+					req.URL.Path = "/api/links"
+				}
+				rr := httptest.NewRecorder()
+				a.ServeHTTP(rr, req)
+				codes <- rr.Code
+			}(i)
+		}
+		wg.Wait()
+		close(codes)
+		created := 0
+		for code := range codes {
+			if code == http.StatusCreated {
+				created++
+			}
+		}
+		if created != 1 {
+			t.Errorf("%s: %d requests created the link, want 1", method, created)
+		}
+	}
+}
+
+func TestAPIConcurrentPatch(t *testing.T) {
+	db, err := database.SetupDB(filepath.Join(t.TempDir(), "urls.db"), "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put(context.Background(), "/gh", database.Record{Url: "https://github.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent changes of different fields are all kept
+	changes := []string{`{"description":"GitHub"}`, `{"tags":["code"]}`, `{"status":301}`}
+	a := New(newBarrierStore(db, len(changes)), nil)
+	var wg sync.WaitGroup
+	for _, body := range changes {
+		wg.Add(1)
+		go func(body string) {
+			defer wg.Done()
+			req := httptest.NewRequest("PATCH", "/api/links/gh", strings.NewReader(body))
+			rr := httptest.NewRecorder()
+			a.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Errorf("PATCH %s: wrong status code: got %v want %v (%s)", body, rr.Code, http.StatusOK, rr.Body)
+			}
+		}(body)
+	}
+	wg.Wait()
+	rec, err := db.Get(context.Background(), "/gh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Description != "GitHub" || len(rec.Tags) != 1 || rec.Status != 301 {
+		t.Errorf("lost a concurrent change: %+v", rec)
+	}
+}
+
+func TestAPIWithoutGenerator(t *testing.T) {
+	a := New(database.NewMemStore(), nil)
+	req := httptest.NewRequest("POST", "/api/links", strings.NewReader(`{"url":"https://example.com"}`))
+	rr := httptest.NewRecorder()
+	a.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestClicks(t *testing.T) {
+	db, err := database.SetupDB(filepath.Join(t.TempDir(), "urls.db"), "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	start := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	clicks := []database.Click{
+		{Time: start, Key: "/gh", Path: "/gh", URL: "https://github.com", Referrer: "example.com", Agent: "browser", IP: "192.0.2.0"},
+		{Time: start.Add(time.Hour), Key: "/gh", Path: "/gh", URL: "https://github.com", Agent: "cli"},
+		{Time: start.AddDate(0, 0, 1), Key: "go.example.com/pkg", Path: "/pkg", URL: "https://pkg.go.dev", Agent: "bot"},
+	}
+	for _, c := range clicks {
+		if err := db.RecordClick(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := NewClicks(db)
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/api/clicks", http.StatusOK, `[{"key":"/gh","clicks":2,"first":"2026-10-01T10:00:00Z","last":"2026-10-01T11:00:00Z"},` +
+			`{"key":"go.example.com/pkg","clicks":1,"first":"2026-10-02T10:00:00Z","last":"2026-10-02T10:00:00Z"}]`},
+		{"/api/clicks/series?link=/gh&from=2026-10-01&to=2026-10-03", http.StatusOK,
+			`[{"time":"2026-10-01T00:00:00Z","clicks":2},{"time":"2026-10-02T00:00:00Z","clicks":0}]`},
+		{"/api/clicks/series?link=/pkg&host=go.example.com&step=hour&from=2026-10-02T09:00:00Z&to=2026-10-02T11:00:00Z", http.StatusOK,
+			`[{"time":"2026-10-02T09:00:00Z","clicks":0},{"time":"2026-10-02T10:00:00Z","clicks":1}]`},
+		{"/api/clicks/top", http.StatusOK, `[{"value":"/gh","clicks":2},{"value":"go.example.com/pkg","clicks":1}]`},
+		{"/api/clicks/top?by=agent&limit=1&from=2026-10-02", http.StatusOK, `[{"value":"bot","clicks":1}]`},
+		// Invalid queries
+		{"/api/clicks/series?step=month", http.StatusBadRequest, ""},
+		{"/api/clicks/series?from=2026-10-03&to=2026-10-01", http.StatusBadRequest, ""},
+		{"/api/clicks/series?step=hour&from=2020-01-01&to=2026-01-01", http.StatusBadRequest, ""},
+		{"/api/clicks/top?by=ip", http.StatusBadRequest, ""},
+		{"/api/clicks/top?limit=-1", http.StatusBadRequest, ""},
+		{"/api/clicks/export?from=yesterday", http.StatusBadRequest, ""},
+		{"/api/clicks/missing", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		c.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+		if rr.Code != tt.status {
+			t.Errorf("GET %s: wrong status code: got %v want %v (%s)", tt.path, rr.Code, tt.status, rr.Body)
+			continue
+		}
+		if tt.body == "" {
+			continue
+		}
+		var got bytes.Buffer
+		if err := json.Compact(&got, rr.Body.Bytes()); err != nil || got.String() != tt.body {
+			t.Errorf("GET %s: wrong body:\ngot  %s\nwant %s", tt.path, rr.Body, tt.body)
+		}
+	}
+
+	// CSV
+	csvTests := []struct {
+		path string
+		body string
+	}{
+		{"/api/clicks/series?link=/gh&from=2026-10-01&to=2026-10-02&format=csv", "time,clicks\n2026-10-01T00:00:00Z,2\n"},
+		{"/api/clicks/top?by=referrer&format=csv", "referrer,clicks\n,2\nexample.com,1\n"},
+		{"/api/clicks/export?to=2026-10-02", "time,key,path,url,referrer,agent,ip\n" +
+			"2026-10-01T10:00:00Z,/gh,/gh,https://github.com,example.com,browser,192.0.2.0\n" +
+			"2026-10-01T11:00:00Z,/gh,/gh,https://github.com,,cli,\n"},
+	}
+	for _, tt := range csvTests {
+		rr := httptest.NewRecorder()
+		c.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+		if ct := rr.Header().Get("Content-Type"); rr.Code != http.StatusOK || !strings.HasPrefix(ct, "text/csv") {
+			t.Errorf("GET %s: wrong response: got %v %s (%s)", tt.path, rr.Code, ct, rr.Body)
+			continue
+		}
+		if got := rr.Body.String(); got != tt.body {
+			t.Errorf("GET %s: wrong CSV:\ngot  %q\nwant %q", tt.path, got, tt.body)
+		}
+	}
+}
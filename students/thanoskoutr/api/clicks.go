@@ -0,0 +1,239 @@
+package api
+
+import (
+	"encoding/csv"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+)
+
+// ClicksPrefix is the path the clicks are served under.
+const ClicksPrefix = "/api/clicks"
+
+// defaultSpans are the ranges of the series of each step, that end now,
+// when the range is not set.
+var defaultSpans = map[string]time.Duration{
+	database.StepHour: 24 * time.Hour,
+	database.StepDay:  30 * 24 * time.Hour,
+	database.StepWeek: 12 * 7 * 24 * time.Hour,
+}
+
+// Clicks is an http.Handler that serves the clicks of the links of a
+// Database.
+type Clicks struct {
+	db *database.Database
+}
+
+// NewClicks will return a Clicks for the clicks of the Database.
+func NewClicks(db *database.Database) *Clicks {
+	return &Clicks{db: db}
+}
+
+// ServeHTTP will route the request to the handler of its path.
+func (c *Clicks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		err = methodNotAllowed(w, "GET, HEAD")
+	} else {
+		switch strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, ClicksPrefix), "/") {
+		case "":
+			err = c.counts(w, r)
+		case "/series":
+			err = c.series(w, r)
+		case "/top":
+			err = c.top(w, r)
+		case "/export":
+			err = c.export(w, r)
+		default:
+			err = errorf(http.StatusNotFound, "path %q is not served by the API", r.URL.Path)
+		}
+	}
+	if err != nil {
+		writeError(w, r, err)
+	}
+}
+
+// linkCount is the counter of the clicks of a link.
+type linkCount struct {
+	Key string `json:"key"`
+	database.ClickCount
+}
+
+// counts will return the counters of the links, from the most clicked
+// one.
+func (c *Clicks) counts(w http.ResponseWriter, r *http.Request) error {
+	counts, err := database.GetClickCountsDB(c.db)
+	if err != nil {
+		return err
+	}
+	links := make([]linkCount, 0, len(counts))
+	for key, count := range counts {
+		links = append(links, linkCount{Key: key, ClickCount: count})
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Clicks != links[j].Clicks {
+			return links[i].Clicks > links[j].Clicks
+		}
+		return links[i].Key < links[j].Key
+	})
+	if r.URL.Query().Get("format") != "csv" {
+		return writeJSON(w, http.StatusOK, links)
+	}
+	rows := [][]string{{"key", "clicks", "first", "last"}}
+	for _, l := range links {
+		rows = append(rows, []string{l.Key, strconv.FormatUint(l.Clicks, 10), formatTime(l.First), formatTime(l.Last)})
+	}
+	return writeCSV(w, "clicks.csv", rows)
+}
+
+// series will return the clicks per step of a range, of a link or of
+// all of them.
+func (c *Clicks) series(w http.ResponseWriter, r *http.Request) error {
+	step := r.URL.Query().Get("step")
+	if step == "" {
+		step = database.StepDay
+	}
+	span, ok := defaultSpans[step]
+	if !ok {
+		return errorf(http.StatusBadRequest, "unknown step %q, want hour, day or week", step)
+	}
+	f, err := clickFilter(r)
+	if err != nil {
+		return err
+	}
+	if f.To.IsZero() {
+		f.To = time.Now().UTC()
+	}
+	if f.From.IsZero() {
+		f.From = f.To.Add(-span)
+	}
+	points, err := database.ClickSeriesDB(c.db, f, step)
+	if err != nil {
+		return err
+	}
+	if r.URL.Query().Get("format") != "csv" {
+		return writeJSON(w, http.StatusOK, points)
+	}
+	rows := [][]string{{"time", "clicks"}}
+	for _, p := range points {
+		rows = append(rows, []string{formatTime(p.Time), strconv.FormatUint(p.Clicks, 10)})
+	}
+	return writeCSV(w, "series.csv", rows)
+}
+
+// top will return the most clicked values of a field: the links, the
+// referrers or the user agent classes.
+func (c *Clicks) top(w http.ResponseWriter, r *http.Request) error {
+	by := r.URL.Query().Get("by")
+	if by == "" {
+		by = database.FieldKey
+	}
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errorf(http.StatusBadRequest, "limit %q is not a number of values, or 0 for all of them", v)
+		}
+		limit = n
+	}
+	f, err := clickFilter(r)
+	if err != nil {
+		return err
+	}
+	top, err := database.TopClicksDB(c.db, f, by, limit)
+	if err != nil {
+		return err
+	}
+	if r.URL.Query().Get("format") != "csv" {
+		return writeJSON(w, http.StatusOK, top)
+	}
+	rows := [][]string{{by, "clicks"}}
+	for _, t := range top {
+		rows = append(rows, []string{t.Value, strconv.FormatUint(t.Clicks, 10)})
+	}
+	return writeCSV(w, "top-"+by+".csv", rows)
+}
+
+// export will stream the clicks of a range as CSV, in time order.
+func (c *Clicks) export(w http.ResponseWriter, r *http.Request) error {
+	f, err := clickFilter(r)
+	if err != nil {
+		return err
+	}
+	setCSVHeaders(w, "export.csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "key", "path", "url", "referrer", "agent", "ip"})
+	err = database.ScanClicksDB(c.db, f, func(click database.Click) error {
+		return cw.Write([]string{formatTime(click.Time), click.Key, click.Path, click.URL, click.Referrer, click.Agent, click.IP})
+	})
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	// The response is already sent, so the error can only be logged
+	if err != nil {
+		log.Printf("api: %s %s: %v", r.Method, r.URL.Path, err)
+	}
+	return nil
+}
+
+// clickFilter will return the filter of the query parameters of the
+// request: the link (with its host, like the links), from and to, as
+// RFC 3339 times or dates, e.g. 2026-10-01.
+func clickFilter(r *http.Request) (database.ClickFilter, error) {
+	q := r.URL.Query()
+	var f database.ClickFilter
+	if link := q.Get("link"); link != "" {
+		f.Key = database.HostKey(q.Get("host"), link)
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := parseTime(v)
+		if err != nil {
+			return f, errorf(http.StatusBadRequest, "%s %q is not a time, e.g. 2026-10-01 or 2026-10-01T12:00:00Z", p.name, v)
+		}
+		*p.t = t
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && !f.From.Before(f.To) {
+		return f, errorf(http.StatusBadRequest, "from must be before to")
+	}
+	return f, nil
+}
+
+// parseTime will parse an RFC 3339 time or a date.
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// formatTime will format the time for CSV, in UTC.
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// setCSVHeaders will set the headers of a CSV file download.
+func setCSVHeaders(w http.ResponseWriter, name string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+}
+
+// writeCSV will write the rows as the CSV body of the response.
+func writeCSV(w http.ResponseWriter, name string, rows [][]string) error {
+	setCSVHeaders(w, name)
+	cw := csv.NewWriter(w)
+	cw.WriteAll(rows)
+	return cw.Error()
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/config"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/urlshort"
+	"gopkg.in/yaml.v2"
+)
+
+// Exit codes of the commands
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
+
+// command is a subcommand of the CLI
+type command struct {
+	args string
+	help string
+	run  func(args []string, stdout io.Writer) error
+}
+
+// commands are the subcommands of the CLI, serve is the default one
+var commands = map[string]command{
+	"serve":     {"[flags]", "start the server (default)", serve},
+	"add":       {"[flags] <key> <url>", "add a link", add},
+	"get":       {"[flags] <key>", "show a link", get},
+	"rm":        {"[flags] <key>...", "remove links", rm},
+	"ls":        {"[flags] [prefix]", "list the links, optionally only the keys with the prefix", ls},
+	"import":    {"[flags] <file>", "add the links of a file, in any supported format, - for stdin", importLinks},
+	"export":    {"[flags] [file]", "write the links as a YAML or JSON file, to stdout by default", exportLinks},
+	"mv":        {"[flags] <key> <new-key>", "move a link to a new key", mv},
+	"validate":  {"[flags] <file>...", "check files of links, fails if they have errors", validate},
+	"lint":      {"[flags] <file>...", "same as validate", validate},
+	"conflicts": {"[flags]", "list the paths defined in more than one source, fails if there are any", conflicts},
+	"explain":   {"[flags] <url>", "show how the server resolves a URL, e.g. /gh or go.example.com/pkg?x=1", explain},
+}
+
+// usageError is an error in the arguments of a command
+type usageError struct {
+	err error
+}
+
+func (e usageError) Error() string {
+	return e.err.Error()
+}
+
+// run runs the subcommand of the arguments, and returns its exit code
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage(stdout)
+		return exitOK
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "urlshort: unknown command %q\n", name)
+		usage(stderr)
+		return exitUsage
+	}
+	err := cmd.run(args, stdout)
+	var uerr usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &uerr):
+		fmt.Fprintf(stderr, "urlshort %s: %v\nusage: urlshort %s %s\n", name, err, name, cmd.args)
+		return exitUsage
+	case errors.Is(err, database.ErrNotFound):
+		fmt.Fprintf(stderr, "urlshort %s: %v\n", name, err)
+		return exitNotFound
+	case errors.Is(err, database.ErrLocked):
+		fmt.Fprintf(stderr, "urlshort %s: %v, stop the server or use its API\n", name, err)
+		return exitError
+	default:
+		fmt.Fprintf(stderr, "urlshort %s: %v\n", name, err)
+		return exitError
+	}
+}
+
+// usage writes the list of the subcommands
+func usage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "usage: urlshort <command> [flags] [arguments]")
+	fmt.Fprintln(w, "\ncommands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", name, commands[name].args, commands[name].help)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "\nRun urlshort <command> -h for the flags of a command.")
+}
+
+// parseFlags parses the flags of a command, and checks that it got
+// from min to max arguments, or more if max is negative
+func parseFlags(flags *flag.FlagSet, args []string, min int, max int) error {
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			flags.SetOutput(os.Stderr)
+			flags.PrintDefaults()
+			return err
+		}
+		return usageError{err}
+	}
+	if flags.NArg() < min {
+		return usageError{errors.New("missing arguments")}
+	}
+	if max >= 0 && flags.NArg() > max {
+		return usageError{errors.New("too many arguments")}
+	}
+	return nil
+}
+
+// dbFlag adds the flag for the Database file
+func dbFlag(flags *flag.FlagSet) *string {
+	return flags.String("db", "urls.db", "Database file")
+}
+
+// formatFlag adds the flag for the output format
+func formatFlag(flags *flag.FlagSet, def string, formats ...string) *string {
+	return flags.String("o", def, "Output format: "+strings.Join(formats, ", "))
+}
+
+// openReadOnly opens the Database read-only, or a snapshot of it if
+// another process (e.g. the server) holds it open for writing
+func openReadOnly(name string) (*database.Database, error) {
+	db, err := database.SetupReadOnlyDB(name, bucketName)
+	if errors.Is(err, database.ErrLocked) {
+		return database.SetupSnapshotDB(name, bucketName)
+	}
+	return db, err
+}
+
+// add adds a link
+func add(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("add", flag.ContinueOnError)
+	dbFilename := dbFlag(flags)
+	status := flags.Int("status", 0, "Status code of the redirect: 301, 302, 303, 307 or 308")
+	query := flags.String("query", "", "Query policy: drop, append, merge or replace")
+	description := flags.String("description", "", "Description of the link")
+	tags := flags.String("tags", "", "Comma separated tags of the link")
+	disabled := flags.Bool("disabled", false, "Add the link disabled")
+	force := flags.Bool("f", false, "Replace the link if the key exists")
+	if err := parseFlags(flags, args, 2, 2); err != nil {
+		return err
+	}
+	key := flags.Arg(0)
+	rec := database.Record{
+		Url:         flags.Arg(1),
+		Status:      *status,
+		Query:       *query,
+		Description: *description,
+		Disabled:    *disabled,
+	}
+	for _, tag := range strings.Split(*tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			rec.Tags = append(rec.Tags, tag)
+		}
+	}
+	if err := urlshort.CheckRecord(key, rec); err != nil {
+		return usageError{err}
+	}
+	db, err := database.SetupDB(*dbFilename, bucketName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if !*force {
+		if _, err := database.GetRecordDB(db, key); err == nil {
+			return fmt.Errorf("key %q already exists, use -f to replace it", key)
+		} else if !errors.Is(err, database.ErrNotFound) {
+			return err
+		}
+	}
+	return database.PutRecordDB(db, key, rec)
+}
+
+// get shows a link
+func get(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	dbFilename := dbFlag(flags)
+	format := formatFlag(flags, "table", "table", "json", "yaml", "url")
+	if err := parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+	db, err := openReadOnly(*dbFilename)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	rec, err := database.GetRecordDB(db, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "url":
+		_, err = fmt.Fprintln(stdout, rec.Url)
+		return err
+	case "json", "yaml":
+		return writeEncoded(stdout, *format, rec)
+	}
+	return writeTable(stdout, *format, map[string]database.Record{flags.Arg(0): rec})
+}
+
+// rm removes links
+func rm(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("rm", flag.ContinueOnError)
+	dbFilename := dbFlag(flags)
+	if err := parseFlags(flags, args, 1, -1); err != nil {
+		return err
+	}
+	db, err := database.SetupDB(*dbFilename, bucketName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var firstErr error
+	for _, key := range flags.Args() {
+		if err := database.DeleteEntryDB(db, key); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ls lists the links
+func ls(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	dbFilename := dbFlag(flags)
+	format := formatFlag(flags, "table", "table", "json", "yaml")
+	if err := parseFlags(flags, args, 0, 1); err != nil {
+		return err
+	}
+	records, err := readRecords(*dbFilename, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *format == "json" || *format == "yaml" {
+		return writeEncoded(stdout, *format, sortedRecords(records))
+	}
+	return writeTable(stdout, *format, records)
+}
+
+// importLinks adds the links of a YAML or JSON file
+func importLinks(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dbFilename := dbFlag(flags)
+	enc := flags.String("format", "", "Format of the file: "+strings.Join(urlshort.Formats, ", ")+", by default detected")
+	if err := parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+	name := flags.Arg(0)
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return err
+	}
+	if *enc == "" {
+		*enc = urlshort.DetectFormat(name, data)
+	}
+	records, err := urlshort.ParseRecords(data, *enc)
+	if err != nil {
+		return err
+	}
+	for key, rec := range records {
+		if err := urlshort.CheckRecord(key, rec); err != nil {
+			return err
+		}
+	}
+	db, err := database.SetupDB(*dbFilename, bucketName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := database.PutRecordsDB(db, records); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stdout, "imported %d links\n", len(records))
+	return err
+}
+
+// exportLinks writes the links as a YAML or JSON file
+func exportLinks(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	dbFilename := dbFlag(flags)
+	format := formatFlag(flags, "", "yaml", "json")
+	if err := parseFlags(flags, args, 0, 1); err != nil {
+		return err
+	}
+	name := flags.Arg(0)
+	if *format == "" {
+		*format = formatOf(name)
+	}
+	if *format != "yaml" && *format != "json" {
+		return usageError{fmt.Errorf("unknown format %q", *format)}
+	}
+	records, err := readRecords(*dbFilename, "")
+	if err != nil {
+		return err
+	}
+	if name == "" || name == "-" {
+		return writeEncoded(stdout, *format, sortedRecords(records))
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := writeEncoded(f, *format, sortedRecords(records)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mv moves a link to a new key
+func mv(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("mv", flag.ContinueOnError)
+	dbFilename := dbFlag(flags)
+	if err := parseFlags(flags, args, 2, 2); err != nil {
+		return err
+	}
+	if err := urlshort.CheckRecord(flags.Arg(1), database.Record{Url: "https://example.com"}); err != nil {
+		return usageError{err}
+	}
+	db, err := database.SetupDB(*dbFilename, bucketName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return database.MoveRecordDB(db, flags.Arg(0), flags.Arg(1))
+}
+
+// validate checks YAML and JSON files, and fails if they have errors,
+// or any problem in strict mode
+func validate(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	strict := flags.Bool("strict", false, "Fail on warnings too")
+	format := formatFlag(flags, "text", "text", "json")
+	if err := parseFlags(flags, args, 1, -1); err != nil {
+		return err
+	}
+	diags := []urlshort.Diagnostic{}
+	for _, name := range flags.Args() {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		diags = append(diags, urlshort.Validate(name, data, "")...)
+	}
+	if *format == "json" {
+		if err := writeEncoded(stdout, "json", diags); err != nil {
+			return err
+		}
+	} else {
+		for _, d := range diags {
+			fmt.Fprintln(stdout, d)
+		}
+	}
+	if urlshort.HasErrors(diags) || (*strict && len(diags) > 0) {
+		return fmt.Errorf("%d problems found", len(diags))
+	}
+	return nil
+}
+
+// explain shows every source of the chain of handlers consulted for the
+// URL, the entries that match it, and where it is redirected
+func explain(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	chainFlags := addChainFlags(flags)
+	host := flags.String("host", "", "Host of the request, if the URL has none")
+	format := formatFlag(flags, "text", "text", "json")
+	if err := parseFlags(flags, args, 1, 1); err != nil {
+		return err
+	}
+	req, err := explainRequest(flags.Arg(0), *host)
+	if err != nil {
+		return usageError{err}
+	}
+	chain, closeChain, err := openChain(chainFlags)
+	if err != nil {
+		return err
+	}
+	defer closeChain()
+	e := chain.Explain(req)
+	if *format == "json" {
+		if err := writeEncoded(stdout, "json", e); err != nil {
+			return err
+		}
+	} else if err := writeExplanation(stdout, e); err != nil {
+		return err
+	}
+	if e.Match == nil && e.Fallback != "" {
+		return fmt.Errorf("%s: %w", flags.Arg(0), database.ErrNotFound)
+	}
+	return nil
+}
+
+// conflicts lists the paths defined in more than one source of the
+// chain of handlers, and fails if there are any
+func conflicts(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("conflicts", flag.ContinueOnError)
+	chainFlags := addChainFlags(flags)
+	format := formatFlag(flags, "table", "table", "json")
+	if err := parseFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+	chain, closeChain, err := openChain(chainFlags)
+	if err != nil {
+		return err
+	}
+	defer closeChain()
+	conflicts, err := chain.Conflicts(context.Background())
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "json":
+		if conflicts == nil {
+			conflicts = []config.Conflict{}
+		}
+		err = writeEncoded(stdout, "json", conflicts)
+	case "table":
+		err = writeConflicts(stdout, conflicts)
+	default:
+		return usageError{fmt.Errorf("unknown format %q", *format)}
+	}
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%d conflicts found", len(conflicts))
+	}
+	return nil
+}
+
+// openChain builds the chain of handlers of the flags, reading the
+// Databases without locking out a running server, and returns a
+// function that closes it
+func openChain(chainFlags *chainFlags) (*config.Chain, func(), error) {
+	cfg, err := chainFlags.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range cfg.Sources {
+		cfg.Sources[i].Options.Reload = 0
+	}
+	builder := config.NewBuilder(bucketName)
+	builder.ReadOnly = true
+	chain, err := builder.Build(cfg)
+	if err != nil {
+		builder.Close()
+		return nil, nil, err
+	}
+	return chain, func() {
+		chain.Stop()
+		builder.Close()
+	}, nil
+}
+
+// writeConflicts writes the definitions of the conflicting paths as a
+// table, marking the one that is served
+func writeConflicts(w io.Writer, conflicts []config.Conflict) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tSOURCE\tKIND\tURL\tSTATUS\tNOTE")
+	for _, c := range conflicts {
+		for _, d := range c.Definitions {
+			status := "302"
+			if d.Status != 0 {
+				status = strconv.Itoa(d.Status)
+			}
+			note := "shadowed"
+			switch {
+			case d.Effective:
+				note = "effective"
+			case d.Disabled:
+				note = "disabled"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", c.Key, d.Source, d.Kind, d.URL, status, note)
+		}
+	}
+	return tw.Flush()
+}
+
+// explainRequest returns the request of a URL to explain, which can be
+// a path, a host and a path, or an absolute URL, with a query
+func explainRequest(target string, host string) (*http.Request, error) {
+	if !strings.HasPrefix(target, "/") && !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	if u.Host != "" {
+		host = u.Host
+	}
+	req, err := http.NewRequest(http.MethodGet, u.RequestURI(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = host
+	return req, nil
+}
+
+// writeExplanation writes the sources consulted for a request as a
+// table, with the entries that match, and where it is redirected
+func writeExplanation(w io.Writer, e config.Explanation) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tKIND\tMATCH\tKEY\tSTATUS\tURL\tNOTE")
+	for _, step := range e.Steps {
+		switch {
+		case step.Error != "":
+			fmt.Fprintf(tw, "%s\t%s\t-\t\t\t\terror: %s\n", step.Source, step.Kind, step.Error)
+		case len(step.Matches) == 0:
+			fmt.Fprintf(tw, "%s\t%s\t-\t\t\t\t\n", step.Source, step.Kind)
+		}
+		for i, m := range step.Matches {
+			note := "shadowed"
+			if i == 0 && !step.Shadowed {
+				note = "redirects"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", step.Source, step.Kind, m.Kind, m.Key, m.Status, m.URL, note)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	switch {
+	case e.Match != nil:
+		_, err := fmt.Fprintf(w, "=> %d %s (%s %s)\n", e.Status, e.URL, e.Source, e.Match.Key)
+		return err
+	case e.Fallback != "":
+		_, err := fmt.Fprintf(w, "=> fallback %s\n", e.Fallback)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "=> %d (%s failed)\n", e.Status, e.Source)
+	return err
+}
+
+// readRecords reads the links of the Database whose keys have the prefix
+func readRecords(name string, prefix string) (map[string]database.Record, error) {
+	db, err := openReadOnly(name)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	records := make(map[string]database.Record)
+	err = database.ForEachRecordDB(db, func(key string, rec database.Record) error {
+		if strings.HasPrefix(key, prefix) {
+			records[key] = rec
+		}
+		return nil
+	})
+	return records, err
+}
+
+// formatOf returns the format of a file from its extension, yaml by default
+func formatOf(name string) string {
+	if strings.EqualFold(filepath.Ext(name), ".json") {
+		return "json"
+	}
+	return "yaml"
+}
+
+// sortedRecords returns the records sorted by key, the order they are
+// written in
+func sortedRecords(records map[string]database.Record) []database.Record {
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sorted := make([]database.Record, 0, len(keys))
+	for _, key := range keys {
+		sorted = append(sorted, records[key])
+	}
+	return sorted
+}
+
+// writeEncoded writes the value as JSON or YAML, in the format of the files
+func writeEncoded(w io.Writer, format string, v interface{}) error {
+	var data []byte
+	var err error
+	if format == "json" {
+		data, err = json.MarshalIndent(v, "", "  ")
+		data = append(data, '\n')
+	} else {
+		data, err = yaml.Marshal(v)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// writeTable writes the records as a table, sorted by key
+func writeTable(w io.Writer, format string, records map[string]database.Record) error {
+	if format != "table" {
+		return usageError{fmt.Errorf("unknown format %q", format)}
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tURL\tSTATUS\tENABLED\tTAGS")
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		rec := records[key]
+		status := "302"
+		if rec.Status != 0 {
+			status = strconv.Itoa(rec.Status)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%s\n", key, rec.Url, status, !rec.Disabled, strings.Join(rec.Tags, ","))
+	}
+	return tw.Flush()
+}
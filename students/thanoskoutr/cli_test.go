@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+)
+
+// runCLI runs the command, and checks its exit code
+func runCLI(t *testing.T, code int, args ...string) string {
+	var stdout, stderr bytes.Buffer
+	if got := run(args, &stdout, &stderr); got != code {
+		t.Errorf("urlshort %s: wrong exit code: got %v want %v (%s)",
+			strings.Join(args, " "), got, code, stderr.String())
+	}
+	return stdout.String()
+}
+
+func TestCLI(t *testing.T) {
+	dbFilename := filepath.Join(t.TempDir(), "urls.db")
+
+	// Add links, and check their arguments
+	runCLI(t, exitOK, "add", "-db", dbFilename, "-status", "301", "-tags", "code, go", "/gh", "https://github.com")
+	runCLI(t, exitOK, "add", "-db", dbFilename, "go.example.com/pkg", "https://pkg.go.dev")
+	runCLI(t, exitError, "add", "-db", dbFilename, "/gh", "https://github.com/golang")
+	runCLI(t, exitOK, "add", "-db", dbFilename, "-f", "/gh", "https://github.com/golang")
+	runCLI(t, exitUsage, "add", "-db", dbFilename, "/gh")
+	runCLI(t, exitUsage, "add", "-db", dbFilename, "/bad", "not-a-url")
+	runCLI(t, exitUsage, "add", "-db", dbFilename, "-nope", "/bad", "https://example.com")
+	runCLI(t, exitUsage, "nope")
+
+	// Get them
+	if out := runCLI(t, exitOK, "get", "-db", dbFilename, "-o", "url", "/gh"); out != "https://github.com/golang\n" {
+		t.Errorf("wrong url: %q", out)
+	}
+	var rec database.Record
+	if err := json.Unmarshal([]byte(runCLI(t, exitOK, "get", "-db", dbFilename, "-o", "json", "go.example.com/pkg")), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Url != "https://pkg.go.dev" || rec.Host != "go.example.com" {
+		t.Errorf("wrong record: %+v", rec)
+	}
+	runCLI(t, exitNotFound, "get", "-db", dbFilename, "/missing")
+
+	// List them, as a table and with a prefix
+	out := runCLI(t, exitOK, "ls", "-db", dbFilename)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "KEY") || !strings.HasPrefix(lines[1], "/gh ") {
+		t.Errorf("wrong table:\n%s", out)
+	}
+	if out := runCLI(t, exitOK, "ls", "-db", dbFilename, "-o", "yaml", "go."); strings.Contains(out, "/gh") {
+		t.Errorf("wrong links with prefix:\n%s", out)
+	}
+
+	// Move and remove them
+	runCLI(t, exitOK, "mv", "-db", dbFilename, "/gh", "/github")
+	runCLI(t, exitNotFound, "mv", "-db", dbFilename, "/gh", "/github")
+	runCLI(t, exitError, "mv", "-db", dbFilename, "/github", "go.example.com/pkg")
+	runCLI(t, exitOK, "get", "-db", dbFilename, "/github")
+	runCLI(t, exitOK, "rm", "-db", dbFilename, "/github")
+	runCLI(t, exitNotFound, "rm", "-db", dbFilename, "/github")
+}
+
+func TestSeedDB(t *testing.T) {
+	db, err := database.SetupDB(filepath.Join(t.TempDir(), "urls.db"), bucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Seeding again keeps the edited links
+	if err := seedDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.PutEntryDB(db, "/gnu/ddd", "https://www.gnu.org/software/ddd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := seedDB(db); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := database.GetRecordDB(db, "/gnu/ddd"); err != nil || rec.Url != "https://www.gnu.org/software/ddd" {
+		t.Errorf("seeding replaced an edited link: %+v (%v)", rec, err)
+	}
+}
+
+func TestCLIImportExport(t *testing.T) {
+	dir := t.TempDir()
+	dbFilename := filepath.Join(dir, "urls.db")
+	yamlFilename := filepath.Join(dir, "urls.yaml")
+	data := "- path: /gh/*\n  url: https://github.com/*\n- path: /gl\n  url: https://gitlab.com\n  enabled: false\n"
+	if err := os.WriteFile(yamlFilename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out := runCLI(t, exitOK, "import", "-db", dbFilename, yamlFilename); out != "imported 2 links\n" {
+		t.Errorf("wrong import output: %q", out)
+	}
+
+	// Export as JSON, and import it to another Database
+	jsonFilename := filepath.Join(dir, "urls.json")
+	runCLI(t, exitOK, "export", "-db", dbFilename, jsonFilename)
+	copyFilename := filepath.Join(dir, "copy.db")
+	runCLI(t, exitOK, "import", "-db", copyFilename, jsonFilename)
+	out := runCLI(t, exitOK, "export", "-db", copyFilename, "-o", "yaml")
+	for _, want := range []string{"path: /gh/*", "url: https://gitlab.com", "enabled: false"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("export does not contain %q:\n%s", want, out)
+		}
+	}
+
+	// The format of a file without an extension is detected
+	csvFilename := filepath.Join(dir, "links")
+	if err := os.WriteFile(csvFilename, []byte("path,url\n/go,https://go.dev\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	runCLI(t, exitOK, "import", "-db", dbFilename, csvFilename)
+	if out := runCLI(t, exitOK, "get", "-db", dbFilename, "/go"); !strings.Contains(out, "https://go.dev") {
+		t.Errorf("wrong link imported from CSV: %q", out)
+	}
+
+	// Invalid links are not imported
+	if err := os.WriteFile(yamlFilename, []byte("- path: /bad\n  url: https://example.com\n  status: 200\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	runCLI(t, exitError, "import", "-db", dbFilename, yamlFilename)
+	runCLI(t, exitNotFound, "get", "-db", dbFilename, "/bad")
+}
+
+func TestCLIReadOnly(t *testing.T) {
+	dbFilename := filepath.Join(t.TempDir(), "urls.db")
+	runCLI(t, exitOK, "add", "-db", dbFilename, "/gh", "https://github.com")
+
+	// Hold the Database open, like the server
+	db, err := database.SetupDB(dbFilename, bucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if out := runCLI(t, exitOK, "get", "-db", dbFilename, "-o", "url", "/gh"); out != "https://github.com\n" {
+		t.Errorf("wrong url: %q", out)
+	}
+	runCLI(t, exitError, "rm", "-db", dbFilename, "/gh")
+}
+
+func TestCLIValidate(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	warning := filepath.Join(dir, "warning.json")
+	invalid := filepath.Join(dir, "invalid.yaml")
+	files := map[string]string{
+		valid:   "- path: /gh\n  url: https://github.com\n",
+		warning: `[{"path": "/gh", "url": "https://github.com", "colour": "red"}]`,
+		invalid: "- path: gh\n  url: https://github.com\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(name, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out := runCLI(t, exitOK, "validate", valid); out != "" {
+		t.Errorf("wrong output for valid file: %q", out)
+	}
+	runCLI(t, exitOK, "lint", valid, warning)
+	runCLI(t, exitError, "lint", "-strict", valid, warning)
+	if out := runCLI(t, exitError, "validate", invalid); !strings.Contains(out, "invalid.yaml:1:3: error:") {
+		t.Errorf("wrong output for invalid file: %q", out)
+	}
+}
+
+func TestCLIExplain(t *testing.T) {
+	dir := t.TempDir()
+	dbFilename := filepath.Join(dir, "urls.db")
+	yamlFilename := filepath.Join(dir, "urls.yaml")
+	if err := os.WriteFile(yamlFilename, []byte("- path: /gh/*\n  url: https://github.com/*\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	runCLI(t, exitOK, "add", "-db", dbFilename, "/gh/golang", "https://go.dev")
+	flags := []string{"-db", dbFilename, "-source", yamlFilename}
+
+	out := runCLI(t, exitOK, append([]string{"explain"}, append(flags, "/gh/golang?tab=1")...)...)
+	for _, want := range []string{"exact   /gh/golang", "redirects", "prefix  /gh/*", "shadowed", "=> 302 https://go.dev"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("explain output does not contain %q:\n%s", want, out)
+		}
+	}
+
+	// A request for another host falls back to the links of every host
+	out = runCLI(t, exitOK, append([]string{"explain", "-o", "json"}, append(flags, "go.example.com/gh/x")...)...)
+	var e struct {
+		Host   string `json:"host"`
+		Source string `json:"source"`
+		URL    string `json:"url"`
+	}
+	if err := json.Unmarshal([]byte(out), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Host != "go.example.com" || e.Source != yamlFilename || e.URL != "https://github.com/x" {
+		t.Errorf("wrong explanation: %+v", e)
+	}
+
+	runCLI(t, exitNotFound, append([]string{"explain"}, append(flags, "/nope")...)...)
+	runCLI(t, exitUsage, "explain", "-db", dbFilename)
+}
+
+func TestCLIConflicts(t *testing.T) {
+	dir := t.TempDir()
+	dbFilename := filepath.Join(dir, "urls.db")
+	yamlFilename := filepath.Join(dir, "urls.yaml")
+	if err := os.WriteFile(yamlFilename, []byte("- path: /gh\n  url: https://github.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	runCLI(t, exitOK, "add", "-db", dbFilename, "/go", "https://go.dev")
+	flags := []string{"-db", dbFilename, "-source", yamlFilename}
+	if out := runCLI(t, exitOK, append([]string{"conflicts", "-o", "json"}, flags...)...); out != "[]\n" {
+		t.Errorf("wrong output without conflicts: %q", out)
+	}
+
+	runCLI(t, exitOK, "add", "-db", dbFilename, "/gh", "https://gitlab.com")
+	out := runCLI(t, exitError, append([]string{"conflicts"}, flags...)...)
+	for _, want := range []string{"https://gitlab.com  302     effective", "https://github.com  302     shadowed"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("conflicts output does not contain %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/urlshort"
+)
+
+// Chain is an http.Handler that redirects the paths of the sources of a
+// Config, with their most specific link, and calls the fallback for the
+// rest.
+type Chain struct {
+	// Sources are the links of the sources, in lookup order.
+	Sources []urlshort.Source
+	// Files are the handlers of the mapping files, in lookup order.
+	Files []*urlshort.FileHandler
+	// Database is the first writable Bolt Database, or nil. The
+	// redirects of all the sources are recorded as clicks in it, by
+	// Clicks.
+	Database *database.Database
+	Clicks   *database.ClickWriter
+
+	handler    http.Handler
+	explainers []urlshort.Explainer // of the sources, in lookup order
+	fallback   string               // type of the fallback
+	cancel     context.CancelFunc
+	unwatch    []func() // of the handlers of the Bolt Databases
+	locations  []string // of the Bolt Databases, released on Stop
+	builder    *Builder
+	stopOnce   sync.Once
+}
+
+// ServeHTTP will redirect the request, if its path is in a source, or
+// call the fallback.
+func (c *Chain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.handler.ServeHTTP(w, r)
+}
+
+// Reload will reload the changed mapping files, and log the failures.
+func (c *Chain) Reload() {
+	for _, f := range c.Files {
+		if _, err := f.Reload(); err != nil {
+			log.Printf("urlshort: reload failed, serving the previous version: %v", err)
+		}
+	}
+}
+
+// Stop will stop watching the mapping files and the Bolt Databases, and
+// close the Bolt Databases that no other Chain of the Builder uses. The
+// Chain must not be used after it is stopped.
+func (c *Chain) Stop() error {
+	var err error
+	c.stopOnce.Do(func() {
+		c.cancel()
+		for _, unwatch := range c.unwatch {
+			unwatch()
+		}
+		err = c.builder.release(c.locations)
+	})
+	return err
+}
+
+// Builder builds the Chains of configs.
+//
+// The Bolt Databases are kept open while a Chain uses them, so the
+// Chain of a reloaded config can be built before the previous one is
+// stopped, as a Database cannot be opened twice.
+type Builder struct {
+	// Bucket is the Bucket of the Bolt Databases without the bucket option.
+	Bucket string
+	// ReadOnly opens all the Bolt Databases read-only, or a snapshot of
+	// the ones another process holds open, e.g. for inspecting the chain
+	// of a running server.
+	ReadOnly bool
+
+	mu  sync.Mutex
+	dbs map[string]*openDB
+}
+
+// openDB is a Bolt Database opened by a Builder.
+type openDB struct {
+	db       *database.Database
+	clicks   *database.ClickWriter // of a writable Database
+	readOnly bool
+	refs     int
+}
+
+// close will write the queued clicks, and close the Database.
+func (o *openDB) close() error {
+	if o.clicks != nil {
+		o.clicks.Close()
+	}
+	return o.db.Close()
+}
+
+// NewBuilder will return a Builder, with the default Bucket of the
+// Bolt Databases.
+func NewBuilder(bucket string) *Builder {
+	return &Builder{Bucket: bucket, dbs: make(map[string]*openDB)}
+}
+
+// Build will open the sources of the config, and chain their handlers,
+// from the first one to the fallback. The mapping files with a reload
+// interval are watched until the Chain is stopped.
+//
+// The only errors that can be returned all related to opening the
+// sources, or to a fallback that cannot be served.
+func (b *Builder) Build(cfg *Config) (chain *Chain, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Chain{cancel: cancel, builder: b}
+	defer func() {
+		if err != nil {
+			c.Stop()
+		}
+	}()
+	handler, err := newFallback(cfg.Fallback)
+	if err != nil {
+		return nil, fmt.Errorf("fallback %s: %v", cfg.Fallback.Type, err)
+	}
+	// Build the handlers from the last source, using the previous
+	// handler as the fallback
+	c.Sources = make([]urlshort.Source, len(cfg.Sources))
+	c.explainers = make([]urlshort.Explainer, len(cfg.Sources))
+	c.fallback = cfg.Fallback.Type
+	for i := len(cfg.Sources) - 1; i >= 0; i-- {
+		src := cfg.Sources[i]
+		if b.ReadOnly {
+			src.ReadOnly = true
+		}
+		switch src.Type {
+		case SourceBolt:
+			o, err := b.open(src)
+			if err != nil {
+				return nil, err
+			}
+			db := o.db
+			c.locations = append(c.locations, src.Location)
+			h, err := urlshort.NewStoreHandler(db, handler, urlshort.DefaultDBOptions)
+			if err != nil {
+				return nil, err
+			}
+			c.unwatch = append(c.unwatch, h.Stop)
+			handler = h
+			c.explainers[i] = h
+			c.Sources[i] = urlshort.Source{Name: src.Location, Kind: SourceBolt, Store: db, ReadOnly: src.ReadOnly}
+			if !src.ReadOnly {
+				c.Database = db
+				c.Clicks = o.clicks
+			}
+		case SourceFile:
+			f, err := urlshort.NewFileHandler(src.Location, src.Format, handler, urlshort.FileOptions{Strict: src.Options.Strict})
+			if err != nil {
+				return nil, err
+			}
+			status := f.Status()
+			for _, d := range status.Diagnostics {
+				log.Print(d)
+			}
+			if src.Options.Reload > 0 {
+				go f.Watch(ctx, src.Options.Reload)
+			}
+			handler = f
+			c.explainers[i] = f
+			c.Files = append([]*urlshort.FileHandler{f}, c.Files...)
+			c.Sources[i] = urlshort.Source{Name: src.Location, Kind: status.Format, Store: handlerStore{f.Handler}, ReadOnly: true}
+		case SourceMap:
+			h := urlshort.NewHandler(src.Options.Paths, handler)
+			name := src.Location
+			if name == "" {
+				name = SourceMap
+			}
+			handler = h
+			c.explainers[i] = h
+			c.Sources[i] = urlshort.Source{Name: name, Kind: SourceMap, Store: handlerStore{h}, ReadOnly: true}
+		default:
+			return nil, fmt.Errorf("source %d: unknown type %q", i+1, src.Type)
+		}
+	}
+	c.handler = handler
+	if c.Clicks != nil {
+		c.handler = urlshort.RecordClicks(handler, c.Clicks)
+	}
+	return c, nil
+}
+
+// Close will close all the Bolt Databases, even if a Chain uses them.
+func (b *Builder) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	for location, o := range b.dbs {
+		if cerr := o.close(); err == nil {
+			err = cerr
+		}
+		delete(b.dbs, location)
+	}
+	return err
+}
+
+// open will return the Bolt Database of the source, opening it if no
+// Chain uses it, with the ClickWriter of a writable one.
+func (b *Builder) open(src Source) (*openDB, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if o, ok := b.dbs[src.Location]; ok {
+		if o.readOnly != src.ReadOnly {
+			return nil, fmt.Errorf("%s: read_only cannot change while the Database is open, restart the server", src.Location)
+		}
+		o.refs++
+		return o, nil
+	}
+	bucket := src.Options.Bucket
+	if bucket == "" {
+		bucket = b.Bucket
+	}
+	setup := database.SetupDB
+	if src.ReadOnly {
+		// A read-only Database is not created
+		if _, err := os.Stat(src.Location); err != nil {
+			return nil, err
+		}
+		setup = database.SetupReadOnlyDB
+	}
+	db, err := setup(src.Location, bucket)
+	if b.ReadOnly && errors.Is(err, database.ErrLocked) {
+		db, err = database.SetupSnapshotDB(src.Location, bucket)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", src.Location, err)
+	}
+	o := &openDB{db: db, readOnly: src.ReadOnly, refs: 1}
+	if !src.ReadOnly {
+		o.clicks = database.NewClickWriter(db, database.DefaultClickOptions)
+	}
+	b.dbs[src.Location] = o
+	return o, nil
+}
+
+// release will close the Bolt Databases of the locations that no
+// Chain uses anymore.
+func (b *Builder) release(locations []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	for _, location := range locations {
+		o, ok := b.dbs[location]
+		if !ok {
+			continue
+		}
+		if o.refs--; o.refs > 0 {
+			continue
+		}
+		if cerr := o.close(); err == nil {
+			err = cerr
+		}
+		delete(b.dbs, location)
+	}
+	return err
+}
+
+// newFallback will return the handler of the fallback.
+func newFallback(f Fallback) (http.Handler, error) {
+	switch f.Type {
+	case FallbackNotFound, "":
+		if f.Location == "" {
+			return http.NotFoundHandler(), nil
+		}
+		page, err := os.ReadFile(f.Location)
+		if err != nil {
+			return nil, err
+		}
+		return notFoundPage(page), nil
+	case FallbackStatic:
+		info, err := os.Stat(f.Location)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", f.Location)
+		}
+		return http.FileServer(http.Dir(f.Location)), nil
+	case FallbackProxy:
+		target, err := url.Parse(f.Location)
+		if err != nil {
+			return nil, err
+		}
+		return httputil.NewSingleHostReverseProxy(target), nil
+	case FallbackHello:
+		return http.HandlerFunc(hello), nil
+	}
+	return nil, fmt.Errorf("unknown type")
+}
+
+// notFoundPage is a handler that serves the page with the 404 status.
+type notFoundPage []byte
+
+func (p notFoundPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", http.DetectContentType(p))
+	w.WriteHeader(http.StatusNotFound)
+	w.Write(p)
+}
+
+// hello is a function handler for all paths
+func hello(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "Hello, world!")
+}
+
+// handlerStore is a read-only Store of the current links of a Handler
+type handlerStore struct {
+	h *urlshort.Handler
+}
+
+func (s handlerStore) Get(ctx context.Context, key string) (database.Record, error) {
+	rec, ok := s.h.Record(key)
+	if !ok {
+		return database.Record{}, database.ErrNotFound
+	}
+	return rec, nil
+}
+
+func (s handlerStore) Put(ctx context.Context, key string, rec database.Record) error {
+	return database.ErrReadOnly
+}
+
+func (s handlerStore) Insert(ctx context.Context, key string, rec database.Record) error {
+	return database.ErrReadOnly
+}
+
+func (s handlerStore) Replace(ctx context.Context, key string, rec database.Record) error {
+	return database.ErrReadOnly
+}
+
+func (s handlerStore) Update(ctx context.Context, key string, fn func(rec *database.Record) error) error {
+	return database.ErrReadOnly
+}
+
+func (s handlerStore) Rename(ctx context.Context, key string, newKey string, rec database.Record) error {
+	return database.ErrReadOnly
+}
+
+func (s handlerStore) Delete(ctx context.Context, key string) error {
+	return database.ErrReadOnly
+}
+
+func (s handlerStore) List(ctx context.Context) (map[string]database.Record, error) {
+	return s.h.Records(), nil
+}
+
+func (s handlerStore) Close() error {
+	return nil
+}
@@ -0,0 +1,244 @@
+// Package config declares the chain of handlers of the server in a
+// config file: the sources of the links, in the order they are looked
+// up, and the fallback for the paths that no source has.
+//
+// A config file is YAML (or JSON), e.g.
+//
+//     sources:
+//       - type: bolt
+//         location: urls.db
+//       - type: file
+//         location: urls.yaml
+//         options:
+//           strict: true
+//           reload: 5s
+//       - type: map
+//         options:
+//           paths:
+//             /gh: https://github.com
+//     fallback:
+//       type: static
+//       location: public
+//     server:
+//       listen: ["tls::8443", "unix:/run/urlshort.sock"]
+//       tls_cert: /etc/urlshort/cert.pem
+//       tls_key: /etc/urlshort/key.pem
+//       write_timeout: 5s
+//     admin:
+//       listen: ["127.0.0.1:8081"]
+//
+// The server only redirects, and serves the fallback, while the API, the
+// UI, the metrics and the debug endpoints are served by the admin server,
+// on its own listeners.
+//
+// The most specific link of all the sources redirects a request, like if
+// they were a single mapping: an exact path wins over a template, and a
+// template over a prefix entry, the longest prefix first, whatever their
+// sources. Between links that are as specific, e.g. the same link in two
+// sources, the first source wins, so a link of a source shadows the same
+// link of the next ones.
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/server"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/urlshort"
+	"gopkg.in/yaml.v2"
+)
+
+// Types of the sources.
+const (
+	// SourceBolt is a Bolt Database, writable unless it is read-only.
+	SourceBolt = "bolt"
+	// SourceFile is a mapping file in one of the urlshort.Formats,
+	// always read-only.
+	SourceFile = "file"
+	// SourceMap is a fixed set of paths, always read-only.
+	SourceMap = "map"
+)
+
+// Types of the fallback.
+const (
+	// FallbackNotFound serves a 404 page, the file of the location or
+	// the default one.
+	FallbackNotFound = "notfound"
+	// FallbackStatic serves the files of the directory of the location.
+	FallbackStatic = "static"
+	// FallbackProxy forwards the requests to the URL of the location.
+	FallbackProxy = "proxy"
+	// FallbackHello answers every request with "Hello, world!".
+	FallbackHello = "hello"
+)
+
+// Config is the chain of handlers of the server.
+type Config struct {
+	// Sources are the sources of the links, in lookup order.
+	Sources []Source `yaml:"sources"`
+	// Fallback handles the paths that no source has.
+	Fallback Fallback `yaml:"fallback"`
+	// Server are the settings of the server, which are only read at
+	// startup, see server.Settings.
+	Server server.Settings `yaml:"server"`
+	// Admin are the settings of the admin server, which are only read
+	// at startup too.
+	Admin server.Settings `yaml:"admin"`
+}
+
+// Source is a source of links.
+type Source struct {
+	// Type is one of SourceBolt, SourceFile or SourceMap.
+	Type string `yaml:"type"`
+	// Location is the file of a Bolt Database or of a mapping file,
+	// and the name of a map.
+	Location string `yaml:"location"`
+	// Format is the format of a mapping file, detected if empty, see
+	// urlshort.DetectFormat.
+	Format string `yaml:"format"`
+	// ReadOnly is set for a Bolt Database that is only read, e.g. one
+	// that another process manages.
+	ReadOnly bool `yaml:"read_only"`
+	// Options are the options of the type of the source.
+	Options Options `yaml:"options"`
+}
+
+// Options are the options of the sources, each used by some types.
+type Options struct {
+	// Bucket is the Bucket of a Bolt Database, by default the one of
+	// the Builder.
+	Bucket string `yaml:"bucket"`
+	// Strict rejects a mapping file with any problem, see
+	// urlshort.FileOptions.
+	Strict bool `yaml:"strict"`
+	// Reload is the interval for reloading a changed mapping file, 0
+	// to reload it only with Chain.Reload.
+	Reload time.Duration `yaml:"reload"`
+	// Paths are the paths and URLs of a map.
+	Paths map[string]string `yaml:"paths"`
+}
+
+// Fallback is the handler of the paths that no source has.
+type Fallback struct {
+	// Type is one of FallbackNotFound (the default), FallbackStatic,
+	// FallbackProxy or FallbackHello.
+	Type string `yaml:"type"`
+	// Location is the page of FallbackNotFound, the directory of
+	// FallbackStatic, or the URL of FallbackProxy.
+	Location string `yaml:"location"`
+}
+
+// Load will read and check the config file, see Parse.
+func Load(name string) (*Config, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return cfg, nil
+}
+
+// Parse will decode a YAML (or JSON) config, and check it. Unknown
+// fields are errors, to catch their typos.
+func Parse(data []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Check(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Check will return an error for the first source, fallback or server
+// setting that is not valid, and set the default fallback.
+func (c *Config) Check() error {
+	for i, src := range c.Sources {
+		if err := src.check(); err != nil {
+			return fmt.Errorf("source %d (%s %s): %v", i+1, src.Type, src.Location, err)
+		}
+	}
+	if c.Fallback.Type == "" {
+		c.Fallback.Type = FallbackNotFound
+	}
+	if err := c.Fallback.check(); err != nil {
+		return fmt.Errorf("fallback %s: %v", c.Fallback.Type, err)
+	}
+	if c.Server.MaxHeaderBytes < 0 {
+		return fmt.Errorf("server: max_header_bytes %d is negative", c.Server.MaxHeaderBytes)
+	}
+	if c.Admin.MaxHeaderBytes < 0 {
+		return fmt.Errorf("admin: max_header_bytes %d is negative", c.Admin.MaxHeaderBytes)
+	}
+	return nil
+}
+
+// check will return an error if the source is not valid.
+func (s Source) check() error {
+	switch s.Type {
+	case SourceBolt:
+		if s.Location == "" {
+			return fmt.Errorf("location is missing")
+		}
+	case SourceFile:
+		if s.Location == "" {
+			return fmt.Errorf("location is missing")
+		}
+		if s.Format != "" && !knownFormat(s.Format) {
+			return fmt.Errorf("unknown format %q", s.Format)
+		}
+	case SourceMap:
+		for path, dest := range s.Options.Paths {
+			if err := urlshort.CheckRecord(path, database.Record{Url: dest}); err != nil {
+				return err
+			}
+		}
+	case "":
+		return fmt.Errorf("type is missing")
+	default:
+		return fmt.Errorf("unknown type %q", s.Type)
+	}
+	if s.Options.Reload < 0 {
+		return fmt.Errorf("reload %v is negative", s.Options.Reload)
+	}
+	return nil
+}
+
+// check will return an error if the fallback is not valid.
+func (f Fallback) check() error {
+	switch f.Type {
+	case FallbackNotFound, FallbackHello:
+	case FallbackStatic:
+		if f.Location == "" {
+			return fmt.Errorf("location is missing")
+		}
+	case FallbackProxy:
+		u, err := url.Parse(f.Location)
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("location %q is not an absolute http or https URL", f.Location)
+		}
+	default:
+		return fmt.Errorf("unknown type")
+	}
+	return nil
+}
+
+// knownFormat reports whether the format is one of the urlshort.Formats.
+func knownFormat(format string) bool {
+	for _, f := range urlshort.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
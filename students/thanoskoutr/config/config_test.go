@@ -0,0 +1,434 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/urlshort"
+)
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(`
+sources:
+  - type: bolt
+    location: urls.db
+    options:
+      bucket: links
+  - type: file
+    location: links.txt
+    format: csv
+    options:
+      strict: true
+      reload: 5s
+  - type: map
+    options:
+      paths:
+        /gh: https://github.com
+server:
+  addr: 127.0.0.1:9000
+  listen: ["tls::8443", "unix:/run/urlshort.sock"]
+  write_timeout: 5s
+admin:
+  listen: ["127.0.0.1:9001"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Sources) != 3 || cfg.Sources[0].Options.Bucket != "links" || cfg.Sources[1].Options.Reload != 5*time.Second {
+		t.Errorf("wrong sources: %+v", cfg.Sources)
+	}
+	if cfg.Fallback.Type != FallbackNotFound {
+		t.Errorf("wrong default fallback: %+v", cfg.Fallback)
+	}
+	if cfg.Server.Addr != "127.0.0.1:9000" || cfg.Server.WriteTimeout != 5*time.Second || len(cfg.Server.Listen) != 2 || !reflect.DeepEqual(cfg.Admin.Listen, []string{"127.0.0.1:9001"}) {
+		t.Errorf("wrong server settings: %+v", cfg.Server)
+	}
+
+	// JSON is YAML too
+	if _, err := Parse([]byte(`{"sources": [{"type": "file", "location": "urls.json"}], "fallback": {"type": "hello"}}`)); err != nil {
+		t.Error(err)
+	}
+
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{"sources:\n  - type: bolt\n", "source 1 (bolt ): location is missing"},
+		{"sources:\n  - location: urls.yaml\n", "type is missing"},
+		{"sources:\n  - type: redis\n    location: x\n", `unknown type "redis"`},
+		{"sources:\n  - type: file\n    location: urls.txt\n    format: xml\n", `unknown format "xml"`},
+		{"sources:\n  - type: map\n    options:\n      paths:\n        /gh: github.com\n", "not an absolute http or https URL"},
+		{"sources:\n  - type: file\n    location: urls.yaml\n    readonly: true\n", "field readonly not found"},
+		{"fallback:\n  type: proxy\n  location: localhost:3000\n", "fallback proxy: location"},
+		{"fallback:\n  type: static\n", "fallback static: location is missing"},
+		{"fallback:\n  type: teapot\n", "fallback teapot: unknown type"},
+		{"server:\n  max_header_bytes: -1\n", "server: max_header_bytes -1 is negative"},
+		{"server:\n  read_timeout: soon\n", "into time.Duration"},
+		{"admin:\n  max_header_bytes: -1\n", "admin: max_header_bytes -1 is negative"},
+	}
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("Parse(%q) = %v, want an error with %q", tt.data, err, tt.expected)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	dir := t.TempDir()
+	dbFilename := filepath.Join(dir, "urls.db")
+	yamlFilename := filepath.Join(dir, "urls.yaml")
+	data := "- path: /gh\n  url: https://github.com/yaml\n- path: /yaml\n  url: https://yaml.org\n"
+	if err := os.WriteFile(yamlFilename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pageFilename := filepath.Join(dir, "404.html")
+	if err := os.WriteFile(pageFilename, []byte("<h1>No such link</h1>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		Sources: []Source{
+			{Type: SourceBolt, Location: dbFilename},
+			{Type: SourceFile, Location: yamlFilename},
+			{Type: SourceMap, Options: Options{Paths: map[string]string{"/gh": "https://github.com/map", "/map": "https://example.com"}}},
+		},
+		Fallback: Fallback{Type: FallbackNotFound, Location: pageFilename},
+	}
+	if err := cfg.Check(); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder("URL")
+	defer b.Close()
+	chain, err := b.Build(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.PutEntryDB(chain.Database, "/db", "https://db.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(chain.Sources) != 3 || chain.Sources[1].Kind != "yaml" || !chain.Sources[1].ReadOnly || chain.Sources[0].ReadOnly {
+		t.Errorf("wrong sources: %+v", chain.Sources)
+	}
+	if len(chain.Files) != 1 {
+		t.Errorf("wrong files: %v", chain.Files)
+	}
+
+	// The first source with the path wins
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/db", "https://db.example.com"},
+		{"/gh", "https://github.com/yaml"},
+		{"/yaml", "https://yaml.org"},
+		{"/map", "https://example.com"},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		chain.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if loc := rr.Header().Get("Location"); loc != tt.expected {
+			t.Errorf("%s redirected to %q, want %q", tt.path, loc, tt.expected)
+		}
+	}
+	rr := httptest.NewRecorder()
+	chain.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/nope", nil))
+	if rr.Code != http.StatusNotFound || rr.Body.String() != "<h1>No such link</h1>" {
+		t.Errorf("wrong fallback: %d %q", rr.Code, rr.Body.String())
+	}
+
+	// The redirects of every source are recorded in the Database, and
+	// the fallback is not
+	if err := chain.Clicks.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := database.GetClickCountsDB(chain.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != len(tests) || counts["/gh"].Clicks != 1 {
+		t.Errorf("wrong click counts: %+v", counts)
+	}
+
+	// A rebuilt chain shares the open Database with the previous one
+	cfg.Sources = cfg.Sources[:1]
+	next, err := b.Build(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Database != chain.Database {
+		t.Error("the Database was opened again")
+	}
+	if err := chain.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.GetEntryDB(next.Database, "/db"); err != nil {
+		t.Errorf("the Database was closed with the previous chain: %v", err)
+	}
+	cfg.Sources[0].ReadOnly = true
+	if _, err := b.Build(cfg); err == nil {
+		t.Error("expected an error for changing read_only of an open Database")
+	}
+	if err := next.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The Database is closed with the last chain, so it can be reopened
+	db, err := database.SetupDB(dbFilename, "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// A failed build releases the sources it opened
+	cfg.Sources[0].ReadOnly = false
+	cfg.Sources = append(cfg.Sources, Source{Type: SourceFile, Location: filepath.Join(dir, "missing.yaml")})
+	if _, err := b.Build(cfg); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	db, err = database.SetupDB(dbFilename, "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
+
+func TestFallback(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("static site"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "proxied "+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		fallback Fallback
+		path     string
+		code     int
+		expected string
+	}{
+		{Fallback{Type: FallbackNotFound}, "/x", http.StatusNotFound, "404 page not found\n"},
+		{Fallback{Type: FallbackHello}, "/x", http.StatusOK, "Hello, world!\n"},
+		{Fallback{Type: FallbackStatic, Location: dir}, "/", http.StatusOK, "static site"},
+		{Fallback{Type: FallbackProxy, Location: backend.URL}, "/x", http.StatusOK, "proxied /x"},
+	}
+	b := NewBuilder("URL")
+	defer b.Close()
+	for _, tt := range tests {
+		chain, err := b.Build(&Config{Fallback: tt.fallback})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		chain.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rr.Code != tt.code || rr.Body.String() != tt.expected {
+			t.Errorf("%s: got %d %q, want %d %q", tt.fallback.Type, rr.Code, rr.Body.String(), tt.code, tt.expected)
+		}
+		chain.Stop()
+	}
+	if _, err := b.Build(&Config{Fallback: Fallback{Type: FallbackStatic, Location: filepath.Join(dir, "index.html")}}); err == nil {
+		t.Error("expected an error for a static site that is not a directory")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	dir := t.TempDir()
+	yamlFilename := filepath.Join(dir, "urls.yaml")
+	if err := os.WriteFile(yamlFilename, []byte("- path: /gh/*\n  url: https://github.com/*\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder("URL")
+	defer b.Close()
+	chain, err := b.Build(&Config{
+		Sources: []Source{
+			{Type: SourceBolt, Location: filepath.Join(dir, "urls.db")},
+			{Type: SourceFile, Location: yamlFilename},
+			{Type: SourceMap, Location: "defaults", Options: Options{Paths: map[string]string{"/gh/golang": "https://go.dev"}}},
+		},
+		Fallback: Fallback{Type: FallbackNotFound},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+
+	// The exact path of the map redirects, and shadows the prefix of
+	// the file
+	e := chain.Explain(httptest.NewRequest(http.MethodGet, "/gh/golang?tab=1", nil))
+	if e.Source != "defaults" || e.Match == nil || e.Match.Key != "/gh/golang" || e.URL != "https://go.dev" || e.Status != http.StatusFound {
+		t.Errorf("wrong explanation: %+v", e)
+	}
+	if len(e.Steps) != 3 || len(e.Steps[0].Matches) != 0 || !e.Steps[1].Shadowed || e.Steps[2].Shadowed {
+		t.Errorf("wrong steps: %+v", e.Steps)
+	}
+
+	// The file redirects the other paths
+	e = chain.Explain(httptest.NewRequest(http.MethodGet, "/gh/other?tab=1", nil))
+	if e.Source != yamlFilename || e.Match == nil || e.Match.Key != "/gh/*" || e.URL != "https://github.com/other?tab=1" || e.Steps[1].Shadowed {
+		t.Errorf("wrong explanation: %+v", e)
+	}
+
+	// The Database redirects, and shadows both
+	if err := database.PutEntryDB(chain.Database, "/gh/golang", "https://golang.org"); err != nil {
+		t.Fatal(err)
+	}
+	e = chain.Explain(httptest.NewRequest(http.MethodGet, "/gh/golang", nil))
+	if e.Source != chain.Sources[0].Name || e.URL != "https://golang.org" || !e.Steps[1].Shadowed || !e.Steps[2].Shadowed {
+		t.Errorf("wrong explanation: %+v", e)
+	}
+
+	// No source has the path
+	e = chain.Explain(httptest.NewRequest(http.MethodGet, "/nope", nil))
+	if e.Match != nil || e.Fallback != FallbackNotFound || e.Status != http.StatusNotFound || len(e.Steps) != 3 {
+		t.Errorf("wrong explanation: %+v", e)
+	}
+}
+
+func TestChainSpecificity(t *testing.T) {
+	dir := t.TempDir()
+	yamlFilename := filepath.Join(dir, "urls.yaml")
+	if err := os.WriteFile(yamlFilename, []byte("- path: /gh/golang/*\n  url: https://go.googlesource.com/*\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder("URL")
+	defer b.Close()
+	chain, err := b.Build(&Config{
+		Sources: []Source{
+			{Type: SourceBolt, Location: filepath.Join(dir, "urls.db")},
+			{Type: SourceFile, Location: yamlFilename},
+			{Type: SourceMap, Options: Options{Paths: map[string]string{"/gh/exact": "https://example.com/exact"}}},
+		},
+		Fallback: Fallback{Type: FallbackNotFound},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	if err := database.PutEntryDB(chain.Database, "/gh/*", "https://github.com/*"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The prefix of the Database does not shadow the longer prefix of
+	// the file, or the exact path of the map
+	for path, url := range map[string]string{
+		"/gh/golang/go": "https://go.googlesource.com/go",
+		"/gh/exact":     "https://example.com/exact",
+		"/gh/other":     "https://github.com/other",
+	} {
+		rr := httptest.NewRecorder()
+		chain.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if location := rr.Header().Get("Location"); location != url {
+			t.Errorf("%s: wrong url: got %v want %v", path, location, url)
+		}
+		// And it is explained so
+		if e := chain.Explain(httptest.NewRequest(http.MethodGet, path, nil)); e.URL != url {
+			t.Errorf("%s: wrong explained url: got %v want %v (%+v)", path, e.URL, url, e.Steps)
+		}
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	dir := t.TempDir()
+	yamlFilename := filepath.Join(dir, "urls.yaml")
+	data := "- path: /gh\n  url: https://github.com\n- path: /off\n  url: https://example.com/yaml\n- path: /yaml\n  url: https://yaml.org\n"
+	if err := os.WriteFile(yamlFilename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuilder("URL")
+	defer b.Close()
+	chain, err := b.Build(&Config{
+		Sources: []Source{
+			{Type: SourceBolt, Location: filepath.Join(dir, "urls.db")},
+			{Type: SourceFile, Location: yamlFilename},
+			{Type: SourceMap, Location: "defaults", Options: Options{Paths: map[string]string{"/gh": "https://gitlab.com", "/map": "https://example.com"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Stop()
+	if err := database.PutRecordDB(chain.Database, "/off", database.Record{Url: "https://example.com/db", Disabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	conflicts, err := chain.Conflicts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range conflicts {
+		got = append(got, c.String())
+	}
+	expected := []string{
+		"/gh is defined in " + yamlFilename + ", defaults, and " + yamlFilename + " is effective",
+		"/off is defined in " + chain.Sources[0].Name + ", " + yamlFilename + ", and " + yamlFilename + " is effective",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("wrong conflicts:\ngot  %q\nwant %q", got, expected)
+	}
+	if d := conflicts[1].Definitions[0]; !d.Disabled || d.Effective || d.URL != "https://example.com/db" {
+		t.Errorf("wrong definition of the Database: %+v", d)
+	}
+}
+
+// streamStore is a Store that can only be streamed, like a large Bolt
+// Database, and fails to be listed.
+type streamStore struct {
+	*database.MemStore
+}
+
+func (s streamStore) List(ctx context.Context) (map[string]database.Record, error) {
+	return nil, errors.New("listed")
+}
+
+func (s streamStore) ForEach(ctx context.Context, fn func(key string, rec database.Record) error) error {
+	records, _ := s.MemStore.List(ctx)
+	for key, rec := range records {
+		if err := fn(key, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestConflictsStreamed(t *testing.T) {
+	ctx := context.Background()
+	newStore := func(records map[string]string) database.Store {
+		m := database.NewMemStore()
+		for key, url := range records {
+			m.Put(ctx, key, database.Record{Url: url})
+		}
+		return streamStore{m}
+	}
+	chain := &Chain{Sources: []urlshort.Source{
+		{Name: "a.db", Kind: SourceBolt, Store: newStore(map[string]string{"/a": "https://a.example.com", "/ab": "https://a.example.com/b", "/only": "https://a.example.com/only"})},
+		{Name: "b.db", Kind: SourceBolt, Store: newStore(map[string]string{"/ab": "https://b.example.com", "/bm": "https://b.example.com/m"})},
+		{Name: "map", Kind: SourceMap, Store: database.NewMemStore()},
+	}}
+	chain.Sources[2].Store.Put(ctx, "/bm", database.Record{Url: "https://example.com/m"})
+	conflicts, err := chain.Conflicts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range conflicts {
+		got = append(got, c.String())
+	}
+	expected := []string{
+		"/ab is defined in a.db, b.db, and a.db is effective",
+		"/bm is defined in b.db, map, and b.db is effective",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("wrong conflicts:\ngot  %q\nwant %q", got, expected)
+	}
+}
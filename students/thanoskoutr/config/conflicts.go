@@ -0,0 +1,156 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+)
+
+// Conflict is a key defined in more than one source of a Chain.
+type Conflict struct {
+	// Key is the path, optionally scoped to a host, see database.HostKey.
+	Key string `json:"key"`
+	// Definitions are the definitions of the key, in lookup order.
+	Definitions []Definition `json:"definitions"`
+}
+
+// Definition is the definition of a key in a source.
+type Definition struct {
+	Source   string `json:"source"`
+	Kind     string `json:"kind"`
+	URL      string `json:"url"`
+	Status   int    `json:"status,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+	// Effective is set for the definition that is served, the first
+	// one that is not disabled.
+	Effective bool `json:"effective,omitempty"`
+}
+
+// Effective will return the definition that is served, if any.
+func (c Conflict) Effective() (Definition, bool) {
+	for _, d := range c.Definitions {
+		if d.Effective {
+			return d, true
+		}
+	}
+	return Definition{}, false
+}
+
+// String will describe the Conflict in a line, e.g.
+// /gh is defined in urls.db, urls.yaml, and urls.db is effective
+func (c Conflict) String() string {
+	sources := make([]string, len(c.Definitions))
+	for i, d := range c.Definitions {
+		sources[i] = d.Source
+	}
+	s := c.Key + " is defined in " + strings.Join(sources, ", ")
+	if d, ok := c.Effective(); ok {
+		return s + ", and " + d.Source + " is effective"
+	}
+	return s + ", and disabled in all of them"
+}
+
+// Conflicts will return the keys that are defined in more than one
+// source, sorted by key, with the definition of each source and the
+// one that is served.
+//
+// Only the same keys conflict, e.g. /gh/* and /gh/{user} are different
+// keys, even if they match the same requests, see Explain.
+//
+// The links of the Bolt Databases (the sources that are a
+// database.Iterator) are not read in memory: the keys of the other
+// sources are looked up in them, and they are streamed to find the keys
+// they share with the Databases after them.
+func (c *Chain) Conflicts(ctx context.Context) ([]Conflict, error) {
+	listed := make([]map[string]database.Record, len(c.Sources))
+	streamed := make([]bool, len(c.Sources))
+	keys := make(map[string]bool)
+	var iterators []int
+	for i, src := range c.Sources {
+		if _, ok := src.Store.(database.Iterator); ok {
+			streamed[i] = true
+			iterators = append(iterators, i)
+			continue
+		}
+		records, err := src.Store.List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		listed[i] = records
+		for key := range records {
+			keys[key] = true
+		}
+	}
+	for n, i := range iterators {
+		others := iterators[n+1:]
+		if len(others) == 0 {
+			break
+		}
+		err := c.Sources[i].Store.(database.Iterator).ForEach(ctx, func(key string, rec database.Record) error {
+			if keys[key] {
+				return nil
+			}
+			for _, j := range others {
+				_, err := c.Sources[j].Store.Get(ctx, key)
+				if err == nil {
+					keys[key] = true
+					return nil
+				}
+				if !errors.Is(err, database.ErrNotFound) {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	definitions := make(map[string][]Definition)
+	for key := range keys {
+		for i, src := range c.Sources {
+			rec, ok := listed[i][key]
+			if streamed[i] {
+				var err error
+				rec, err = src.Store.Get(ctx, key)
+				if errors.Is(err, database.ErrNotFound) {
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				ok = true
+			}
+			if !ok {
+				continue
+			}
+			definitions[key] = append(definitions[key], Definition{
+				Source:   src.Name,
+				Kind:     src.Kind,
+				URL:      rec.Url,
+				Status:   rec.Status,
+				Disabled: rec.Disabled,
+			})
+		}
+	}
+	var conflicts []Conflict
+	for key, defs := range definitions {
+		if len(defs) < 2 {
+			continue
+		}
+		for i := range defs {
+			if !defs[i].Disabled {
+				defs[i].Effective = true
+				break
+			}
+		}
+		conflicts = append(conflicts, Conflict{Key: key, Definitions: defs})
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Key < conflicts[j].Key
+	})
+	return conflicts, nil
+}
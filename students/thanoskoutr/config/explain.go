@@ -0,0 +1,87 @@
+package config
+
+import (
+	"net/http"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/urlshort"
+)
+
+// Explanation is the trace of how a Chain resolves a request, see
+// Chain.Explain.
+type Explanation struct {
+	Host  string `json:"host,omitempty"`
+	Path  string `json:"path"`
+	Query string `json:"query,omitempty"`
+	// Steps are the sources consulted, in lookup order.
+	Steps []Step `json:"steps"`
+	// Source is the name of the source that redirects the request,
+	// empty if the fallback handles it.
+	Source string `json:"source,omitempty"`
+	// Match is the entry that redirects the request, if a source does.
+	Match *urlshort.Match `json:"match,omitempty"`
+	// Fallback is the type of the fallback, if it handles the request.
+	Fallback string `json:"fallback,omitempty"`
+	// Status is the status code of the response, 0 if the fallback
+	// decides it.
+	Status int `json:"status,omitempty"`
+	// URL is the URL the request is redirected to, if a source does.
+	URL string `json:"url,omitempty"`
+}
+
+// Step is a source consulted to resolve a request.
+type Step struct {
+	Source string `json:"source"`
+	Kind   string `json:"kind"`
+	// Matches are the entries of the source that match the request,
+	// the first one redirects it, unless the source is shadowed.
+	Matches []urlshort.Match `json:"matches,omitempty"`
+	// Shadowed is set if the source matches the request, but an entry
+	// of another source redirects it, see urlshort.Match.Beats.
+	Shadowed bool `json:"shadowed,omitempty"`
+	// Error is the error of the lookup, which is served as a 500,
+	// unless an entry of another source redirects the request.
+	Error string `json:"error,omitempty"`
+}
+
+// Explain will resolve the request like ServeHTTP, without redirecting
+// it, and return every source consulted, the entries of each source
+// that match, and the final destination and status.
+//
+// The most specific entry of all the sources redirects the request, see
+// urlshort.Match.Beats, and the other sources that match are shadowed
+// by it. A source that fails before it matches makes the request fail,
+// unless an entry of another source redirects it, like for ServeHTTP.
+func (c *Chain) Explain(r *http.Request) Explanation {
+	e := Explanation{Host: r.Host, Path: r.URL.Path, Query: r.URL.RawQuery}
+	redirects, failed := -1, -1
+	for i, explainer := range c.explainers {
+		matches, err := explainer.Matches(r)
+		step := Step{Source: c.Sources[i].Name, Kind: c.Sources[i].Kind, Matches: matches}
+		if err != nil {
+			step.Error = err.Error()
+			if len(matches) == 0 && failed < 0 {
+				failed = i
+			}
+		}
+		if len(matches) > 0 && (e.Match == nil || matches[0].Beats(*e.Match)) {
+			e.Source, e.Match = step.Source, &matches[0]
+			e.URL, e.Status = matches[0].URL, matches[0].Status
+			redirects = i
+		}
+		e.Steps = append(e.Steps, step)
+	}
+	for i := range e.Steps {
+		e.Steps[i].Shadowed = i != redirects && len(e.Steps[i].Matches) > 0
+	}
+	switch {
+	case e.Match != nil:
+	case failed >= 0:
+		e.Source, e.Status = e.Steps[failed].Source, http.StatusInternalServerError
+	default:
+		e.Fallback = c.fallback
+		if c.fallback == FallbackNotFound {
+			e.Status = http.StatusNotFound
+		}
+	}
+	return e
+}
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Steps of a series of clicks, see ClickSeriesDB.
+const (
+	StepHour = "hour"
+	StepDay  = "day"
+	StepWeek = "week"
+)
+
+// Fields of the clicks that can be totaled, see TopClicksDB.
+const (
+	FieldKey      = "key"
+	FieldReferrer = "referrer"
+	FieldAgent    = "agent"
+)
+
+// MaxClickPoints is the maximum number of points of a series of clicks.
+const MaxClickPoints = 10000
+
+// ClickPoint is the number of clicks of a step of a series, from its
+// time.
+type ClickPoint struct {
+	Time   time.Time `json:"time"`
+	Clicks uint64    `json:"clicks"`
+}
+
+// ClickTotal is the number of clicks of a value of a field, e.g. of a
+// referrer.
+type ClickTotal struct {
+	Value  string `json:"value"`
+	Clicks uint64 `json:"clicks"`
+}
+
+// StartOfStep returns the start of the step of the time, in UTC, e.g.
+// the start of its day. Weeks start on Monday.
+func StartOfStep(t time.Time, step string) (time.Time, error) {
+	t = t.UTC()
+	switch step {
+	case StepHour:
+		return t.Truncate(time.Hour), nil
+	case StepDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+	case StepWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7), nil
+	}
+	return time.Time{}, fmt.Errorf("%w: unknown step %q, want hour, day or week", ErrInvalidQuery, step)
+}
+
+// nextStep will return the start of the step after the one that starts
+// at t.
+func nextStep(t time.Time, step string) time.Time {
+	switch step {
+	case StepHour:
+		return t.Add(time.Hour)
+	case StepWeek:
+		return t.AddDate(0, 0, 7)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// ClickSeriesDB returns the clicks of the filter per step (hour, day or
+// week), from the step of From to the step of To, including the steps
+// without clicks. From and To must be set, and the series can have at
+// most MaxClickPoints points.
+//
+// Every point has all the clicks of its step: From is moved back to the
+// start of its step, so the first point is not partial, while the last
+// point only has the clicks before To.
+func ClickSeriesDB(db *Database, f ClickFilter, step string) ([]ClickPoint, error) {
+	if f.From.IsZero() || f.To.IsZero() || !f.From.Before(f.To) {
+		return nil, fmt.Errorf("%w: a series needs a range, from before to", ErrInvalidQuery)
+	}
+	start, err := StartOfStep(f.From, step)
+	if err != nil {
+		return nil, err
+	}
+	f.From = start
+	var points []ClickPoint
+	index := make(map[int64]int) // of the points, by the Unix time of their step
+	for t := start; t.Before(f.To); t = nextStep(t, step) {
+		if len(points) == MaxClickPoints {
+			return nil, fmt.Errorf("%w: a series has at most %d points, use a larger step or a shorter range", ErrInvalidQuery, MaxClickPoints)
+		}
+		index[t.Unix()] = len(points)
+		points = append(points, ClickPoint{Time: t})
+	}
+	err = ScanClicksDB(db, f, func(c Click) error {
+		t, _ := StartOfStep(c.Time, step)
+		if i, ok := index[t.Unix()]; ok {
+			points[i].Clicks++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// TopClicksDB returns the values of the field (key, referrer or agent) of
+// the clicks of the filter, from the most to the least clicked one, at
+// most n of them, or all of them if n is 0. The clicks without a
+// referrer have an empty referrer.
+func TopClicksDB(db *Database, f ClickFilter, field string, n int) ([]ClickTotal, error) {
+	var value func(c Click) string
+	switch field {
+	case FieldKey:
+		value = func(c Click) string { return c.Key }
+	case FieldReferrer:
+		value = func(c Click) string { return c.Referrer }
+	case FieldAgent:
+		value = func(c Click) string { return c.Agent }
+	default:
+		return nil, fmt.Errorf("%w: unknown field %q, want key, referrer or agent", ErrInvalidQuery, field)
+	}
+	totals := make(map[string]uint64)
+	err := ScanClicksDB(db, f, func(c Click) error {
+		totals[value(c)]++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	top := make([]ClickTotal, 0, len(totals))
+	for v, clicks := range totals {
+		top = append(top, ClickTotal{Value: v, Clicks: clicks})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Clicks != top[j].Clicks {
+			return top[i].Clicks > top[j].Clicks
+		}
+		return top[i].Value < top[j].Value
+	})
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top, nil
+}
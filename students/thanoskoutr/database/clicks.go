@@ -0,0 +1,351 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Click is a redirect of a link, recorded by RecordClickDB.
+type Click struct {
+	Time time.Time `json:"time"`
+	// Key is the key of the link, see HostKey.
+	Key string `json:"key"`
+	// Path is the path of the request, which differs from the path of
+	// the key for templates and prefix entries.
+	Path string `json:"path"`
+	// URL is where the request was redirected to.
+	URL string `json:"url"`
+	// Referrer is the host of the referring page, if any.
+	Referrer string `json:"referrer,omitempty"`
+	// Agent is the class of the user agent, e.g. browser or bot.
+	Agent string `json:"agent"`
+	// IP is the anonymized address of the client, e.g. 192.0.2.0.
+	IP string `json:"ip,omitempty"`
+}
+
+// ClickCount is the counter of the clicks of a link.
+type ClickCount struct {
+	Clicks uint64    `json:"clicks"`
+	First  time.Time `json:"first"`
+	Last   time.Time `json:"last"`
+}
+
+// clicksBucket will return the name of the Bucket of the clicks of the
+// links of the Database, kept next to the Bucket of the links.
+func clicksBucket(db *Database) []byte {
+	return []byte(db.Bucket + ".clicks")
+}
+
+// linkClicksBucket will return the name of the Bucket of the index of
+// the clicks by link, see linkClickKey.
+func linkClicksBucket(db *Database) []byte {
+	return []byte(db.Bucket + ".clicks.bylink")
+}
+
+// countsBucket will return the name of the Bucket of the counters of
+// the clicks of the links of the Database.
+func countsBucket(db *Database) []byte {
+	return []byte(db.Bucket + ".counts")
+}
+
+// clickKey will return the key of a click, its time and its sequence
+// number in big-endian, so the keys are ordered by time, and the clicks
+// of a time range can be found with a cursor.
+func clickKey(t time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+// linkClickKey will return the key of a click in the index of the clicks
+// by link: the key of the link, a zero byte and the key of the click, so
+// the keys of a link are ordered by time, and the clicks of a link in a
+// time range can be found with a cursor.
+func linkClickKey(link string, clickKey []byte) []byte {
+	k := make([]byte, 0, len(link)+1+len(clickKey))
+	k = append(k, link...)
+	k = append(k, 0)
+	return append(k, clickKey...)
+}
+
+// RecordClickDB adds the click to the clicks of the Bolt Database, and
+// increments the counter of its link.
+//
+// The clicks are kept in time order. Their Buckets are created by the
+// first click. For recording many clicks, see ClickWriter.
+func RecordClickDB(db *Database, c Click) error {
+	err := db.BoltDB.Update(func(tx *bolt.Tx) error {
+		return putClicks(tx, db, []Click{c})
+	})
+	return wrapError("record click", c.Key, err)
+}
+
+// putClicks will add the clicks, and increment the counters of their
+// links, in the transaction.
+func putClicks(tx *bolt.Tx, db *Database, clicks []Click) error {
+	b, err := tx.CreateBucketIfNotExists(clicksBucket(db))
+	if err != nil {
+		return err
+	}
+	byLink, err := tx.CreateBucketIfNotExists(linkClicksBucket(db))
+	if err != nil {
+		return err
+	}
+	added := make(map[string]*ClickCount)
+	for _, c := range clicks {
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		k := clickKey(c.Time, seq)
+		if err := b.Put(k, v); err != nil {
+			return err
+		}
+		if err := byLink.Put(linkClickKey(c.Key, k), nil); err != nil {
+			return err
+		}
+		count, ok := added[c.Key]
+		if !ok {
+			count = &ClickCount{}
+			added[c.Key] = count
+		}
+		count.add(1, c.Time, c.Time)
+	}
+
+	// Update the counter of each link once
+	counts, err := tx.CreateBucketIfNotExists(countsBucket(db))
+	if err != nil {
+		return err
+	}
+	for key, add := range added {
+		var count ClickCount
+		if v := counts.Get([]byte(key)); v != nil {
+			if err := json.Unmarshal(v, &count); err != nil {
+				return err
+			}
+		}
+		count.add(add.Clicks, add.First, add.Last)
+		v, err := json.Marshal(count)
+		if err != nil {
+			return err
+		}
+		if err := counts.Put([]byte(key), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add will add the clicks, from first to last, to the counter.
+func (c *ClickCount) add(clicks uint64, first time.Time, last time.Time) {
+	c.Clicks += clicks
+	if c.First.IsZero() || first.Before(c.First) {
+		c.First = first
+	}
+	if last.After(c.Last) {
+		c.Last = last
+	}
+}
+
+// GetClickCountDB returns the counter of the clicks of the link of the
+// key, which is zero if it has no clicks.
+func GetClickCountDB(db *Database, key string) (ClickCount, error) {
+	var count ClickCount
+	err := db.BoltDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(countsBucket(db))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(key)); v != nil {
+			return json.Unmarshal(v, &count)
+		}
+		return nil
+	})
+	return count, wrapError("get click count", key, err)
+}
+
+// GetClickCountsDB returns the counters of the links that have clicks.
+func GetClickCountsDB(db *Database) (map[string]ClickCount, error) {
+	counts := make(map[string]ClickCount)
+	err := db.BoltDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(countsBucket(db))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var count ClickCount
+			if err := json.Unmarshal(v, &count); err != nil {
+				return wrapError("decode", string(k), err)
+			}
+			counts[string(k)] = count
+			return nil
+		})
+	})
+	return counts, wrapError("get click counts", "", err)
+}
+
+// ForEachClickDB calls fn for every click of the Bolt Database, in time
+// order, until fn returns an error.
+func ForEachClickDB(db *Database, fn func(c Click) error) error {
+	return ScanClicksDB(db, ClickFilter{}, fn)
+}
+
+// ClickFilter selects the clicks of a time range, and of a link.
+type ClickFilter struct {
+	// Key is the key of the link, or empty for all the links.
+	Key string
+	// From is the start of the range, included, and To is its end,
+	// excluded. A zero time leaves the range open on that side.
+	From time.Time
+	To   time.Time
+}
+
+// ScanClicksDB calls fn for every click of the filter, in time order,
+// until fn returns an error. Only the clicks of the time range are read,
+// and of the link, if set.
+func ScanClicksDB(db *Database, f ClickFilter, fn func(c Click) error) error {
+	err := db.BoltDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(clicksBucket(db))
+		if b == nil {
+			return nil
+		}
+		if byLink := tx.Bucket(linkClicksBucket(db)); f.Key != "" && byLink != nil {
+			return scanLinkClicks(b, byLink, f, fn)
+		}
+		var end []byte
+		if !f.To.IsZero() {
+			end = clickKey(f.To, 0)
+		}
+		c := b.Cursor()
+		k, v := c.First()
+		if !f.From.IsZero() {
+			k, v = c.Seek(clickKey(f.From, 0))
+		}
+		for ; k != nil && (end == nil || bytes.Compare(k, end) < 0); k, v = c.Next() {
+			var click Click
+			if err := json.Unmarshal(v, &click); err != nil {
+				return wrapError("decode", "", err)
+			}
+			if f.Key != "" && click.Key != f.Key {
+				continue
+			}
+			if err := fn(click); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return wrapError("list clicks", f.Key, err)
+}
+
+// scanLinkClicks will call fn for every click of the link of the filter,
+// in its time range, found in the index of the clicks by link.
+func scanLinkClicks(b *bolt.Bucket, byLink *bolt.Bucket, f ClickFilter, fn func(c Click) error) error {
+	prefix := linkClickKey(f.Key, nil)
+	c := byLink.Cursor()
+	k, _ := c.Seek(prefix)
+	if !f.From.IsZero() {
+		k, _ = c.Seek(linkClickKey(f.Key, clickKey(f.From, 0)))
+	}
+	var end []byte
+	if !f.To.IsZero() {
+		end = linkClickKey(f.Key, clickKey(f.To, 0))
+	}
+	for ; k != nil && bytes.HasPrefix(k, prefix) && (end == nil || bytes.Compare(k, end) < 0); k, _ = c.Next() {
+		v := b.Get(k[len(prefix):])
+		if v == nil {
+			continue
+		}
+		var click Click
+		if err := json.Unmarshal(v, &click); err != nil {
+			return wrapError("decode", "", err)
+		}
+		if err := fn(click); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clicksVersion is the version of the keys of the clicks, see clickKey.
+//
+// The clicks of version 0 have the sequence number as their key, and the
+// ones of version 1 are not in the index of the clicks by link.
+const clicksVersion = 2
+
+// migrateClicks will rewrite the keys of the clicks of older versions,
+// and index them by link, in the transaction, see MigrateDB.
+func migrateClicks(tx *bolt.Tx, db *Database, meta *bolt.Bucket) error {
+	b := tx.Bucket(clicksBucket(db))
+	if b == nil {
+		return nil
+	}
+	version, _ := strconv.Atoi(string(meta.Get(clicksBucket(db))))
+	if version >= clicksVersion {
+		return nil
+	}
+	if version < 1 {
+		if err := migrateClickKeys(b); err != nil {
+			return err
+		}
+	}
+	byLink, err := tx.CreateBucketIfNotExists(linkClicksBucket(db))
+	if err != nil {
+		return err
+	}
+	err = b.ForEach(func(k, v []byte) error {
+		var c Click
+		if err := json.Unmarshal(v, &c); err != nil {
+			return wrapError("decode", "", err)
+		}
+		return byLink.Put(linkClickKey(c.Key, k), nil)
+	})
+	if err != nil {
+		return err
+	}
+	return meta.Put(clicksBucket(db), []byte(strconv.Itoa(clicksVersion)))
+}
+
+// migrateClickKeys will rewrite the sequence number keys of the clicks
+// of version 0 as time-ordered keys.
+func migrateClickKeys(b *bolt.Bucket) error {
+	// Collect the keys first, a Bucket cannot be changed while iterating
+	legacy := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		if len(k) == 8 {
+			legacy[string(k)] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range legacy {
+		var c Click
+		if err := json.Unmarshal(v, &c); err != nil {
+			return wrapError("decode", "", err)
+		}
+		if err := b.Delete([]byte(k)); err != nil {
+			return err
+		}
+		if err := b.Put(clickKey(c.Time, binary.BigEndian.Uint64([]byte(k))), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordClick will record the click, see RecordClickDB.
+func (db *Database) RecordClick(c Click) error {
+	return RecordClickDB(db, c)
+}
@@ -0,0 +1,214 @@
+package database
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrClosed is returned when recording a click to a closed ClickWriter.
+var ErrClosed = errors.New("click writer is closed")
+
+// ClickOptions are the options of a ClickWriter.
+type ClickOptions struct {
+	// QueueSize is the number of clicks waiting to be written, after
+	// which new clicks are dropped.
+	QueueSize int
+	// BatchSize is the number of clicks that are written at once, in
+	// one transaction, without waiting for the FlushInterval.
+	BatchSize int
+	// FlushInterval is the longest a click waits to be written.
+	FlushInterval time.Duration
+	// SampleRate is 1 of how many clicks are kept while the queue is
+	// more than half full, or 0 (or 1) to keep all of them until it is
+	// full.
+	SampleRate int
+}
+
+// DefaultClickOptions are the default ClickOptions.
+var DefaultClickOptions = ClickOptions{
+	QueueSize:     8192,
+	BatchSize:     512,
+	FlushInterval: time.Second,
+	SampleRate:    10,
+}
+
+// ClickStats are the counters of a ClickWriter.
+type ClickStats struct {
+	// Queued are the clicks accepted for writing.
+	Queued uint64 `json:"queued"`
+	// Written are the clicks written to the Database.
+	Written uint64 `json:"written"`
+	// Failed are the clicks whose transaction failed.
+	Failed uint64 `json:"failed"`
+	// Sampled are the clicks left out by sampling, and Dropped the
+	// clicks left out because the queue was full.
+	Sampled uint64 `json:"sampled"`
+	Dropped uint64 `json:"dropped"`
+	// Batches are the transactions.
+	Batches uint64 `json:"batches"`
+}
+
+// ClickWriter records clicks to a Bolt Database asynchronously, in
+// batches, so recording a click never waits for a transaction.
+//
+// Bolt has a single writer, so writing every click in its own
+// transaction would serialize the redirects. A ClickWriter queues the
+// clicks, and writes them in a transaction when BatchSize of them are
+// queued, or after the FlushInterval. Under backpressure, when the
+// Database cannot keep up, it keeps only a sample of the clicks, and
+// then drops them, see ClickOptions. The per-link counters only count
+// the clicks that are written.
+type ClickWriter struct {
+	stats   ClickStats // updated atomically
+	sampler uint64     // atomic, counts the clicks while sampling
+
+	db    *Database
+	opts  ClickOptions
+	queue chan Click
+	flush chan chan error
+	done  chan struct{}
+
+	mu     sync.RWMutex // guards closed, so the queue is not closed while sending to it
+	closed bool
+}
+
+// NewClickWriter will return a ClickWriter that writes to the Database,
+// with the options, where the options that are not set have their
+// DefaultClickOptions. It must be closed to write the queued clicks.
+func NewClickWriter(db *Database, opts ClickOptions) *ClickWriter {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultClickOptions.QueueSize
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultClickOptions.BatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultClickOptions.FlushInterval
+	}
+	w := &ClickWriter{
+		db:    db,
+		opts:  opts,
+		queue: make(chan Click, opts.QueueSize),
+		flush: make(chan chan error),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// RecordClick will queue the click, without waiting for it to be
+// written. Under backpressure it may leave the click out, which is
+// counted in the Stats but is not an error.
+func (w *ClickWriter) RecordClick(c Click) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if rate := uint64(w.opts.SampleRate); rate > 1 && len(w.queue) >= cap(w.queue)/2 {
+		if atomic.AddUint64(&w.sampler, 1)%rate != 0 {
+			atomic.AddUint64(&w.stats.Sampled, 1)
+			return nil
+		}
+	}
+	select {
+	case w.queue <- c:
+		atomic.AddUint64(&w.stats.Queued, 1)
+	default:
+		atomic.AddUint64(&w.stats.Dropped, 1)
+	}
+	return nil
+}
+
+// Flush will write the queued clicks, and return the error of their
+// transaction, if any.
+func (w *ClickWriter) Flush() error {
+	reply := make(chan error, 1)
+	select {
+	case w.flush <- reply:
+		return <-reply
+	case <-w.done:
+		return ErrClosed
+	}
+}
+
+// Close will write the queued clicks, and stop the ClickWriter. The
+// Database is not closed.
+func (w *ClickWriter) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	<-w.done
+	return nil
+}
+
+// Stats will return the counters of the ClickWriter.
+func (w *ClickWriter) Stats() ClickStats {
+	return ClickStats{
+		Queued:  atomic.LoadUint64(&w.stats.Queued),
+		Written: atomic.LoadUint64(&w.stats.Written),
+		Failed:  atomic.LoadUint64(&w.stats.Failed),
+		Sampled: atomic.LoadUint64(&w.stats.Sampled),
+		Dropped: atomic.LoadUint64(&w.stats.Dropped),
+		Batches: atomic.LoadUint64(&w.stats.Batches),
+	}
+}
+
+// run will write the queued clicks in batches, until the queue is
+// closed.
+func (w *ClickWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]Click, 0, w.opts.BatchSize)
+	for {
+		select {
+		case c, ok := <-w.queue:
+			if !ok {
+				w.write(batch)
+				return
+			}
+			if batch = append(batch, c); len(batch) >= w.opts.BatchSize {
+				w.write(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.write(batch)
+			batch = batch[:0]
+		case reply := <-w.flush:
+			// Take the clicks queued before the flush too
+			for n := len(w.queue); n > 0; n-- {
+				batch = append(batch, <-w.queue)
+			}
+			reply <- w.write(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// write will write the clicks in a transaction.
+func (w *ClickWriter) write(clicks []Click) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+	err := w.db.BoltDB.Update(func(tx *bolt.Tx) error {
+		return putClicks(tx, w.db, clicks)
+	})
+	atomic.AddUint64(&w.stats.Batches, 1)
+	if err != nil {
+		atomic.AddUint64(&w.stats.Failed, uint64(len(clicks)))
+		err = wrapError("record clicks", "", err)
+		log.Printf("%v, %d clicks lost", err, len(clicks))
+		return err
+	}
+	atomic.AddUint64(&w.stats.Written, uint64(len(clicks)))
+	return nil
+}
@@ -1,6 +1,16 @@
 package database
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/boltdb/bolt"
 )
 
@@ -10,18 +20,45 @@ import (
 type Database struct {
 	Bucket string
 	BoltDB *bolt.DB
+
+	mu       sync.RWMutex
+	watchers []*watcher
+	snapshot string // file of a snapshot, removed on Close
+}
+
+// HostKey returns the key of a path scoped to a host, e.g. go.example.com/pkg.
+//
+// Keys of paths that are not scoped to a host are the paths themselves,
+// so they start with a "/".
+func HostKey(host string, path string) string {
+	return strings.ToLower(host) + path
+}
+
+// SplitHostKey returns the host and the path of a key, see HostKey.
+func SplitHostKey(key string) (host string, path string) {
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return key, "/"
+	}
+	return key[:i], key[i:]
 }
 
+// openTimeout is how long opening a Database waits for another
+// process that holds it open.
+const openTimeout = time.Second
+
 // SetupDB opens a Bolt Database and creates a Bucket for storing
 // key-value pairs.
 //
-// If the dbName file does not exist it will create it.
+// If the dbName file does not exist it will create it. If the Bucket
+// has values of older versions, it will migrate them, see MigrateDB.
+// If another process holds the Database open, ErrLocked is returned.
 func SetupDB(dbName string, bucket string) (*Database, error) {
 	// Open the db data file in your current directory.
 	// It will be created if it doesn't exist.
-	db, err := bolt.Open(dbName, 0600, nil)
+	db, err := bolt.Open(dbName, 0600, &bolt.Options{Timeout: openTimeout})
 	if err != nil {
-		return nil, err
+		return nil, wrapError("open", "", err)
 	}
 	// Create the buckets, if they do not exist
 	err = db.Update(func(tx *bolt.Tx) error {
@@ -33,69 +70,198 @@ func SetupDB(dbName string, bucket string) (*Database, error) {
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		db.Close()
+		return nil, wrapError("setup", "", err)
 	}
 	// log.Printf("Bolt Database %s, setup done", dbName)
+	d := &Database{
+		BoltDB: db,
+		Bucket: bucket,
+	}
+	// Rewrite the values of older versions
+	err = MigrateDB(d)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// SetupReadOnlyDB opens an existing Bolt Database read-only.
+//
+// The Bucket is not created, so if it does not exist, all the
+// operations return ErrBucketMissing. All the writes return ErrReadOnly.
+// If another process holds the Database open for writing, ErrLocked is
+// returned, see SetupSnapshotDB.
+func SetupReadOnlyDB(dbName string, bucket string) (*Database, error) {
+	db, err := bolt.Open(dbName, 0600, &bolt.Options{ReadOnly: true, Timeout: openTimeout})
+	if err != nil {
+		return nil, wrapError("open", "", err)
+	}
 	return &Database{
 		BoltDB: db,
 		Bucket: bucket,
 	}, nil
 }
 
-// PutEntryDB inserts a new key-value pair into the Bolt Database.
-func PutEntryDB(db *Database, key string, value string) error {
-	err := db.BoltDB.Update(func(tx *bolt.Tx) error {
-		err := tx.Bucket([]byte(db.Bucket)).Put([]byte(key), []byte(value))
-		if err != nil {
-			return err
+// snapshotAttempts is how many copies SetupSnapshotDB makes, until one
+// is consistent.
+const snapshotAttempts = 3
+
+// copyFile copies the file of a snapshot, and is replaced by the tests.
+var copyFile = io.Copy
+
+// SetupSnapshotDB opens a read-only copy of a Bolt Database, for reading
+// it while another process holds it open for writing, see SetupReadOnlyDB.
+//
+// The copy is made without locking the Database, so a commit of the
+// other process while copying can leave it torn. Every commit writes the
+// meta pages of the file last, so the copy is made again if they changed
+// while copying, up to a few times, after which ErrInconsistent is
+// returned. The copy is then checked, and has the changes committed when
+// it was made. It is removed when the Database is closed.
+func SetupSnapshotDB(dbName string, bucket string) (*Database, error) {
+	var err error
+	for i := 0; i < snapshotAttempts; i++ {
+		var db *Database
+		if db, err = copySnapshot(dbName, bucket); err == nil {
+			return db, nil
+		}
+		if !errors.Is(err, ErrInconsistent) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// copySnapshot will copy the Bolt Database to a temporary file, and open
+// it read-only if no commit happened while copying, see SetupSnapshotDB.
+func copySnapshot(dbName string, bucket string) (*Database, error) {
+	src, err := os.Open(dbName)
+	if err != nil {
+		return nil, wrapError("snapshot", "", err)
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp("", "urlshort-*.db")
+	if err != nil {
+		return nil, wrapError("snapshot", "", err)
+	}
+	_, err = copyFile(dst, src)
+	if err == nil {
+		err = sameMeta(dst, src)
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return nil, wrapError("snapshot", "", err)
+	}
+	db, err := SetupReadOnlyDB(dst.Name(), bucket)
+	if err != nil {
+		os.Remove(dst.Name())
+		return nil, err
+	}
+	db.snapshot = dst.Name()
+	err = db.BoltDB.View(func(tx *bolt.Tx) error {
+		// Report the first problem only
+		for err := range tx.Check() {
+			return fmt.Errorf("%w: %v", ErrInconsistent, err)
 		}
-		// log.Printf("Bolt Bucket %s, updated with \"%s\":\"%s\" pair", db.Bucket, key, value)
 		return nil
 	})
 	if err != nil {
-		return err
+		db.Close()
+		return nil, wrapError("snapshot", "", err)
+	}
+	return db, nil
+}
+
+// sameMeta will return ErrInconsistent if the meta pages of the copy of
+// a Bolt Database file differ from the ones of the file now, because a
+// commit happened while copying.
+func sameMeta(copied *os.File, src *os.File) error {
+	// The meta pages are the first two pages, of the page size of the
+	// meta, after the header of the page and the magic and version. Bolt
+	// writes it in the byte order of the platform, little-endian on the
+	// common ones, else the page size of the platform is used
+	header := make([]byte, 28)
+	if _, err := copied.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("%w: %v", ErrInconsistent, err)
+	}
+	pageSize := int64(binary.LittleEndian.Uint32(header[24:]))
+	if pageSize < 512 || pageSize > 1<<20 {
+		pageSize = int64(os.Getpagesize())
+	}
+	a := make([]byte, 2*pageSize)
+	b := make([]byte, 2*pageSize)
+	na, _ := copied.ReadAt(a, 0)
+	nb, _ := src.ReadAt(b, 0)
+	if na != nb || !bytes.Equal(a[:na], b[:nb]) {
+		return ErrInconsistent
+	}
+	return nil
+}
+
+// bucket will return the Bucket of the Database in the transaction,
+// or ErrBucketMissing.
+func bucket(tx *bolt.Tx, db *Database) (*bolt.Bucket, error) {
+	b := tx.Bucket([]byte(db.Bucket))
+	if b == nil {
+		return nil, ErrBucketMissing
 	}
-	return err
+	return b, nil
+}
+
+// PutEntryDB inserts a new key-value pair into the Bolt Database.
+//
+// The value is stored as the URL of a Record, see PutRecordDB.
+func PutEntryDB(db *Database, key string, value string) error {
+	return PutRecordDB(db, key, Record{Url: value})
 }
 
 // GetEntryDB reads a key-value pair from the Bolt Database Bucket,
 // given the key.
+//
+// For a key stored with PutRecordDB, the value is the URL of the Record.
+// If the key does not exist, ErrNotFound is returned.
 func GetEntryDB(db *Database, key string) (string, error) {
-	value := ""
-	err := db.BoltDB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(db.Bucket))
-		v := b.Get([]byte(key))
-		value = string(v)
-		return nil
-	})
+	rec, err := GetRecordDB(db, key)
 	if err != nil {
 		return "", err
 	}
-	return value, err
+	return rec.Url, nil
 }
 
 // GetEntriesDB reads all key-value pairs from the Bolt Database Bucket.
+//
+// For keys stored with PutRecordDB, the value is the URL of the Record.
 func GetEntriesDB(db *Database) (map[string]string, error) {
 	entries := make(map[string]string)
-	err := db.BoltDB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(db.Bucket))
-		b.ForEach(func(k, v []byte) error {
-			entries[string(k)] = string(v)
-			return nil
-		})
+	err := ForEachRecordDB(db, func(key string, rec Record) error {
+		entries[key] = rec.Url
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	return entries, err
+	return entries, nil
 }
 
 // DeleteEntryDB deletes a key-value pair from the Bolt Database Bucket,
 // given the key.
+//
+// If the key does not exist, ErrNotFound is returned.
 func DeleteEntryDB(db *Database, key string) error {
 	err := db.BoltDB.Update(func(tx *bolt.Tx) error {
-		err := tx.Bucket([]byte(db.Bucket)).Delete([]byte(key))
+		b, err := bucket(tx, db)
+		if err != nil {
+			return err
+		}
+		if b.Get([]byte(key)) == nil {
+			return ErrNotFound
+		}
+		err = b.Delete([]byte(key))
 		if err != nil {
 			return err
 		}
@@ -103,25 +269,337 @@ func DeleteEntryDB(db *Database, key string) error {
 		return nil
 	})
 	if err != nil {
-		return err
+		return wrapError("delete", key, err)
 	}
-	return err
+	notify(db, Change{Key: key, Deleted: true})
+	return nil
 }
 
 // PutMapEntriesDB inserts a map of key-value pairs into the Bolt Database.
+//
+// The values are stored as the URLs of Records, see PutRecordDB.
 func PutMapEntriesDB(db *Database, entries map[string]string) error {
+	changes := make([]Change, 0, len(entries))
+	now := time.Now().UTC()
 	err := db.BoltDB.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, db)
+		if err != nil {
+			return err
+		}
 		for key, value := range entries {
-			err := tx.Bucket([]byte(db.Bucket)).Put([]byte(key), []byte(value))
+			rec, err := putRecord(b, key, Record{Url: value}, now)
 			if err != nil {
-				return err
+				return wrapError("put", key, err)
 			}
+			changes = append(changes, Change{Key: key, Record: rec})
 			// log.Printf("Bolt Bucket %s, updated with \"%s\":\"%s\" pair", db.Bucket, key, value)
 		}
 		return nil
 	})
 	if err != nil {
+		return wrapError("put", "", err)
+	}
+	notify(db, changes...)
+	return nil
+}
+
+// PutRecordDB inserts a new key-Record pair into the Bolt Database,
+// or replaces the Record of the key.
+//
+// The Record is stored in the current version, with the host and the
+// path of the key, see HostKey. Its UpdatedAt time is set to now, and
+// its CreatedAt time is kept from the replaced Record, if any.
+func PutRecordDB(db *Database, key string, rec Record) error {
+	return writeRecordDB(db, "put", key, rec, nil)
+}
+
+// InsertRecordDB inserts a new key-Record pair into the Bolt Database,
+// like PutRecordDB. The key is checked in the same transaction, so if
+// it exists, ErrExists is returned and its Record is kept.
+func InsertRecordDB(db *Database, key string, rec Record) error {
+	return writeRecordDB(db, "insert", key, rec, func(exists bool) error {
+		if exists {
+			return ErrExists
+		}
+		return nil
+	})
+}
+
+// ReplaceRecordDB replaces the Record of a key of the Bolt Database,
+// like PutRecordDB. The key is checked in the same transaction, so if
+// it does not exist, ErrNotFound is returned and nothing is inserted.
+func ReplaceRecordDB(db *Database, key string, rec Record) error {
+	return writeRecordDB(db, "replace", key, rec, func(exists bool) error {
+		if !exists {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+// UpdateRecordDB changes the Record of a key of the Bolt Database with
+// the function, and stores it like PutRecordDB, in a single transaction,
+// so that no change of the key in between is lost.
+//
+// If the key does not exist, ErrNotFound is returned, and if the
+// function returns an error, the Record is kept and the error is
+// returned as is. The function must not use the Database.
+func UpdateRecordDB(db *Database, key string, fn func(rec *Record) error) error {
+	var rec Record
+	var fnErr error
+	err := db.BoltDB.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, db)
+		if err != nil {
+			return err
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		if rec, err = decodeRecord(v); err != nil {
+			return err
+		}
+		if fnErr = fn(&rec); fnErr != nil {
+			return fnErr
+		}
+		rec, err = putRecord(b, key, rec, time.Now().UTC())
+		return err
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return wrapError("update", key, err)
+	}
+	notify(db, Change{Key: key, Record: rec})
+	return nil
+}
+
+// writeRecordDB will put the key-Record pair in a transaction, if check
+// returns no error for whether the key exists, and notify the watchers.
+func writeRecordDB(db *Database, op string, key string, rec Record, check func(exists bool) error) error {
+	err := db.BoltDB.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, db)
+		if err != nil {
+			return err
+		}
+		if check != nil {
+			if err := check(b.Get([]byte(key)) != nil); err != nil {
+				return err
+			}
+		}
+		rec, err = putRecord(b, key, rec, time.Now().UTC())
+		return err
+	})
+	if err != nil {
+		return wrapError(op, key, err)
+	}
+	notify(db, Change{Key: key, Record: rec})
+	return nil
+}
+
+// PutRecordsDB inserts a map of key-Record pairs into the Bolt Database,
+// in a single transaction, like PutRecordDB.
+func PutRecordsDB(db *Database, records map[string]Record) error {
+	changes := make([]Change, 0, len(records))
+	now := time.Now().UTC()
+	err := db.BoltDB.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, db)
+		if err != nil {
+			return err
+		}
+		for key, rec := range records {
+			rec, err := putRecord(b, key, rec, now)
+			if err != nil {
+				return wrapError("put", key, err)
+			}
+			changes = append(changes, Change{Key: key, Record: rec})
+		}
+		return nil
+	})
+	if err != nil {
+		return wrapError("put", "", err)
+	}
+	notify(db, changes...)
+	return nil
+}
+
+// MoveRecordDB moves the Record of a key to a new key, in a single
+// transaction. The host and the path of the Record are set from the
+// new key, and its times are kept.
+//
+// If the key does not exist, ErrNotFound is returned, and if the new
+// key exists, ErrExists is returned.
+func MoveRecordDB(db *Database, key string, newKey string) error {
+	var rec Record
+	err := db.BoltDB.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, db)
+		if err != nil {
+			return err
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		if b.Get([]byte(newKey)) != nil {
+			return wrapError("move", newKey, ErrExists)
+		}
+		if rec, err = decodeRecord(v); err != nil {
+			return err
+		}
+		rec.Host, rec.Path = SplitHostKey(newKey)
+		rec.Version = RecordVersion
+		value, err := encodeRecord(rec)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(newKey), value); err != nil {
+			return err
+		}
+		return b.Delete([]byte(key))
+	})
+	if err != nil {
+		return wrapError("move", key, err)
+	}
+	notify(db, Change{Key: key, Deleted: true}, Change{Key: newKey, Record: rec})
+	return nil
+}
+
+// RenameRecordDB replaces the Record of a key with the Record of a new
+// key, in a single transaction, like PutRecordDB, so the link is never
+// under both keys or under none. Its CreatedAt time is kept from the
+// replaced Record.
+//
+// If the new key exists, ErrExists is returned, and else if the key does
+// not exist, ErrNotFound is returned.
+func RenameRecordDB(db *Database, key string, newKey string, rec Record) error {
+	err := db.BoltDB.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, db)
+		if err != nil {
+			return err
+		}
+		if newKey != key && b.Get([]byte(newKey)) != nil {
+			return wrapError("rename", newKey, ErrExists)
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		if newKey == key {
+			rec, err = putRecord(b, key, rec, time.Now().UTC())
+			return err
+		}
+		old, err := decodeRecord(v)
+		if err != nil {
+			return err
+		}
+		rec = fillRecord(newKey, rec, &old, time.Now().UTC())
+		value, err := encodeRecord(rec)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(newKey), value); err != nil {
+			return err
+		}
+		return b.Delete([]byte(key))
+	})
+	if err != nil {
+		return wrapError("rename", key, err)
+	}
+	if newKey == key {
+		notify(db, Change{Key: key, Record: rec})
+	} else {
+		notify(db, Change{Key: key, Deleted: true}, Change{Key: newKey, Record: rec})
+	}
+	return nil
+}
+
+// putRecord will fill in the Record of the key and put it in the Bucket.
+func putRecord(b *bolt.Bucket, key string, rec Record, now time.Time) (Record, error) {
+	var old *Record
+	if v := b.Get([]byte(key)); v != nil {
+		if r, err := decodeRecord(v); err == nil {
+			old = &r
+		}
+	}
+	rec = fillRecord(key, rec, old, now)
+	value, err := encodeRecord(rec)
+	if err != nil {
+		return Record{}, err
+	}
+	return rec, b.Put([]byte(key), value)
+}
+
+// fillRecord will set the version, the host, the path and the times of
+// the Record of the key, which replaces the old Record, if not nil.
+func fillRecord(key string, rec Record, old *Record, now time.Time) Record {
+	rec.Version = RecordVersion
+	rec.Host, rec.Path = SplitHostKey(key)
+	rec.UpdatedAt = now
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = now
+		if old != nil && !old.CreatedAt.IsZero() {
+			rec.CreatedAt = old.CreatedAt
+		}
+	}
+	return rec
+}
+
+// GetRecordDB reads a key-Record pair from the Bolt Database Bucket,
+// given the key.
+//
+// If the key does not exist, ErrNotFound is returned.
+func GetRecordDB(db *Database, key string) (Record, error) {
+	var rec Record
+	err := db.BoltDB.View(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, db)
+		if err != nil {
+			return err
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		rec, err = decodeRecord(v)
 		return err
+	})
+	if err != nil {
+		return Record{}, wrapError("get", key, err)
 	}
-	return err
+	return rec, nil
+}
+
+// GetRecordsDB reads all key-Record pairs from the Bolt Database Bucket.
+func GetRecordsDB(db *Database) (map[string]Record, error) {
+	records := make(map[string]Record)
+	err := ForEachRecordDB(db, func(key string, rec Record) error {
+		records[key] = rec
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// ForEachRecordDB calls the function for every key-Record pair of the
+// Bolt Database Bucket, without reading them all in memory.
+//
+// If the function returns an error, the iteration stops and the
+// error is returned.
+func ForEachRecordDB(db *Database, fn func(key string, rec Record) error) error {
+	err := db.BoltDB.View(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, db)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			rec, err := decodeRecord(v)
+			if err != nil {
+				return wrapError("decode", string(k), err)
+			}
+			return fn(string(k), rec)
+		})
+	})
+	return wrapError("list", "", err)
 }
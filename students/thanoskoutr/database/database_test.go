@@ -1,8 +1,21 @@
 package database
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/generator"
+	"gopkg.in/yaml.v2"
 )
 
 // Testcases Maphandler
@@ -82,11 +95,13 @@ func TestDeleteEntryDB(t *testing.T) {
 	}
 	// Check if still in database
 	v, err := GetEntryDB(db, k)
-	if err != nil {
-		t.Fatal(err)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Entry still in database, key: %s, value: %s, error: %v\n", k, v, err)
 	}
-	if v != "" {
-		t.Errorf("Entry still in database, key: %s\n", k)
+	// Delete it again
+	err = DeleteEntryDB(db, k)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("wrong error for deleting a missing key: %s, got %v want %v\n", k, err, ErrNotFound)
 	}
 	t.Logf("Entry deleted, key: %s\n", k)
 }
@@ -101,3 +116,1037 @@ func TestPutMapEntriesDB(t *testing.T) {
 		t.Logf("Entry added, key: %s, value: %s\n", k, v)
 	}
 }
+
+func TestPutRecordDB(t *testing.T) {
+	// Put entry, key-Record pair
+	k := "/ghb/fiber"
+	rec := Record{Url: "https://github.com/gofiber/fiber", Status: 301, Query: "append"}
+	err := PutRecordDB(db, k, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("Record added, key: %s, record: %+v\n", k, rec)
+
+	// Get it back as a Record and as a plain value
+	got, err := GetRecordDB(db, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameLink(got, rec) {
+		t.Errorf("wrong record for: %s, got %+v want %+v\n", k, got, rec)
+	}
+	v, err := GetEntryDB(db, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != rec.Url {
+		t.Errorf("wrong value for: %s, got %s want %s\n", k, v, rec.Url)
+	}
+}
+
+func TestGetRecordsDB(t *testing.T) {
+	// Plain values are read as Records with just a URL
+	k := "/ghb/ent"
+	v := "https://github.com/ent/ent"
+	err := PutEntryDB(db, k, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := GetRecordsDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := records[k]; !sameLink(rec, Record{Url: v}) {
+		t.Errorf("wrong record for: %s, got %+v want %+v\n", k, rec, Record{Url: v})
+	}
+	for k, rec := range records {
+		t.Logf("key: %s, record: %+v\n", k, rec)
+	}
+}
+
+func TestHostKey(t *testing.T) {
+	// Keys of paths with and without a host
+	keys := map[string][2]string{
+		"go.example.com/pkg": {"go.example.com", "/pkg"},
+		"/pkg":               {"", "/pkg"},
+		"go.example.com/":    {"go.example.com", "/"},
+	}
+	for key, hostPath := range keys {
+		if k := HostKey(hostPath[0], hostPath[1]); k != key {
+			t.Errorf("wrong key for: %v, got %s want %s\n", hostPath, k, key)
+		}
+		host, path := SplitHostKey(key)
+		if host != hostPath[0] || path != hostPath[1] {
+			t.Errorf("wrong host and path for: %s, got %s %s want %v\n", key, host, path, hostPath)
+		}
+	}
+	if k := HostKey("Go.Example.com", "/Pkg"); k != "go.example.com/Pkg" {
+		t.Errorf("host is not lowercased, got %s\n", k)
+	}
+}
+
+func TestWatchDB(t *testing.T) {
+	// Collect the changes made to the Database
+	var changes []Change
+	unwatch := WatchDB(db, func(c Change) {
+		changes = append(changes, c)
+	})
+	k := "/ghb/fabric"
+	v := "https://github.com/hyperledger/fabric"
+	if err := PutEntryDB(db, k, v); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteEntryDB(db, k); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Change{
+		{Key: k, Record: Record{Url: v}},
+		{Key: k, Deleted: true},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("wrong number of changes, got %d want %d\n", len(changes), len(expected))
+	}
+	for i := range expected {
+		if changes[i].Key != expected[i].Key || changes[i].Deleted != expected[i].Deleted ||
+			!sameLink(changes[i].Record, expected[i].Record) {
+			t.Errorf("wrong change, got %+v want %+v\n", changes[i], expected[i])
+		}
+	}
+
+	// No changes are seen after unwatching
+	unwatch()
+	if err := PutEntryDB(db, k, v); err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteEntryDB(db, k)
+	if len(changes) != len(expected) {
+		t.Errorf("change seen after unwatching: %+v", changes[len(changes)-1])
+	}
+}
+
+func TestStore(t *testing.T) {
+	// Run the same tests for all Store implementations
+	stores := map[string]Store{
+		"bolt":   db,
+		"memory": NewMemStore(),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			testStore(t, store)
+		})
+	}
+}
+
+// Run the Store tests on a Store
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	k := "/store/podman"
+	rec := Record{Url: "https://github.com/containers/podman", Status: 308}
+
+	// Put and get a Record
+	if err := store.Put(ctx, k, rec); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get(ctx, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameLink(got, rec) {
+		t.Errorf("wrong record for: %s, got %+v want %+v\n", k, got, rec)
+	}
+	records, err := store.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameLink(records[k], rec) {
+		t.Errorf("wrong listed record for: %s, got %+v want %+v\n", k, records[k], rec)
+	}
+
+	// Delete it, and check it is not found
+	if err := store.Delete(ctx, k); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, k); !errors.Is(err, ErrNotFound) {
+		t.Errorf("wrong error for deleted key: %s, got %v want %v\n", k, err, ErrNotFound)
+	}
+
+	// Replace only an existing key, and insert only a new one
+	if err := store.Replace(ctx, k, rec); !errors.Is(err, ErrNotFound) {
+		t.Errorf("wrong error for replacing a missing key: %s, got %v want %v\n", k, err, ErrNotFound)
+	}
+	if _, err := store.Get(ctx, k); !errors.Is(err, ErrNotFound) {
+		t.Errorf("replace inserted the missing key: %s, got %v\n", k, err)
+	}
+	if err := store.Insert(ctx, k, rec); err != nil {
+		t.Fatal(err)
+	}
+	other := Record{Url: "https://podman.io"}
+	if err := store.Insert(ctx, k, other); !errors.Is(err, ErrExists) {
+		t.Errorf("wrong error for inserting an existing key: %s, got %v want %v\n", k, err, ErrExists)
+	}
+	if got, _ := store.Get(ctx, k); !sameLink(got, rec) {
+		t.Errorf("insert replaced the record of: %s, got %+v want %+v\n", k, got, rec)
+	}
+	if err := store.Replace(ctx, k, other); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get(ctx, k); !sameLink(got, other) {
+		t.Errorf("wrong replaced record for: %s, got %+v want %+v\n", k, got, other)
+	}
+
+	// Update only an existing key, and keep the Record on an error
+	if err := store.Update(ctx, "/store/missing", func(r *Record) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Errorf("wrong error for updating a missing key, got %v want %v\n", err, ErrNotFound)
+	}
+	errStop := errors.New("stop")
+	if err := store.Update(ctx, k, func(r *Record) error { r.Url = rec.Url; return errStop }); err != errStop {
+		t.Errorf("wrong error of the update function, got %v want %v\n", err, errStop)
+	}
+	if got, _ := store.Get(ctx, k); !sameLink(got, other) {
+		t.Errorf("failed update changed the record of: %s, got %+v want %+v\n", k, got, other)
+	}
+	err = store.Update(ctx, k, func(r *Record) error {
+		r.Status = 301
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get(ctx, k); got.Url != other.Url || got.Status != 301 {
+		t.Errorf("wrong updated record for: %s, got %+v\n", k, got)
+	}
+
+	// Rename it, only to a new key
+	renamed := k + "/renamed"
+	store.Put(ctx, "/store/taken", rec)
+	if err := store.Rename(ctx, k, "/store/taken", rec); !errors.Is(err, ErrExists) {
+		t.Errorf("wrong error for renaming to an existing key, got %v want %v\n", err, ErrExists)
+	}
+	if err := store.Rename(ctx, "/store/missing", renamed, rec); !errors.Is(err, ErrNotFound) {
+		t.Errorf("wrong error for renaming a missing key, got %v want %v\n", err, ErrNotFound)
+	}
+	if err := store.Rename(ctx, k, renamed, rec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, k); !errors.Is(err, ErrNotFound) {
+		t.Errorf("renamed key still exists: %s, got %v\n", k, err)
+	}
+	if got, _ := store.Get(ctx, renamed); !sameLink(got, rec) || got.Path != renamed {
+		t.Errorf("wrong renamed record for: %s, got %+v want %+v\n", renamed, got, rec)
+	}
+	store.Delete(ctx, renamed)
+	store.Delete(ctx, "/store/taken")
+
+	// A canceled context is not served
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := store.Get(canceled, k); !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong error for canceled context, got %v want %v\n", err, context.Canceled)
+	}
+}
+
+func TestErrNotFound(t *testing.T) {
+	// A missing key, and a key with an empty value
+	k := "/empty"
+	if err := PutEntryDB(db, k, ""); err != nil {
+		t.Fatal(err)
+	}
+	v, err := GetEntryDB(db, k)
+	if err != nil || v != "" {
+		t.Errorf("wrong value for empty key: %s, got %q, %v\n", k, v, err)
+	}
+	_, err = GetEntryDB(db, "/missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("wrong error for missing key, got %v want %v\n", err, ErrNotFound)
+	}
+	_, err = GetRecordDB(db, "/missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("wrong error for missing record, got %v want %v\n", err, ErrNotFound)
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Op != "get" || e.Key != "/missing" {
+		t.Errorf("wrong error details, got %#v\n", err)
+	}
+	if err := DeleteEntryDB(db, k); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrBucketMissing(t *testing.T) {
+	// Open a Database without the Bucket
+	dbFilename := filepath.Join(t.TempDir(), "urls.db")
+	other, err := SetupDB(dbFilename, "OTHER")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+	missing, err := SetupReadOnlyDB(dbFilename, "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer missing.Close()
+
+	// Every operation fails
+	_, err = GetEntryDB(missing, "/a")
+	checkErr(t, "GetEntryDB", err, ErrBucketMissing)
+	_, err = GetEntriesDB(missing)
+	checkErr(t, "GetEntriesDB", err, ErrBucketMissing)
+	_, err = GetRecordsDB(missing)
+	checkErr(t, "GetRecordsDB", err, ErrBucketMissing)
+	err = ForEachRecordDB(missing, func(string, Record) error { return nil })
+	checkErr(t, "ForEachRecordDB", err, ErrBucketMissing)
+}
+
+func TestErrReadOnly(t *testing.T) {
+	// Open a Database read-only
+	dbFilename := filepath.Join(t.TempDir(), "urls.db")
+	rw, err := SetupDB(dbFilename, "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PutEntryDB(rw, "/a", "https://example.com/a"); err != nil {
+		t.Fatal(err)
+	}
+	rw.Close()
+	ro, err := SetupReadOnlyDB(dbFilename, "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+
+	// Reads succeed and every write fails
+	if v, err := GetEntryDB(ro, "/a"); err != nil || v != "https://example.com/a" {
+		t.Errorf("wrong value in read-only database, got %q, %v\n", v, err)
+	}
+	err = PutEntryDB(ro, "/b", "https://example.com/b")
+	checkErr(t, "PutEntryDB", err, ErrReadOnly)
+	err = PutRecordDB(ro, "/b", Record{Url: "https://example.com/b"})
+	checkErr(t, "PutRecordDB", err, ErrReadOnly)
+	err = PutMapEntriesDB(ro, pathsToUrls)
+	checkErr(t, "PutMapEntriesDB", err, ErrReadOnly)
+	err = DeleteEntryDB(ro, "/a")
+	checkErr(t, "DeleteEntryDB", err, ErrReadOnly)
+}
+
+func TestBoltErrors(t *testing.T) {
+	// Bolt errors are wrapped
+	_, err := SetupDB(t.TempDir(), "URL")
+	var e *Error
+	if !errors.As(err, &e) || e.Op != "open" {
+		t.Errorf("wrong error for opening a directory, got %#v\n", err)
+	}
+
+	// Values that cannot be decoded are reported
+	k := "/broken"
+	err = db.BoltDB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(db.Bucket)).Put([]byte(k), []byte("{broken"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteEntryDB(db, k)
+	_, err = GetRecordDB(db, k)
+	if !errors.As(err, &e) || e.Key != k || errors.Is(err, ErrNotFound) {
+		t.Errorf("wrong error for broken record, got %#v\n", err)
+	}
+	_, err = GetEntriesDB(db)
+	if !errors.As(err, &e) || e.Key != k {
+		t.Errorf("wrong error for broken records, got %#v\n", err)
+	}
+}
+
+// Check that the error of a function is the expected one
+func checkErr(t *testing.T, name string, err error, expected error) {
+	t.Helper()
+	if !errors.Is(err, expected) {
+		t.Errorf("wrong error for %s, got %v want %v\n", name, err, expected)
+	}
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Errorf("error for %s is not a database.Error, got %#v\n", name, err)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	// Records keep their metadata
+	k := "go.example.com/ghb/iterm2"
+	rec := Record{
+		Url:         "https://gitlab.com/gnachman/iterm2",
+		Status:      301,
+		Disabled:    true,
+		Description: "iTerm2 sources",
+		Tags:        []string{"terminal", "macos"},
+		CreatedBy:   "thanoskoutr",
+	}
+	if err := PutRecordDB(db, k, rec); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetRecordDB(db, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameLink(got, rec) || got.CreatedBy != rec.CreatedBy {
+		t.Errorf("wrong record for: %s, got %+v want %+v\n", k, got, rec)
+	}
+	if got.Version != RecordVersion || got.Host != "go.example.com" || got.Path != "/ghb/iterm2" {
+		t.Errorf("wrong version, host or path for: %s, got %+v\n", k, got)
+	}
+	if got.CreatedAt.IsZero() || got.UpdatedAt.Before(got.CreatedAt) {
+		t.Errorf("wrong times for: %s, got %+v\n", k, got)
+	}
+
+	// Replacing a Record keeps its creation time
+	time.Sleep(time.Millisecond)
+	if err := PutEntryDB(db, k, "https://iterm2.com"); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := GetRecordDB(db, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.CreatedAt.Equal(got.CreatedAt) || !updated.UpdatedAt.After(got.UpdatedAt) {
+		t.Errorf("wrong times for replaced: %s, got %+v want created at %v\n", k, updated, got.CreatedAt)
+	}
+	if err := DeleteEntryDB(db, k); err != nil {
+		t.Fatal(err)
+	}
+
+	// The zero times are not encoded, and the others are kept
+	plain := Record{Url: "https://iterm2.com"}
+	j, err := json.Marshal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, err := yaml.Marshal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, encoded := range []string{string(j), string(y)} {
+		if strings.Contains(encoded, "created_at") || strings.Contains(encoded, "updated_at") {
+			t.Errorf("zero times are encoded: %s\n", encoded)
+		}
+	}
+	j, err = json.Marshal(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, err = yaml.Marshal(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON, fromYAML Record
+	if err := json.Unmarshal(j, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal(y, &fromYAML); err != nil {
+		t.Fatal(err)
+	}
+	for _, decoded := range []Record{fromJSON, fromYAML} {
+		if !decoded.CreatedAt.Equal(updated.CreatedAt) || !decoded.UpdatedAt.Equal(updated.UpdatedAt) {
+			t.Errorf("wrong decoded times, got %+v want %+v\n", decoded, updated)
+		}
+	}
+}
+
+func TestMigrateDB(t *testing.T) {
+	// Write legacy values to a new Database
+	dbFilename := filepath.Join(t.TempDir(), "urls.db")
+	legacy, err := bolt.Open(dbFilename, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = legacy.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("URL"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("/plain"), []byte("https://example.com/plain")); err != nil {
+			return err
+		}
+		return b.Put([]byte("/v0"), []byte(`{"url":"https://example.com/v0","status":301}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.Close()
+
+	// Open it, which migrates the values
+	migrated, err := SetupDB(dbFilename, "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrated.Close()
+	expected := map[string]Record{
+		"/plain": {Url: "https://example.com/plain"},
+		"/v0":    {Url: "https://example.com/v0", Status: 301},
+	}
+	err = migrated.BoltDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("URL")).ForEach(func(k, v []byte) error {
+			rec, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+			if rec.Version != RecordVersion || !sameLink(rec, expected[string(k)]) {
+				t.Errorf("wrong migrated record for: %s, got %+v want %+v\n", k, rec, expected[string(k)])
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutGeneratedDB(t *testing.T) {
+	// Use a new Database, to start the sequence from 1
+	fresh, err := SetupDB(filepath.Join(t.TempDir(), "urls.db"), "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	stores := map[string]KeyGenerator{
+		"bolt":   fresh,
+		"memory": NewMemStore(),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			testPutGenerated(t, store)
+		})
+	}
+}
+
+// Run the key generation tests on a Store
+func testPutGenerated(t *testing.T, store KeyGenerator) {
+	ctx := context.Background()
+	rec := Record{Url: "https://github.com/gophercises/urlshort"}
+
+	// Sequence codes skip the blocked ones
+	seq := &generator.Generator{Strategy: generator.Sequence{}, BlockedWords: []string{"4"}}
+	for _, expected := range []string{"/3", "/5"} {
+		key, err := store.PutGenerated(ctx, seq, rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != expected {
+			t.Errorf("wrong sequence key, got %s want %s\n", key, expected)
+		}
+	}
+
+	// Hash codes are reused for the same URL, and retried for another one
+	hash := &generator.Generator{Strategy: generator.Hash{}, Prefix: "/h/"}
+	rec.Host = "Go.Example.com"
+	first, err := store.PutGenerated(ctx, hash, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(first, "go.example.com/h/") {
+		t.Errorf("wrong hash key, got %s want prefix go.example.com/h/\n", first)
+	}
+	again, err := store.PutGenerated(ctx, hash, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Errorf("hash key not reused, got %s want %s\n", again, first)
+	}
+	other := Record{Url: "https://example.com/other"}
+	code, _ := generator.Hash{}.Generate(generator.Input{URL: other.Url})
+	store.(Store).Put(ctx, "/h/"+code, rec)
+	key, err := store.PutGenerated(ctx, hash, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key == "/h/"+code {
+		t.Errorf("hash key not retried after a collision: %s\n", key)
+	}
+	got, err := store.(Store).Get(ctx, key)
+	if err != nil || got.Url != other.Url {
+		t.Errorf("wrong generated record for: %s, got %+v (%v)\n", key, got, err)
+	}
+
+	// No free code after the maximum attempts
+	hash.MaxAttempts = 1
+	store.(Store).Put(ctx, "/h/"+code, rec)
+	if _, err := store.PutGenerated(ctx, hash, other); !errors.Is(err, generator.ErrExhausted) {
+		t.Errorf("wrong error for exhausted codes, got %v want %v\n", err, generator.ErrExhausted)
+	}
+}
+
+func TestMoveRecordDB(t *testing.T) {
+	records := map[string]Record{
+		"/mv/old":   {Url: "https://example.com/old", Description: "old"},
+		"/mv/other": {Url: "https://example.com/other"},
+	}
+	if err := PutRecordsDB(db, records); err != nil {
+		t.Fatal(err)
+	}
+	if err := MoveRecordDB(db, "/mv/old", "/mv/new"); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := GetRecordDB(db, "/mv/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameLink(rec, records["/mv/old"]) || rec.Path != "/mv/new" {
+		t.Errorf("wrong moved record, got %+v want %+v\n", rec, records["/mv/old"])
+	}
+	checkErr(t, "get moved", func() error { _, err := GetRecordDB(db, "/mv/old"); return err }(), ErrNotFound)
+	checkErr(t, "move missing", MoveRecordDB(db, "/mv/old", "/mv/newer"), ErrNotFound)
+	checkErr(t, "move to existing", MoveRecordDB(db, "/mv/new", "/mv/other"), ErrExists)
+}
+
+func TestSetupSnapshotDB(t *testing.T) {
+	// Hold a Database open for writing
+	dbFilename := filepath.Join(t.TempDir(), "urls.db")
+	writer, err := SetupDB(dbFilename, "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	if err := PutEntryDB(writer, "/snap", "https://example.com/snap"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = SetupReadOnlyDB(dbFilename, "URL")
+	checkErr(t, "open locked", err, ErrLocked)
+
+	// Its snapshot can be read, and is removed on close
+	snapshot, err := SetupSnapshotDB(dbFilename, "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := GetEntryDB(snapshot, "/snap"); err != nil || v != "https://example.com/snap" {
+		t.Errorf("wrong snapshot value, got %q (%v)\n", v, err)
+	}
+	name := snapshot.snapshot
+	if err := snapshot.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("snapshot %s was not removed: %v\n", name, err)
+	}
+
+	// A copy is made again if a commit happens while copying, until
+	// none does
+	defer func() { copyFile = io.Copy }()
+	commits := 1
+	copyFile = func(dst io.Writer, src io.Reader) (int64, error) {
+		n, err := io.Copy(dst, src)
+		if commits > 0 {
+			commits--
+			PutEntryDB(writer, "/snap/during", "https://example.com/during")
+		}
+		return n, err
+	}
+	snapshot, err = SetupSnapshotDB(dbFilename, "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := GetEntryDB(snapshot, "/snap/during"); err != nil || v != "https://example.com/during" {
+		t.Errorf("wrong snapshot value after a commit while copying, got %q (%v)\n", v, err)
+	}
+	snapshot.Close()
+	commits = snapshotAttempts
+	_, err = SetupSnapshotDB(dbFilename, "URL")
+	checkErr(t, "snapshot while committing", err, ErrInconsistent)
+}
+
+func TestClicks(t *testing.T) {
+	clicksDB, err := SetupDB(filepath.Join(t.TempDir(), "urls.db"), "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clicksDB.Close()
+
+	// No clicks before the first one
+	if count, err := GetClickCountDB(clicksDB, "/gh"); err != nil || count.Clicks != 0 {
+		t.Errorf("wrong count without clicks, got %+v (%v)\n", count, err)
+	}
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	clicks := []Click{
+		{Time: start, Key: "/gh/*", Path: "/gh/golang", URL: "https://github.com/golang", Agent: "browser", IP: "192.0.2.0"},
+		{Time: start.Add(time.Hour), Key: "/gh/*", Path: "/gh/go", URL: "https://github.com/go", Agent: "cli"},
+		{Time: start.Add(time.Minute), Key: "/yaml", Path: "/yaml", URL: "https://yaml.org", Referrer: "example.com", Agent: "bot"},
+	}
+	for _, c := range clicks {
+		if err := clicksDB.RecordClick(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The clicks are kept in time order
+	var got []Click
+	err = ForEachClickDB(clicksDB, func(c Click) error {
+		got = append(got, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ordered := []Click{clicks[0], clicks[2], clicks[1]}; !reflect.DeepEqual(got, ordered) {
+		t.Errorf("wrong clicks:\ngot  %+v\nwant %+v\n", got, ordered)
+	}
+	counts, err := GetClickCountsDB(clicksDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]ClickCount{
+		"/gh/*": {Clicks: 2, First: start, Last: start.Add(time.Hour)},
+		"/yaml": {Clicks: 1, First: start.Add(time.Minute), Last: start.Add(time.Minute)},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("wrong counts:\ngot  %+v\nwant %+v\n", counts, expected)
+	}
+
+	// The clicks are kept out of the links
+	if records, err := GetRecordsDB(clicksDB); err != nil || len(records) != 0 {
+		t.Errorf("clicks are in the links, got %v (%v)\n", records, err)
+	}
+}
+
+func TestScanClicksDB(t *testing.T) {
+	clicksDB, err := SetupDB(filepath.Join(t.TempDir(), "urls.db"), "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clicksDB.Close()
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 48; i++ {
+		key := "/gh"
+		if i%3 == 0 {
+			key = "/yaml"
+		}
+		if err := clicksDB.RecordClick(Click{Time: start.Add(time.Duration(i) * time.Hour), Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter ClickFilter
+		first  time.Time
+		clicks int
+	}{
+		{"all", ClickFilter{}, start, 48},
+		{"from", ClickFilter{From: start.Add(40 * time.Hour)}, start.Add(40 * time.Hour), 8},
+		{"to", ClickFilter{To: start.Add(10 * time.Hour)}, start, 10},
+		{"range", ClickFilter{From: start.Add(24 * time.Hour), To: start.Add(30 * time.Hour)}, start.Add(24 * time.Hour), 6},
+		{"key", ClickFilter{Key: "/yaml", From: start.Add(time.Hour)}, start.Add(3 * time.Hour), 15},
+		{"key range", ClickFilter{Key: "/gh", From: start.Add(3 * time.Hour), To: start.Add(9 * time.Hour)}, start.Add(4 * time.Hour), 4},
+		{"key prefix", ClickFilter{Key: "/g"}, time.Time{}, 0},
+		{"empty", ClickFilter{From: start.Add(100 * time.Hour)}, time.Time{}, 0},
+	}
+	for _, test := range tests {
+		var got []Click
+		err := ScanClicksDB(clicksDB, test.filter, func(c Click) error {
+			if len(got) > 0 && c.Time.Before(got[len(got)-1].Time) {
+				t.Errorf("%s: clicks out of order, %v before %v\n", test.name, c.Time, got[len(got)-1].Time)
+			}
+			got = append(got, c)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != test.clicks {
+			t.Errorf("%s: wrong number of clicks, got %d want %d\n", test.name, len(got), test.clicks)
+		}
+		if len(got) > 0 && !got[0].Time.Equal(test.first) {
+			t.Errorf("%s: wrong first click, got %v want %v\n", test.name, got[0].Time, test.first)
+		}
+	}
+
+	// The clicks of a link are found in its index, without reading the
+	// clicks of the other links
+	err = clicksDB.BoltDB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(clicksBucket(clicksDB)).Put(clickKey(start.Add(time.Hour), 2), []byte("{broken"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	err = ScanClicksDB(clicksDB, ClickFilter{Key: "/yaml"}, func(c Click) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 16 {
+		t.Errorf("wrong clicks of a link, got %d (%v) want 16\n", n, err)
+	}
+}
+
+func TestMigrateClicks(t *testing.T) {
+	// Write clicks with their sequence number as key
+	dbFilename := filepath.Join(t.TempDir(), "urls.db")
+	legacy, err := bolt.Open(dbFilename, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	clicks := []Click{
+		{Time: start.Add(time.Hour), Key: "/gh", Agent: "browser"},
+		{Time: start, Key: "/yaml", Agent: "bot"},
+	}
+	err = legacy.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucket([]byte("URL")); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket([]byte("URL.clicks"))
+		if err != nil {
+			return err
+		}
+		for _, c := range clicks {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint64(k, seq)
+			v, err := json.Marshal(c)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.Close()
+
+	// Open it, which rewrites the keys in time order
+	migrated, err := SetupDB(dbFilename, "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrated.Close()
+	var got []Click
+	err = ScanClicksDB(migrated, ClickFilter{From: start}, func(c Click) error {
+		got = append(got, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ordered := []Click{clicks[1], clicks[0]}; !reflect.DeepEqual(got, ordered) {
+		t.Errorf("wrong migrated clicks:\ngot  %+v\nwant %+v\n", got, ordered)
+	}
+	got = nil
+	err = ScanClicksDB(migrated, ClickFilter{Key: "/gh"}, func(c Click) error {
+		got = append(got, c)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed := []Click{clicks[0]}; !reflect.DeepEqual(got, indexed) {
+		t.Errorf("wrong migrated clicks of a link:\ngot  %+v\nwant %+v\n", got, indexed)
+	}
+
+	// New clicks do not reuse the sequence numbers
+	if err := migrated.RecordClick(Click{Time: start, Key: "/gh"}); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	ForEachClickDB(migrated, func(c Click) error {
+		n++
+		return nil
+	})
+	if n != 3 {
+		t.Errorf("wrong number of clicks after migration, got %d want 3\n", n)
+	}
+}
+
+func TestClickSeriesDB(t *testing.T) {
+	clicksDB, err := SetupDB(filepath.Join(t.TempDir(), "urls.db"), "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clicksDB.Close()
+	// Thursday
+	start := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	clicks := []Click{
+		{Time: start, Key: "/gh", Referrer: "example.com", Agent: "browser"},
+		{Time: start.Add(30 * time.Minute), Key: "/gh", Agent: "cli"},
+		{Time: start.Add(2 * time.Hour), Key: "/yaml", Referrer: "example.com", Agent: "browser"},
+		{Time: start.AddDate(0, 0, 2), Key: "/gh", Referrer: "go.dev", Agent: "bot"},
+		{Time: start.AddDate(0, 0, 5), Key: "/gh", Agent: "browser"},
+	}
+	for _, c := range clicks {
+		if err := clicksDB.RecordClick(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name     string
+		filter   ClickFilter
+		step     string
+		expected []ClickPoint
+	}{
+		{"hour", ClickFilter{From: start, To: start.Add(3 * time.Hour)}, StepHour, []ClickPoint{
+			{start, 2}, {start.Add(time.Hour), 0}, {start.Add(2 * time.Hour), 1},
+		}},
+		{"day", ClickFilter{Key: "/gh", From: start, To: day(5)}, StepDay, []ClickPoint{
+			{day(1), 2}, {day(2), 0}, {day(3), 1}, {day(4), 0},
+		}},
+		// The first point has all the clicks of its step
+		{"unaligned", ClickFilter{Key: "/gh", From: start.Add(45 * time.Minute), To: start.Add(2 * time.Hour)}, StepHour, []ClickPoint{
+			{start, 2}, {start.Add(time.Hour), 0},
+		}},
+		// The weeks start on Monday, 28 September and 5 October
+		{"week", ClickFilter{From: day(1), To: day(8)}, StepWeek, []ClickPoint{
+			{time.Date(2026, 9, 28, 0, 0, 0, 0, time.UTC), 4}, {day(5), 1},
+		}},
+	}
+	for _, test := range tests {
+		got, err := ClickSeriesDB(clicksDB, test.filter, test.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: wrong series:\ngot  %v\nwant %v\n", test.name, got, test.expected)
+		}
+	}
+
+	top, err := TopClicksDB(clicksDB, ClickFilter{}, FieldReferrer, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []ClickTotal{{"", 2}, {"example.com", 2}}; !reflect.DeepEqual(top, expected) {
+		t.Errorf("wrong top referrers:\ngot  %v\nwant %v\n", top, expected)
+	}
+	top, err = TopClicksDB(clicksDB, ClickFilter{Key: "/gh"}, FieldAgent, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []ClickTotal{{"browser", 2}, {"bot", 1}, {"cli", 1}}; !reflect.DeepEqual(top, expected) {
+		t.Errorf("wrong top agents:\ngot  %v\nwant %v\n", top, expected)
+	}
+
+	// Invalid queries
+	_, noRange := ClickSeriesDB(clicksDB, ClickFilter{From: start}, StepDay)
+	_, badStep := ClickSeriesDB(clicksDB, ClickFilter{From: start, To: day(5)}, "month")
+	_, tooLong := ClickSeriesDB(clicksDB, ClickFilter{From: day(1), To: day(1).AddDate(5, 0, 0)}, StepHour)
+	_, badField := TopClicksDB(clicksDB, ClickFilter{}, "ip", 10)
+	for name, err := range map[string]error{"no range": noRange, "bad step": badStep, "too long": tooLong, "bad field": badField} {
+		if !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("wrong error for %s, got %v want %v\n", name, err, ErrInvalidQuery)
+		}
+	}
+}
+
+func TestClickWriter(t *testing.T) {
+	clicksDB, err := SetupDB(filepath.Join(t.TempDir(), "urls.db"), "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clicksDB.Close()
+	count := func() uint64 {
+		t.Helper()
+		c, err := GetClickCountDB(clicksDB, "/gh")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Clicks
+	}
+	click := Click{Time: time.Now().UTC(), Key: "/gh", Path: "/gh", URL: "https://github.com"}
+
+	// A full batch is written at once, and the rest after the interval
+	w := NewClickWriter(clicksDB, ClickOptions{BatchSize: 3, FlushInterval: 50 * time.Millisecond})
+	for i := 0; i < 4; i++ {
+		w.RecordClick(click)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := count(); got != 3 && got != 4 {
+		t.Errorf("got %d clicks after a full batch, want 3", got)
+	}
+	for count() < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := count(); got != 4 {
+		t.Errorf("got %d clicks after the interval, want 4", got)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RecordClick(click); !errors.Is(err, ErrClosed) {
+		t.Errorf("got %v for a closed ClickWriter, want ErrClosed", err)
+	}
+
+	// While the Database is busy, the clicks are sampled and dropped,
+	// and the queued ones are written on Close
+	tx, err := clicksDB.BoltDB.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = NewClickWriter(clicksDB, ClickOptions{QueueSize: 8, BatchSize: 1, FlushInterval: time.Hour, SampleRate: 2})
+	const total = 100
+	for i := 0; i < total; i++ {
+		w.RecordClick(click)
+	}
+	stats := w.Stats()
+	if stats.Sampled == 0 || stats.Dropped == 0 || stats.Queued+stats.Sampled+stats.Dropped != total {
+		t.Errorf("wrong stats under backpressure: %+v", stats)
+	}
+	tx.Rollback()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stats = w.Stats(); stats.Written != stats.Queued || stats.Failed != 0 {
+		t.Errorf("the queued clicks were not written on Close: %+v", stats)
+	}
+	if got := count(); got != 4+stats.Written {
+		t.Errorf("got %d clicks, want %d", got, 4+stats.Written)
+	}
+}
+
+// BenchmarkRecordClick compares recording a click in its own transaction
+// with queueing it to a ClickWriter, from concurrent requests
+func BenchmarkRecordClick(b *testing.B) {
+	click := Click{Time: time.Now().UTC(), Key: "/gh", Path: "/gh", URL: "https://github.com", Agent: "browser"}
+	run := func(b *testing.B, rec func(c Click) error) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := rec(click); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	}
+	b.Run("transaction", func(b *testing.B) {
+		clicksDB, err := SetupDB(filepath.Join(b.TempDir(), "urls.db"), "URL")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer clicksDB.Close()
+		run(b, clicksDB.RecordClick)
+	})
+	b.Run("batched", func(b *testing.B) {
+		clicksDB, err := SetupDB(filepath.Join(b.TempDir(), "urls.db"), "URL")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer clicksDB.Close()
+		w := NewClickWriter(clicksDB, DefaultClickOptions)
+		run(b, w.RecordClick)
+		b.StopTimer()
+		w.Close()
+		stats := w.Stats()
+		b.ReportMetric(float64(stats.Sampled+stats.Dropped)/float64(b.N), "lost/op")
+	})
+}
+
+// Check that two Records are the same link, ignoring their version and times
+func sameLink(a Record, b Record) bool {
+	return a.Url == b.Url && a.Status == b.Status && a.Query == b.Query &&
+		a.Disabled == b.Disabled && a.Description == b.Description &&
+		reflect.DeepEqual(a.Tags, b.Tags)
+}
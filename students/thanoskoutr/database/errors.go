@@ -0,0 +1,77 @@
+package database
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// ErrNotFound is returned when the key does not exist.
+	ErrNotFound = errors.New("key not found")
+	// ErrBucketMissing is returned when the Bucket of the Database
+	// does not exist.
+	ErrBucketMissing = errors.New("bucket does not exist")
+	// ErrReadOnly is returned when writing to a Database that was
+	// opened read-only.
+	ErrReadOnly = errors.New("database is read-only")
+	// ErrExists is returned when a new key already exists.
+	ErrExists = errors.New("key already exists")
+	// ErrLocked is returned when the Database could not be opened,
+	// because another process holds it open for writing.
+	ErrLocked = errors.New("database is locked by another process")
+	// ErrInconsistent is returned when a snapshot of a Database that is
+	// being written is not consistent, see SetupSnapshotDB.
+	ErrInconsistent = errors.New("database snapshot is inconsistent")
+	// ErrInvalidQuery is returned for a query of the clicks that is not
+	// valid, e.g. with an unknown step.
+	ErrInvalidQuery = errors.New("invalid query")
+)
+
+// Error represents an error of an operation on the Bolt Database.
+//
+// Err is either one of the errors of this package, or the error
+// returned by Bolt, so they can be checked with errors.Is:
+//
+//     if errors.Is(err, database.ErrNotFound) {
+//         ...
+//     }
+type Error struct {
+	Op  string // operation, e.g. "get"
+	Key string // key of the operation, if any
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Key == "" {
+		return "database: " + e.Op + ": " + e.Err.Error()
+	}
+	return "database: " + e.Op + " " + strconv.Quote(e.Key) + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// wrapError will wrap an error of an operation in an Error.
+//
+// The Bolt errors for writing to a read-only Database are
+// replaced by ErrReadOnly, and the timeout for opening a Database
+// held by another process by ErrLocked.
+func wrapError(op string, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	switch err {
+	case bolt.ErrDatabaseReadOnly, bolt.ErrTxNotWritable:
+		err = ErrReadOnly
+	case bolt.ErrTimeout:
+		err = ErrLocked
+	}
+	return &Error{Op: op, Key: key, Err: err}
+}
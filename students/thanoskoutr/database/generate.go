@@ -0,0 +1,133 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/generator"
+)
+
+// KeyGenerator is implemented by the stores that can generate the keys
+// of new Records.
+type KeyGenerator interface {
+	// PutGenerated inserts the Record under a generated key, on the
+	// host of the Record, and returns the key.
+	PutGenerated(ctx context.Context, gen *generator.Generator, rec Record) (string, error)
+}
+
+// PutGeneratedDB inserts the Record into the Bolt Database Bucket under
+// a key generated by the Generator, and returns the key.
+//
+// The key is generated inside the write transaction, so a collision with
+// an existing key is detected and retried with the next code. Codes with
+// blocked words are retried too. The sequence strategy counts with the
+// sequence of the Bucket.
+//
+// If the strategy always generates the same code for a URL, e.g. hash,
+// and the Record of the code has the same URL, its key is returned and
+// nothing is inserted. If no code is free after the maximum attempts,
+// generator.ErrExhausted is returned.
+func PutGeneratedDB(db *Database, gen *generator.Generator, rec Record) (string, error) {
+	var key string
+	var inserted bool
+	err := db.BoltDB.Update(func(tx *bolt.Tx) error {
+		b, err := bucket(tx, db)
+		if err != nil {
+			return err
+		}
+		key, inserted, err = generateKey(gen, rec, b.NextSequence, func(k string) (*Record, error) {
+			v := b.Get([]byte(k))
+			if v == nil {
+				return nil, nil
+			}
+			r, err := decodeRecord(v)
+			return &r, err
+		})
+		if err != nil || !inserted {
+			return err
+		}
+		rec, err = putRecord(b, key, rec, time.Now().UTC())
+		return err
+	})
+	if err != nil {
+		return "", wrapError("generate", key, err)
+	}
+	if inserted {
+		notify(db, Change{Key: key, Record: rec})
+	}
+	return key, nil
+}
+
+// generateKey will try the codes of the Generator, until one is allowed
+// and free, with existing returning the Record of a key, or nil.
+//
+// It returns the key, and whether the Record must be inserted under it,
+// which is false if the key of a reusable code is returned.
+func generateKey(gen *generator.Generator, rec Record, next func() (uint64, error), existing func(key string) (*Record, error)) (string, bool, error) {
+	for attempt := 0; attempt < gen.Attempts(); attempt++ {
+		code, err := gen.Strategy.Generate(generator.Input{
+			URL:          rec.Url,
+			Attempt:      attempt,
+			NextSequence: next,
+		})
+		if err != nil {
+			return "", false, err
+		}
+		if !gen.Allowed(code) {
+			continue
+		}
+		key := HostKey(rec.Host, gen.Path(code))
+		old, err := existing(key)
+		if err != nil {
+			return "", false, err
+		}
+		if old == nil {
+			return key, true, nil
+		}
+		if gen.Reusable() && old.Url == rec.Url {
+			return key, false, nil
+		}
+	}
+	return "", false, generator.ErrExhausted
+}
+
+// PutGenerated inserts the Record under a generated key,
+// see PutGeneratedDB.
+func (db *Database) PutGenerated(ctx context.Context, gen *generator.Generator, rec Record) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return PutGeneratedDB(db, gen, rec)
+}
+
+// PutGenerated inserts the Record under a generated key,
+// like PutGeneratedDB.
+func (m *MemStore) PutGenerated(ctx context.Context, gen *generator.Generator, rec Record) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	next := func() (uint64, error) {
+		m.sequence++
+		return m.sequence, nil
+	}
+	key, inserted, err := generateKey(gen, rec, next, func(k string) (*Record, error) {
+		if r, ok := m.records[k]; ok {
+			return &r, nil
+		}
+		return nil, nil
+	})
+	if err != nil || !inserted {
+		m.mu.Unlock()
+		return key, err
+	}
+	rec = fillRecord(key, rec, nil, time.Now().UTC())
+	m.records[key] = rec
+	watchers := m.watchers
+	m.mu.Unlock()
+	for _, w := range watchers {
+		w.fn(Change{Key: key, Record: rec})
+	}
+	return key, nil
+}
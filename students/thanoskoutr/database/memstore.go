@@ -0,0 +1,206 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemStore is an in-memory Store, e.g. for tests.
+//
+// The zero value is not ready for use, see NewMemStore.
+type MemStore struct {
+	mu       sync.RWMutex
+	records  map[string]Record
+	sequence uint64
+	watchers []*watcher
+}
+
+// NewMemStore returns an empty in-memory Store.
+func NewMemStore() *MemStore {
+	return &MemStore{records: make(map[string]Record)}
+}
+
+// Get returns the Record of the key, or ErrNotFound.
+func (m *MemStore) Get(ctx context.Context, key string) (Record, error) {
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rec, ok := m.records[key]
+	if !ok {
+		return Record{}, ErrNotFound
+	}
+	return rec, nil
+}
+
+// Put inserts the key-Record pair, or replaces the Record of the key,
+// like PutRecordDB.
+func (m *MemStore) Put(ctx context.Context, key string, rec Record) error {
+	return m.write(ctx, key, rec, nil)
+}
+
+// Insert inserts the key-Record pair, or returns ErrExists, like
+// InsertRecordDB.
+func (m *MemStore) Insert(ctx context.Context, key string, rec Record) error {
+	return m.write(ctx, key, rec, func(exists bool) error {
+		if exists {
+			return ErrExists
+		}
+		return nil
+	})
+}
+
+// Replace replaces the Record of the key, or returns ErrNotFound, like
+// ReplaceRecordDB.
+func (m *MemStore) Replace(ctx context.Context, key string, rec Record) error {
+	return m.write(ctx, key, rec, func(exists bool) error {
+		if !exists {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+// write will put the key-Record pair, if check returns no error for
+// whether the key exists, and notify the watchers.
+func (m *MemStore) write(ctx context.Context, key string, rec Record, check func(exists bool) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	var old *Record
+	if r, ok := m.records[key]; ok {
+		old = &r
+	}
+	if check != nil {
+		if err := check(old != nil); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+	}
+	rec = fillRecord(key, rec, old, time.Now().UTC())
+	m.records[key] = rec
+	watchers := m.watchers
+	m.mu.Unlock()
+	for _, w := range watchers {
+		w.fn(Change{Key: key, Record: rec})
+	}
+	return nil
+}
+
+// Update changes the Record of the key with the function, and stores
+// it, or returns ErrNotFound or the error of the function, like
+// UpdateRecordDB. The function must not use the MemStore.
+func (m *MemStore) Update(ctx context.Context, key string, fn func(rec *Record) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	old, ok := m.records[key]
+	if !ok {
+		m.mu.Unlock()
+		return ErrNotFound
+	}
+	rec := old
+	rec.Tags = append([]string(nil), old.Tags...)
+	if err := fn(&rec); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	rec = fillRecord(key, rec, &old, time.Now().UTC())
+	m.records[key] = rec
+	watchers := m.watchers
+	m.mu.Unlock()
+	for _, w := range watchers {
+		w.fn(Change{Key: key, Record: rec})
+	}
+	return nil
+}
+
+// Rename replaces the Record of the key with the Record of a new key,
+// or returns ErrNotFound or ErrExists, like RenameRecordDB.
+func (m *MemStore) Rename(ctx context.Context, key string, newKey string, rec Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if _, ok := m.records[newKey]; ok && newKey != key {
+		m.mu.Unlock()
+		return ErrExists
+	}
+	old, ok := m.records[key]
+	if !ok {
+		m.mu.Unlock()
+		return ErrNotFound
+	}
+	rec = fillRecord(newKey, rec, &old, time.Now().UTC())
+	changes := []Change{{Key: newKey, Record: rec}}
+	if newKey != key {
+		delete(m.records, key)
+		changes = append([]Change{{Key: key, Deleted: true}}, changes...)
+	}
+	m.records[newKey] = rec
+	watchers := m.watchers
+	m.mu.Unlock()
+	for _, w := range watchers {
+		for _, c := range changes {
+			w.fn(c)
+		}
+	}
+	return nil
+}
+
+// Delete removes the key, or returns ErrNotFound.
+func (m *MemStore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if _, ok := m.records[key]; !ok {
+		m.mu.Unlock()
+		return ErrNotFound
+	}
+	delete(m.records, key)
+	watchers := m.watchers
+	m.mu.Unlock()
+	for _, w := range watchers {
+		w.fn(Change{Key: key, Deleted: true})
+	}
+	return nil
+}
+
+// List returns a copy of all key-Record pairs.
+func (m *MemStore) List(ctx context.Context) (map[string]Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	records := make(map[string]Record, len(m.records))
+	for k, rec := range m.records {
+		records[k] = rec
+	}
+	return records, nil
+}
+
+// Watch registers a function that is called after every change, until
+// the returned unwatch function is called.
+func (m *MemStore) Watch(fn func(Change)) (unwatch func()) {
+	w := &watcher{fn: fn}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watchers = append(m.watchers, w)
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.watchers = withoutWatcher(m.watchers, w)
+	}
+}
+
+// Close does nothing, the records are kept until the MemStore
+// is garbage collected.
+func (m *MemStore) Close() error {
+	return nil
+}
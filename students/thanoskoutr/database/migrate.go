@@ -0,0 +1,73 @@
+package database
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// metaBucket is the Bucket that keeps the Record version of every
+// Bucket of the Bolt Database.
+const metaBucket = "meta"
+
+// MigrateDB rewrites the version 0 values of the Bolt Database Bucket,
+// i.e. plain URLs and Records without a version, as current Records.
+//
+// It also rewrites the keys of the clicks of the links of older
+// versions as time-ordered keys, and indexes them by link.
+//
+// The version of the Bucket is kept in the meta Bucket, so once a
+// Bucket is migrated it is not read again. SetupDB migrates the
+// Bucket it opens.
+func MigrateDB(db *Database) error {
+	err := db.BoltDB.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		if err := migrateRecords(tx, db, meta); err != nil {
+			return err
+		}
+		return migrateClicks(tx, db, meta)
+	})
+	return wrapError("migrate", "", err)
+}
+
+// migrateRecords will rewrite the Records of older versions, in the
+// transaction.
+func migrateRecords(tx *bolt.Tx, db *Database, meta *bolt.Bucket) error {
+	b, err := bucket(tx, db)
+	if err != nil {
+		return err
+	}
+	version, _ := strconv.Atoi(string(meta.Get([]byte(db.Bucket))))
+	if version >= RecordVersion {
+		return nil
+	}
+	now := time.Now().UTC()
+	// Collect the keys first, a Bucket cannot be changed while iterating
+	legacy := make(map[string]Record)
+	err = b.ForEach(func(k, v []byte) error {
+		rec, err := decodeRecord(v)
+		if err != nil {
+			return wrapError("decode", string(k), err)
+		}
+		if rec.Version < RecordVersion {
+			legacy[string(k)] = rec
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for key, rec := range legacy {
+		if rec.CreatedAt.IsZero() {
+			rec.CreatedAt = now
+		}
+		if _, err := putRecord(b, key, rec, now); err != nil {
+			return wrapError("migrate", key, err)
+		}
+	}
+	return meta.Put([]byte(db.Bucket), []byte(strconv.Itoa(RecordVersion)))
+}
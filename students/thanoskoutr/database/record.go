@@ -0,0 +1,145 @@
+package database
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// RecordVersion is the version of the Record encoding written by
+// this package.
+//
+// Version 0 values are the plain URLs and the JSON objects without a
+// version, written by older versions of this package. They are still
+// read, and MigrateDB rewrites them in the current version.
+const RecordVersion = 1
+
+// Record represents a link: the value stored for a key in the Bolt
+// Database Bucket, and an entry of the YAML and JSON files.
+//
+// Contains the URL, how to redirect to it and metadata about the link.
+// A Record is enabled unless Disabled is set, and is encoded with an
+// "enabled" field, which is true when it is omitted. The CreatedAt and
+// UpdatedAt times are encoded as "created_at" and "updated_at" fields,
+// which are omitted when the times are zero.
+type Record struct {
+	Version     int       `json:"version,omitempty" yaml:"version,omitempty"`
+	Path        string    `json:"path,omitempty" yaml:"path,omitempty"`
+	Host        string    `json:"host,omitempty" yaml:"host,omitempty"`
+	Url         string    `json:"url" yaml:"url"`
+	Status      int       `json:"status,omitempty" yaml:"status,omitempty"`
+	Query       string    `json:"query,omitempty" yaml:"query,omitempty"`
+	Disabled    bool      `json:"-" yaml:"-"`
+	Description string    `json:"description,omitempty" yaml:"description,omitempty"`
+	Tags        []string  `json:"tags,omitempty" yaml:"tags,omitempty"`
+	CreatedBy   string    `json:"created_by,omitempty" yaml:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"-" yaml:"-"`
+	UpdatedAt   time.Time `json:"-" yaml:"-"`
+}
+
+// recordFields has the fields of a Record, without its methods.
+type recordFields Record
+
+// recordJSON is the encoding of a Record, with the enabled flag and
+// the times that are not zero.
+type recordJSON struct {
+	recordFields
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	Enabled   *bool      `json:"enabled,omitempty"`
+}
+
+// recordYAML is the encoding of a Record, with the enabled flag and
+// the times that are not zero.
+type recordYAML struct {
+	recordFields `yaml:",inline"`
+	CreatedAt    *time.Time `yaml:"created_at,omitempty"`
+	UpdatedAt    *time.Time `yaml:"updated_at,omitempty"`
+	Enabled      *bool      `yaml:"enabled,omitempty"`
+}
+
+// MarshalJSON encodes the Record, with the enabled flag.
+func (rec Record) MarshalJSON() ([]byte, error) {
+	enabled := !rec.Disabled
+	return json.Marshal(recordJSON{
+		recordFields: recordFields(rec),
+		CreatedAt:    encodeTime(rec.CreatedAt),
+		UpdatedAt:    encodeTime(rec.UpdatedAt),
+		Enabled:      &enabled,
+	})
+}
+
+// UnmarshalJSON decodes the Record, with the enabled flag.
+func (rec *Record) UnmarshalJSON(data []byte) error {
+	var r recordJSON
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	*rec = Record(r.recordFields)
+	rec.CreatedAt = decodeTime(r.CreatedAt)
+	rec.UpdatedAt = decodeTime(r.UpdatedAt)
+	rec.Disabled = r.Enabled != nil && !*r.Enabled
+	return nil
+}
+
+// MarshalYAML encodes the Record, with the enabled flag only
+// for a disabled Record.
+func (rec Record) MarshalYAML() (interface{}, error) {
+	r := recordYAML{
+		recordFields: recordFields(rec),
+		CreatedAt:    encodeTime(rec.CreatedAt),
+		UpdatedAt:    encodeTime(rec.UpdatedAt),
+	}
+	if rec.Disabled {
+		r.Enabled = new(bool)
+	}
+	return r, nil
+}
+
+// UnmarshalYAML decodes the Record, with the enabled flag.
+func (rec *Record) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var r recordYAML
+	if err := unmarshal(&r); err != nil {
+		return err
+	}
+	*rec = Record(r.recordFields)
+	rec.CreatedAt = decodeTime(r.CreatedAt)
+	rec.UpdatedAt = decodeTime(r.UpdatedAt)
+	rec.Disabled = r.Enabled != nil && !*r.Enabled
+	return nil
+}
+
+// encodeTime will return the time to encode, nil if it is zero.
+func encodeTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// decodeTime will return the decoded time, zero if it is nil.
+func decodeTime(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+// encodeRecord will encode a Record to be stored as a value,
+// in the current version.
+func encodeRecord(rec Record) ([]byte, error) {
+	rec.Version = RecordVersion
+	return json.Marshal(rec)
+}
+
+// decodeRecord will decode a stored value to a Record.
+//
+// Values that are not JSON objects are plain URLs, and are decoded
+// to a version 0 Record.
+func decodeRecord(v []byte) (Record, error) {
+	if len(v) == 0 || v[0] != '{' {
+		return Record{Url: string(v)}, nil
+	}
+	var rec Record
+	err := json.Unmarshal(v, &rec)
+	return rec, err
+}
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"context"
+	"os"
+)
+
+// Store is a key-Record storage for paths and their URLs.
+//
+// Database is the Bolt implementation of Store, and MemStore is an
+// in-memory implementation of it.
+type Store interface {
+	// Get returns the Record of the key, or ErrNotFound.
+	Get(ctx context.Context, key string) (Record, error)
+	// Put inserts the key-Record pair, or replaces the Record of the key.
+	Put(ctx context.Context, key string, rec Record) error
+	// Insert inserts the key-Record pair, or returns ErrExists, atomically.
+	Insert(ctx context.Context, key string, rec Record) error
+	// Replace replaces the Record of the key, or returns ErrNotFound,
+	// atomically.
+	Replace(ctx context.Context, key string, rec Record) error
+	// Update changes the Record of the key with the function, and
+	// stores it, atomically, or returns ErrNotFound or the error of the
+	// function. The function must not use the Store.
+	Update(ctx context.Context, key string, fn func(rec *Record) error) error
+	// Rename replaces the Record of the key with the Record of a new
+	// key, atomically, or returns ErrNotFound or ErrExists.
+	Rename(ctx context.Context, key string, newKey string, rec Record) error
+	// Delete removes the key, or returns ErrNotFound.
+	Delete(ctx context.Context, key string) error
+	// List returns all key-Record pairs.
+	List(ctx context.Context) (map[string]Record, error)
+	// Close releases the resources of the Store.
+	Close() error
+}
+
+// Watcher is implemented by the stores that notify about their changes.
+type Watcher interface {
+	// Watch registers a function that is called after every change,
+	// until the returned unwatch function is called.
+	Watch(fn func(Change)) (unwatch func())
+}
+
+// Iterator is implemented by the stores that can iterate over their
+// key-Record pairs, without reading them all in memory.
+type Iterator interface {
+	// ForEach calls the function for every key-Record pair, until
+	// the function returns an error.
+	ForEach(ctx context.Context, fn func(key string, rec Record) error) error
+}
+
+// Get reads the Record of the key from the Bolt Database Bucket.
+func (db *Database) Get(ctx context.Context, key string) (Record, error) {
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
+	return GetRecordDB(db, key)
+}
+
+// Put inserts the key-Record pair into the Bolt Database Bucket.
+func (db *Database) Put(ctx context.Context, key string, rec Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return PutRecordDB(db, key, rec)
+}
+
+// Insert inserts the key-Record pair into the Bolt Database Bucket,
+// if the key does not exist, see InsertRecordDB.
+func (db *Database) Insert(ctx context.Context, key string, rec Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return InsertRecordDB(db, key, rec)
+}
+
+// Replace replaces the Record of the key of the Bolt Database Bucket,
+// if the key exists, see ReplaceRecordDB.
+func (db *Database) Replace(ctx context.Context, key string, rec Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ReplaceRecordDB(db, key, rec)
+}
+
+// Update changes the Record of the key of the Bolt Database Bucket
+// with the function, see UpdateRecordDB.
+func (db *Database) Update(ctx context.Context, key string, fn func(rec *Record) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return UpdateRecordDB(db, key, fn)
+}
+
+// Rename replaces the Record of the key of the Bolt Database Bucket
+// with the Record of a new key, see RenameRecordDB.
+func (db *Database) Rename(ctx context.Context, key string, newKey string, rec Record) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return RenameRecordDB(db, key, newKey, rec)
+}
+
+// Delete deletes the key from the Bolt Database Bucket.
+func (db *Database) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return DeleteEntryDB(db, key)
+}
+
+// List reads all key-Record pairs from the Bolt Database Bucket.
+func (db *Database) List(ctx context.Context) (map[string]Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return GetRecordsDB(db)
+}
+
+// ForEach calls the function for every key-Record pair of the
+// Bolt Database Bucket, see ForEachRecordDB.
+func (db *Database) ForEach(ctx context.Context, fn func(key string, rec Record) error) error {
+	return ForEachRecordDB(db, func(key string, rec Record) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(key, rec)
+	})
+}
+
+// Watch registers a function that is called after every change
+// of the Bolt Database Bucket, see WatchDB.
+func (db *Database) Watch(fn func(Change)) (unwatch func()) {
+	return WatchDB(db, fn)
+}
+
+// Close closes the Bolt Database, and removes it if it is a snapshot,
+// see SetupSnapshotDB.
+func (db *Database) Close() error {
+	err := db.BoltDB.Close()
+	if db.snapshot != "" {
+		if rerr := os.Remove(db.snapshot); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package database
+
+// Change represents a change of a key in the Bolt Database Bucket.
+//
+// For a deleted key, the Record is empty.
+type Change struct {
+	Key     string
+	Record  Record
+	Deleted bool
+}
+
+// watcher is a registered function, removed by its pointer.
+type watcher struct {
+	fn func(Change)
+}
+
+// withoutWatcher will return a copy of the watchers without w, so the
+// watchers that are being notified are not changed.
+func withoutWatcher(watchers []*watcher, w *watcher) []*watcher {
+	kept := make([]*watcher, 0, len(watchers))
+	for _, other := range watchers {
+		if other != w {
+			kept = append(kept, other)
+		}
+	}
+	return kept
+}
+
+// WatchDB registers a function that is called after every change
+// made to the Bolt Database Bucket through this package, until the
+// returned unwatch function is called.
+//
+// The function is called after the change is committed, in the
+// goroutine that made the change.
+func WatchDB(db *Database, fn func(Change)) (unwatch func()) {
+	w := &watcher{fn: fn}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.watchers = append(db.watchers, w)
+	return func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.watchers = withoutWatcher(db.watchers, w)
+	}
+}
+
+// notify will call the registered watchers for every change.
+func notify(db *Database, changes ...Change) {
+	db.mu.RLock()
+	watchers := db.watchers
+	db.mu.RUnlock()
+	for _, w := range watchers {
+		for _, c := range changes {
+			w.fn(c)
+		}
+	}
+}
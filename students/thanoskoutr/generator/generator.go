@@ -0,0 +1,261 @@
+// Package generator generates the short codes of links, for paths
+// that are not chosen by hand.
+//
+// A Strategy generates the codes: from a counter (Sequence), at random
+// (Random) or from the destination URL (Hash). A Generator wraps a
+// Strategy, to reject codes with blocked words and to retry on
+// collisions, see database.PutGeneratedDB.
+package generator
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Base62 is the alphabet of digits and ASCII letters.
+	Base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	// Unambiguous is the Base62 alphabet without the characters that are
+	// easily confused with each other: 0, O, o, 1, I and l.
+	Unambiguous = "23456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnpqrstuvwxyz"
+)
+
+// DefaultLength is the length of the Random and Hash codes, if not set.
+const DefaultLength = 7
+
+// DefaultMaxAttempts is the number of codes a Generator tries, if not set.
+const DefaultMaxAttempts = 10
+
+// ErrExhausted is returned when no code could be generated, because
+// all the attempts collided or were blocked.
+var ErrExhausted = errors.New("generator: no free code after the maximum attempts")
+
+// Input is the input of a Strategy, for generating a single code.
+type Input struct {
+	// URL is the destination URL of the link.
+	URL string
+	// Attempt is the number of codes already rejected for this link.
+	Attempt int
+	// NextSequence returns the next value of a persistent counter.
+	NextSequence func() (uint64, error)
+}
+
+// Strategy generates codes.
+type Strategy interface {
+	Generate(in Input) (string, error)
+}
+
+// Sequence generates codes by encoding the next value of a counter,
+// e.g. the Bolt Bucket sequence, in the alphabet (Unambiguous by
+// default).
+type Sequence struct {
+	Alphabet string
+}
+
+// Generate returns the next value of the counter, encoded.
+func (s Sequence) Generate(in Input) (string, error) {
+	if in.NextSequence == nil {
+		return "", errors.New("generator: sequence strategy without a counter")
+	}
+	n, err := in.NextSequence()
+	if err != nil {
+		return "", err
+	}
+	return Encode(n, alphabetOr(s.Alphabet, Unambiguous)), nil
+}
+
+// Random generates cryptographically random codes of the length,
+// from the alphabet (Unambiguous by default).
+type Random struct {
+	Length   int
+	Alphabet string
+}
+
+// Generate returns a new random code.
+func (s Random) Generate(in Input) (string, error) {
+	alphabet := alphabetOr(s.Alphabet, Unambiguous)
+	max := big.NewInt(int64(len(alphabet)))
+	code := make([]byte, lengthOr(s.Length))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = alphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// Hash generates codes of the length from the SHA-256 hash of the URL,
+// in the alphabet (Unambiguous by default), so the same URL always gets
+// the same code. After a collision, the attempt is hashed with the URL.
+type Hash struct {
+	Length   int
+	Alphabet string
+}
+
+// Generate returns the code of the URL, for the attempt.
+func (s Hash) Generate(in Input) (string, error) {
+	data := in.URL
+	if in.Attempt > 0 {
+		data += "#" + strconv.Itoa(in.Attempt)
+	}
+	sum := sha256.Sum256([]byte(data))
+	alphabet := alphabetOr(s.Alphabet, Unambiguous)
+	length := lengthOr(s.Length)
+	var code strings.Builder
+	// Encode the hash 8 bytes at a time, until the code is long enough
+	for i := 0; code.Len() < length; i = (i + 8) % len(sum) {
+		code.WriteString(Encode(binary.BigEndian.Uint64(sum[i:i+8]), alphabet))
+	}
+	return code.String()[:length], nil
+}
+
+// Reusable reports that the codes of a URL can be reused for it.
+func (s Hash) Reusable() bool {
+	return true
+}
+
+// Reusable is implemented by the strategies that always generate the
+// same codes for a URL, so an existing code of the URL is reused,
+// instead of being treated as a collision.
+type Reusable interface {
+	Reusable() bool
+}
+
+// New returns the strategy with the name: sequence, random or hash,
+// with the alphabet (Unambiguous if empty). The length is used by the
+// random and hash strategies.
+func New(name string, length int, alphabet string) (Strategy, error) {
+	if err := CheckAlphabet(alphabet); alphabet != "" && err != nil {
+		return nil, err
+	}
+	switch name {
+	case "sequence":
+		return Sequence{Alphabet: alphabet}, nil
+	case "random":
+		return Random{Length: length, Alphabet: alphabet}, nil
+	case "hash":
+		return Hash{Length: length, Alphabet: alphabet}, nil
+	}
+	return nil, fmt.Errorf("generator: unknown strategy %q", name)
+}
+
+// CheckAlphabet returns an error if the alphabet cannot encode codes:
+// if it has less than 2 characters, repeats a character, or has
+// characters that are not printable ASCII or are not allowed in a path
+// segment, like / and ?.
+func CheckAlphabet(alphabet string) error {
+	if len(alphabet) < 2 {
+		return fmt.Errorf("generator: alphabet %q has less than 2 characters", alphabet)
+	}
+	for i := 0; i < len(alphabet); i++ {
+		c := alphabet[i]
+		if c <= ' ' || c > '~' || strings.IndexByte("/?#%{}", c) >= 0 {
+			return fmt.Errorf("generator: alphabet %q has the invalid character %q", alphabet, c)
+		}
+		if strings.IndexByte(alphabet[:i], c) >= 0 {
+			return fmt.Errorf("generator: alphabet %q repeats the character %q", alphabet, c)
+		}
+	}
+	return nil
+}
+
+// Generator generates the paths of links with a Strategy.
+//
+// The paths are the codes with the Prefix ("/" by default). Codes that
+// contain one of the BlockedWords are rejected, like the ones that
+// collide with existing paths, and a new code is tried, up to
+// MaxAttempts times.
+type Generator struct {
+	Strategy     Strategy
+	Prefix       string
+	BlockedWords []string
+	MaxAttempts  int
+}
+
+// Path returns the path of a code.
+func (g *Generator) Path(code string) string {
+	if g.Prefix == "" {
+		return "/" + code
+	}
+	return g.Prefix + code
+}
+
+// Attempts returns the maximum number of codes to try.
+func (g *Generator) Attempts() int {
+	if g.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return g.MaxAttempts
+}
+
+// Reusable reports whether an existing path of the URL can be reused.
+func (g *Generator) Reusable() bool {
+	r, ok := g.Strategy.(Reusable)
+	return ok && r.Reusable()
+}
+
+// Allowed reports whether the code contains none of the blocked words.
+//
+// Codes are compared in lower case, and with digits that look like
+// letters read as letters, e.g. "h3ll0" contains "hello".
+func (g *Generator) Allowed(code string) bool {
+	lower := strings.ToLower(code)
+	letters := leet.Replace(lower)
+	for _, word := range g.BlockedWords {
+		word = strings.ToLower(word)
+		if word == "" {
+			continue
+		}
+		if strings.Contains(lower, word) || strings.Contains(letters, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// leet reads the digits that look like letters as letters.
+var leet = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "8", "b")
+
+// Encode encodes the number in the alphabet, most significant digit first.
+// The alphabet must have at least 2 characters, see CheckAlphabet.
+func Encode(n uint64, alphabet string) string {
+	base := uint64(len(alphabet))
+	if base < 2 {
+		panic("generator: Encode with an alphabet of less than 2 characters")
+	}
+	if n == 0 {
+		return alphabet[:1]
+	}
+	var digits []byte
+	for ; n > 0; n /= base {
+		digits = append(digits, alphabet[n%base])
+	}
+	for i, j := 0, len(digits)-1; i < j; i, j = i+1, j-1 {
+		digits[i], digits[j] = digits[j], digits[i]
+	}
+	return string(digits)
+}
+
+// alphabetOr returns the alphabet, or the default one if not set.
+func alphabetOr(alphabet string, def string) string {
+	if alphabet == "" {
+		return def
+	}
+	return alphabet
+}
+
+// lengthOr returns the length, or the DefaultLength if not set.
+func lengthOr(length int) int {
+	if length <= 0 {
+		return DefaultLength
+	}
+	return length
+}
@@ -0,0 +1,143 @@
+package generator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		n    uint64
+		want string
+	}{
+		{0, "0"},
+		{1, "1"},
+		{61, "z"},
+		{62, "10"},
+		{3843, "zz"},
+	}
+	for _, tt := range tests {
+		if got := Encode(tt.n, Base62); got != tt.want {
+			t.Errorf("Encode(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestSequence(t *testing.T) {
+	var n uint64 = 55
+	next := func() (uint64, error) {
+		n++
+		return n, nil
+	}
+	// Unambiguous by default
+	for _, want := range []string{"32", "33"} {
+		code, err := Sequence{}.Generate(Input{NextSequence: next})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != want {
+			t.Errorf("code = %q, want %q", code, want)
+		}
+	}
+	if _, err := (Sequence{}).Generate(Input{}); err == nil {
+		t.Error("expected an error without a counter")
+	}
+}
+
+func TestRandom(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		code, err := Random{}.Generate(Input{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != DefaultLength {
+			t.Errorf("len(%q) = %d, want %d", code, len(code), DefaultLength)
+		}
+		if strings.ContainsAny(code, "0Oo1Il") {
+			t.Errorf("code %q has confusable characters", code)
+		}
+		seen[code] = true
+	}
+	if len(seen) < 99 {
+		t.Errorf("%d distinct codes out of 100", len(seen))
+	}
+	code, _ := Random{Length: 4, Alphabet: "ab"}.Generate(Input{})
+	if len(code) != 4 || strings.Trim(code, "ab") != "" {
+		t.Errorf("code = %q, want 4 characters of ab", code)
+	}
+}
+
+func TestHash(t *testing.T) {
+	in := Input{URL: "https://github.com/gophercises/urlshort"}
+	a, _ := Hash{}.Generate(in)
+	b, _ := Hash{}.Generate(in)
+	if a != b {
+		t.Errorf("codes %q and %q differ for the same URL", a, b)
+	}
+	if len(a) != DefaultLength {
+		t.Errorf("len(%q) = %d, want %d", a, len(a), DefaultLength)
+	}
+	in.Attempt = 1
+	if c, _ := (Hash{}).Generate(in); c == a {
+		t.Errorf("code %q is the same after a collision", c)
+	}
+	long, _ := Hash{Length: 40}.Generate(in)
+	if len(long) != 40 {
+		t.Errorf("len(%q) = %d, want 40", long, len(long))
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, name := range []string{"sequence", "random", "hash"} {
+		if _, err := New(name, 6, ""); err != nil {
+			t.Errorf("New(%q): %v", name, err)
+		}
+	}
+	if _, err := New("uuid", 6, ""); err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+	s, err := New("sequence", 6, "ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := s.Generate(Input{NextSequence: func() (uint64, error) { return 5, nil }}); code != "bab" {
+		t.Errorf("code = %q, want bab", code)
+	}
+	for _, alphabet := range []string{"a", "abca", "ab/", "ab c", "abé"} {
+		if _, err := New("random", 6, alphabet); err == nil {
+			t.Errorf("expected an error for the alphabet %q", alphabet)
+		}
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	g := &Generator{Strategy: Hash{}, BlockedWords: []string{"Bad", ""}}
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"xyz", true},
+		{"aBADz", false},
+		{"b4d99", false},
+		{"bd", true},
+	}
+	for _, tt := range tests {
+		if got := g.Allowed(tt.code); got != tt.want {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+	if got := g.Path("abc"); got != "/abc" {
+		t.Errorf("Path = %q, want /abc", got)
+	}
+	g.Prefix = "/s/"
+	if got := g.Path("abc"); got != "/s/abc" {
+		t.Errorf("Path = %q, want /s/abc", got)
+	}
+	if !g.Reusable() || (&Generator{Strategy: Random{}}).Reusable() {
+		t.Error("only hash codes should be reusable")
+	}
+	if g.Attempts() != DefaultMaxAttempts {
+		t.Errorf("Attempts = %d, want %d", g.Attempts(), DefaultMaxAttempts)
+	}
+}
@@ -3,7 +3,9 @@ module github.com/thanoskoutr/urlshort/students/thanoskoutr
 go 1.17
 
 require (
-	github.com/boltdb/bolt v1.3.1 // indirect
-	golang.org/x/sys v0.0.0-20210927094055-39ccf1dd6fa6 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	github.com/BurntSushi/toml v1.2.1
+	github.com/boltdb/bolt v1.3.1
+	gopkg.in/yaml.v2 v2.4.0
 )
+
+require golang.org/x/sys v0.0.0-20210927094055-39ccf1dd6fa6 // indirect
@@ -1,102 +1,417 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/api"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/config"
 	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/generator"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/server"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/ui"
 	"github.com/thanoskoutr/urlshort/students/thanoskoutr/urlshort"
 )
 
+// bucketName is the Bucket of the Database with the links
+const bucketName = "URL"
+
+// adminDefaults are the default settings of the admin server, which
+// listens only on localhost, and allows long CPU profiles
+var adminDefaults = server.Defaults.Merge(server.Settings{
+	Addr:         "127.0.0.1:8081",
+	WriteTimeout: 2 * time.Minute,
+})
+
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// serve parses the flags of the serve command and starts the server
+func serve(args []string, stdout io.Writer) error {
 	// Parse command-line flag
-	yamlFilename := flag.String("yaml", "urls.yaml", "YAML file with URLs and their short paths")
-	jsonFilename := flag.String("json", "urls.json", "JSON file with URLs and their short paths")
-	dbFilename := flag.String("db", "urls.db", "Database file")
-	flag.Parse()
-
-	// Setup Database
-	BUCKET_NAME := "URL"
-	db, err := database.SetupDB(*dbFilename, BUCKET_NAME)
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	chainFlags := addChainFlags(flags)
+	strategy := flags.String("generator", "random", "Strategy for generated paths: sequence, random or hash")
+	codeLength := flags.Int("code-length", generator.DefaultLength, "Length of the random and hash generated paths")
+	alphabet := flags.String("alphabet", generator.Unambiguous, "Characters of the generated paths, at least 2 of them")
+	blockedWords := flags.String("blocked-words", "", "Comma-separated words that the generated paths must not contain,\n"+
+		"also when spelled with digits, e.g. 5h1t")
+	serverFlags := server.Flags(flags)
+	adminFlags := server.PrefixFlags(flags, "admin-", adminDefaults)
+	strictConflicts := flags.Bool("strict-conflicts", false, "Refuse to start (or to reload the config) if a path is defined in more than one source,\n"+
+		"see the conflicts command")
+	if err := parseFlags(flags, args, 0, 0); err != nil {
+		return err
+	}
+	gen, err := generator.New(*strategy, *codeLength, *alphabet)
+	if err != nil {
+		return usageError{err}
+	}
+	var blocked []string
+	for _, word := range strings.Split(*blockedWords, ",") {
+		if word = strings.TrimSpace(word); word != "" {
+			blocked = append(blocked, word)
+		}
+	}
+
+	// Read the chain of handlers from the config file, or from the flags
+	cfg, err := chainFlags.load()
+	if err != nil {
+		return err
+	}
+
+	// Read the server settings from the config file, the environment
+	// variables and the flags, in increasing precedence
+	env, err := server.Env(os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	settings := server.Defaults.Merge(cfg.Server).Merge(env).Merge(serverFlags())
+	adminEnv, err := server.PrefixEnv(os.LookupEnv, "admin-")
+	if err != nil {
+		return err
+	}
+	adminSettings := adminDefaults.Merge(cfg.Admin).Merge(adminEnv).Merge(adminFlags())
+
+	// Build the chain of handlers, keeping the Databases open until exit
+	builder := config.NewBuilder(bucketName)
+	defer builder.Close()
+	chain, err := builder.Build(cfg)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer db.BoltDB.Close()
+	if *chainFlags.config == "" {
+		if err := seedDB(chain.Database); err != nil {
+			return err
+		}
+	}
+	if err := checkConflicts(chain, *strictConflicts); err != nil {
+		return err
+	}
+	handler := &chainServer{gen: &generator.Generator{Strategy: gen, BlockedWords: blocked}, strictConflicts: *strictConflicts}
+	handler.swap(chain)
+	defer func() {
+		handler.chain().Stop()
+	}()
 
-	// Create a default request multiplexer as the last fallback
-	mux := defaultMux()
+	// Publish the counters of the clicks of the current chain, on the
+	// debug endpoint of the admin server
+	if expvar.Get("clicks") == nil {
+		expvar.Publish("clicks", expvar.Func(func() interface{} {
+			if clicks := handler.chain().Clicks; clicks != nil {
+				return clicks.Stats()
+			}
+			return nil
+		}))
+	}
 
-	// Build the MapHandler using the mux as the fallback
-	mapHandler := createMapHandler(mux)
+	// Reload the config file (or only the files of the chain) on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			if *chainFlags.config == "" {
+				handler.chain().Reload()
+				continue
+			}
+			if err := handler.reload(builder, *chainFlags.config); err != nil {
+				log.Printf("urlshort: config reload failed, serving the previous version: %v", err)
+			}
+		}
+	}()
 
-	// Build the YAMLHandler using the previous handler as the fallback
-	yamlHandler := createYAMLHandler(*yamlFilename, mapHandler)
+	// Serve the redirects and the admin endpoints on separate listeners,
+	// until SIGINT or SIGTERM (or until one of them fails), then drain
+	// the active requests, before the Databases are closed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	metrics := server.NewMetrics()
+	public := server.New(settings, metrics.Handler(handler))
+	admin := server.New(adminSettings, handler.admin(metrics))
+	publicListeners, err := public.Listen()
+	if err != nil {
+		return err
+	}
+	adminListeners, err := admin.Listen()
+	if err != nil {
+		for _, l := range publicListeners {
+			l.Close()
+		}
+		return fmt.Errorf("admin: %w", err)
+	}
+	for _, l := range publicListeners {
+		fmt.Fprintln(stdout, "Starting the server on", l.Addr().Network(), l.Addr())
+	}
+	for _, l := range adminListeners {
+		fmt.Fprintln(stdout, "Starting the admin server on", l.Addr().Network(), l.Addr())
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errc := make(chan error, 2)
+	go func() {
+		errc <- public.Serve(ctx, publicListeners...)
+	}()
+	go func() {
+		if err := admin.Serve(ctx, adminListeners...); err != nil {
+			errc <- fmt.Errorf("admin: %w", err)
+			return
+		}
+		errc <- nil
+	}()
+	err = <-errc
+	cancel()
+	if adminErr := <-errc; err == nil {
+		err = adminErr
+	}
+	return err
+}
 
-	// Build the JSONHandler using the previous handler as the fallback
-	jsonHandler := createJSONHandler(*jsonFilename, yamlHandler)
+// chainFlags are the flags of the chain of handlers
+type chainFlags struct {
+	config   *string
+	db       *string
+	sources  sourceFlag
+	strict   *bool
+	reload   *time.Duration
+	notFound *string
+}
 
-	// Build the DBHandler using the previous handler as the fallback
-	dbHandler := createDBHandler(db, jsonHandler)
+// addChainFlags defines the flags of the chain of handlers
+func addChainFlags(flags *flag.FlagSet) *chainFlags {
+	f := &chainFlags{}
+	f.config = flags.String("config", "", "Config file with the sources of the links and the fallback, reloaded on SIGHUP,\n"+
+		"instead of the -db, -source, -strict, -reload and -not-found flags")
+	flags.Var(&f.sources, "source", "File with URLs and their short paths, optionally prefixed by its format (e.g. csv:links.txt),\n"+
+		"can be repeated, the first file wins (default urls.json and urls.yaml)")
+	f.db = dbFlag(flags)
+	f.strict = flags.Bool("strict", false, "Refuse files with any problem, see the validate command")
+	f.reload = flags.Duration("reload", 5*time.Second, "Interval for reloading the changed files, 0 to reload only on SIGHUP")
+	f.notFound = flags.String("not-found", "", "Page for the paths that no source has, served with the 404 status")
+	return f
+}
 
-	// Start server
-	fmt.Println("Starting the server on :8080")
-	http.ListenAndServe(":8080", dbHandler)
+// load returns the config of the chain of handlers, from the config file,
+// or else from the flags: the Database, the files and the Map Hundler,
+// in this order, and the not-found page
+func (f *chainFlags) load() (*config.Config, error) {
+	if *f.config != "" {
+		return config.Load(*f.config)
+	}
+	sources := f.sources
+	if len(sources) == 0 {
+		sources = sourceFlag{"urls.json", "urls.yaml"}
+	}
+	cfg := &config.Config{
+		Sources:  []config.Source{{Type: config.SourceBolt, Location: *f.db}},
+		Fallback: config.Fallback{Type: config.FallbackNotFound, Location: *f.notFound},
+	}
+	for _, source := range sources {
+		name, format := splitSource(source)
+		cfg.Sources = append(cfg.Sources, config.Source{
+			Type:     config.SourceFile,
+			Location: name,
+			Format:   format,
+			Options:  config.Options{Strict: *f.strict, Reload: *f.reload},
+		})
+	}
+	cfg.Sources = append(cfg.Sources, config.Source{
+		Type:     config.SourceMap,
+		Location: "main.go",
+		Options:  config.Options{Paths: pathsToUrls},
+	})
+	return cfg, nil
 }
 
-// defaultMux is a default request multiplexer for all paths
-func defaultMux() *http.ServeMux {
+// chainServer serves the redirects of the current chain of handlers, and
+// its API and UI on the admin server, which are swapped when the config
+// is reloaded
+type chainServer struct {
+	gen             *generator.Generator
+	strictConflicts bool
+	mu              sync.Mutex // serializes the reloads
+	current         atomic.Value
+}
+
+// chainMux is the chain of handlers, with the mux of its API and UI
+type chainMux struct {
+	*http.ServeMux
+	chain *config.Chain
+}
+
+// ServeHTTP serves only the redirects, and the fallback, of the chain
+func (s *chainServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.chain().ServeHTTP(w, r)
+}
+
+// admin returns the handler of the admin server: the API, the UI and
+// the endpoints of the current chain of handlers, the metrics of the
+// server, and the debug endpoints of pprof and expvar
+func (s *chainServer) admin(metrics http.Handler) http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", hello)
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		s.current.Load().(chainMux).ServeHTTP(w, r)
+	})
 	return mux
 }
 
-// hello is a function handler for all paths
-func hello(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "Hello, world!")
+// chain returns the current chain of handlers
+func (s *chainServer) chain() *config.Chain {
+	return s.current.Load().(chainMux).chain
 }
 
-// createMapHandler creates and returns a Map Hundler
-func createMapHandler(fallback http.Handler) http.HandlerFunc {
-	pathsToUrls := map[string]string{
-		"/urlshort-godoc": "https://godoc.org/github.com/gophercises/urlshort",
-		"/yaml-godoc":     "https://godoc.org/gopkg.in/yaml.v2",
+// swap serves the chain of handlers, and returns the previous one, if any
+func (s *chainServer) swap(chain *config.Chain) *config.Chain {
+	mux := http.NewServeMux()
+	if chain.Database != nil {
+		apiHandler := api.New(chain.Database, s.gen)
+		mux.Handle(api.Prefix, apiHandler)
+		mux.Handle(api.Prefix+"/", apiHandler)
+		clicksHandler := api.NewClicks(chain.Database)
+		mux.Handle(api.ClicksPrefix, clicksHandler)
+		mux.Handle(api.ClicksPrefix+"/", clicksHandler)
 	}
-	mapHandler := urlshort.MapHandler(pathsToUrls, fallback)
-	return mapHandler
+	mux.Handle(ui.Prefix, ui.New(chain.Sources...))
+	mux.Handle("/api/status", statusHandler(chain.Files...))
+	mux.Handle("/api/explain", explainHandler(chain))
+	previous, _ := s.current.Load().(chainMux)
+	s.current.Store(chainMux{mux, chain})
+	return previous.chain
 }
 
-// createYAMLHandler reads the YAML file, creates and returns a YAML Hundler
-func createYAMLHandler(name string, fallback http.Handler) http.HandlerFunc {
-	yamlFile, err := os.ReadFile(name)
+// reload builds the chain of handlers of the config file, serves it,
+// and stops the previous one
+func (s *chainServer) reload(builder *config.Builder, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cfg, err := config.Load(name)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	yamlHandler, err := urlshort.YAMLHandler([]byte(yamlFile), fallback)
+	chain, err := builder.Build(cfg)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if err := checkConflicts(chain, s.strictConflicts); err != nil {
+		chain.Stop()
+		return err
 	}
-	return yamlHandler
+	if previous := s.swap(chain); previous != nil {
+		previous.Stop()
+	}
+	log.Printf("urlshort: reloaded %s", name)
+	return nil
 }
 
-// createJSONHandler reads the JSON file, creates and returns a JSON Hundler
-func createJSONHandler(name string, fallback http.Handler) http.HandlerFunc {
-	jsonFile, err := os.ReadFile(name)
-	if err != nil {
-		log.Fatal(err)
+// pathsToUrls are the paths of the Map Hundler
+var pathsToUrls = map[string]string{
+	"/urlshort-godoc": "https://godoc.org/github.com/gophercises/urlshort",
+	"/yaml-godoc":     "https://godoc.org/gopkg.in/yaml.v2",
+}
+
+// sourceFlag is the list of the files of the -source flags
+type sourceFlag []string
+
+func (s *sourceFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *sourceFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// splitSource splits the format prefix off a source, if it has one
+func splitSource(source string) (name string, format string) {
+	if i := strings.Index(source, ":"); i > 0 {
+		for _, f := range urlshort.Formats {
+			if source[:i] == f {
+				return source[i+1:], f
+			}
+		}
+	}
+	return source, ""
+}
+
+// statusHandler returns the state of the files of the handlers as JSON
+func statusHandler(files ...*urlshort.FileHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := make([]urlshort.FileStatus, 0, len(files))
+		for _, f := range files {
+			status = append(status, f.Status())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
 	}
-	jsonHandler, err := urlshort.JSONHandler([]byte(jsonFile), fallback)
+}
+
+// checkConflicts logs the paths defined in more than one source of the
+// chain of handlers, and fails if there are any in strict mode
+func checkConflicts(chain *config.Chain, strict bool) error {
+	conflicts, err := chain.Conflicts(context.Background())
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	for _, c := range conflicts {
+		log.Printf("urlshort: %v", c)
+	}
+	if strict && len(conflicts) > 0 {
+		return fmt.Errorf("%d conflicts found", len(conflicts))
 	}
-	return jsonHandler
+	return nil
 }
 
-// createDBHandler reads the Database, creates and returns a DB Hundler
-func createDBHandler(db *database.Database, fallback http.Handler) http.HandlerFunc {
-	// Add some entries to the Database
+// explainHandler returns how the chain of handlers resolves the url
+// query parameter (e.g. /gh?tab=repositories, or with a host,
+// go.example.com/gh), as JSON, without redirecting it
+func explainHandler(chain *config.Chain) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		target := r.URL.Query().Get("url")
+		if target == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "url is missing"})
+			return
+		}
+		req, err := explainRequest(target, r.URL.Query().Get("host"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(chain.Explain(req.WithContext(r.Context())))
+	}
+}
+
+// seedDB adds some entries to the Database, if there is one, keeping
+// the keys that already exist, e.g. edited with the admin API
+func seedDB(db *database.Database) error {
+	if db == nil {
+		return nil
+	}
 	pathsToUrls := map[string]string{
 		"/gnu/health":   "https://savannah.gnu.org/projects/health",
 		"/gnu/avr-libc": "https://savannah.nongnu.org/projects/avr-libc",
@@ -104,14 +419,11 @@ func createDBHandler(db *database.Database, fallback http.Handler) http.HandlerF
 		"/gnu/ddd":      "https://savannah.gnu.org/projects/ddd",
 		"/gnu/epsilon":  "https://savannah.gnu.org/projects/epsilon",
 	}
-	err := database.PutMapEntriesDB(db, pathsToUrls)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	dbHandler, err := urlshort.DBHandler(db, fallback)
-	if err != nil {
-		log.Fatal(err)
+	for key, dest := range pathsToUrls {
+		err := database.InsertRecordDB(db, key, database.Record{Url: dest})
+		if err != nil && !errors.Is(err, database.ErrExists) {
+			return err
+		}
 	}
-	return dbHandler
+	return nil
 }
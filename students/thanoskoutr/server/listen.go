@@ -0,0 +1,231 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Networks of the listeners, the prefixes of the Listen settings.
+const (
+	// NetworkTCP listens on a TCP address, the default, e.g. :8080.
+	NetworkTCP = "tcp"
+	// NetworkTLS listens on a TCP address with TLS, and HTTP/2, e.g.
+	// tls::8443, with the certificate of TLSCert and TLSKey.
+	NetworkTLS = "tls"
+	// NetworkUnix listens on a Unix domain socket, e.g.
+	// unix:/run/urlshort.sock.
+	NetworkUnix = "unix"
+	// NetworkSystemd uses the sockets passed by systemd, all of them
+	// (systemd:) or the ones with the FileDescriptorName (systemd:http).
+	NetworkSystemd = "systemd"
+)
+
+// parseListen will split a Listen setting to its network and address.
+func parseListen(spec string) (network string, addr string) {
+	for _, n := range []string{NetworkTCP, NetworkTLS, NetworkUnix, NetworkSystemd} {
+		if spec == n || strings.HasPrefix(spec, n+":") {
+			return n, strings.TrimPrefix(spec[len(n):], ":")
+		}
+	}
+	return NetworkTCP, spec
+}
+
+// Listen will listen on the Listen settings, or else on Addr.
+//
+// The sockets passed by systemd are used only once, so they cannot be
+// listened on again.
+func (s *Server) Listen() ([]net.Listener, error) {
+	specs := s.settings.Listen
+	if len(specs) == 0 {
+		specs = []string{s.settings.Addr}
+	}
+	var listeners []net.Listener
+	for _, spec := range specs {
+		ls, err := s.listen(spec)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("listen %s: %w", spec, err)
+		}
+		listeners = append(listeners, ls...)
+	}
+	return listeners, nil
+}
+
+// listen will listen on a Listen setting.
+func (s *Server) listen(spec string) ([]net.Listener, error) {
+	network, addr := parseListen(spec)
+	switch network {
+	case NetworkTLS:
+		config, err := s.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{tls.NewListener(l, config)}, nil
+	case NetworkUnix:
+		l, err := listenUnix(addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	case NetworkSystemd:
+		return systemdListeners(addr)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
+
+// tlsConfig will return the TLS config of the tls listeners, loading
+// their certificate the first time.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tls != nil {
+		return s.tls, nil
+	}
+	if s.settings.TLSCert == "" || s.settings.TLSKey == "" {
+		return nil, errors.New("the certificate and key files are not set")
+	}
+	cert, err := loadCertificate(s.settings.TLSCert, s.settings.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	s.tls = &tls.Config{
+		GetCertificate: cert.get,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	return s.tls, nil
+}
+
+// certCheckInterval is how often the files of a certificate are checked
+// for changes.
+var certCheckInterval = time.Second
+
+// certificate is a TLS certificate, reloaded when its files change.
+type certificate struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // of the files that were loaded, or failed to
+	checked time.Time
+}
+
+// loadCertificate will load the certificate of the files.
+func loadCertificate(certFile string, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// get will return the certificate, for tls.Config.GetCertificate.
+//
+// If its files changed since the last check, they are loaded again. If
+// they cannot be loaded (e.g. while only one of them is replaced), the
+// previous certificate is kept, until they change again.
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); now.Sub(c.checked) >= certCheckInterval {
+		c.checked = now
+		if err := c.reload(); err != nil {
+			log.Printf("server: reload certificate failed, serving the previous one: %v", err)
+		}
+	}
+	return c.cert, nil
+}
+
+// reload will load the files, if they changed. It must be called with
+// the mutex held.
+func (c *certificate) reload() error {
+	var modTime time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if modTime.Equal(c.modTime) {
+		return nil
+	}
+	c.modTime = modTime
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	return nil
+}
+
+// listenUnix will listen on a Unix domain socket, replacing the socket
+// file of a previous run.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// listenFdsStart is the first file descriptor of the sockets passed by
+// systemd.
+var listenFdsStart = 3
+
+// systemdListeners will return the listeners of the sockets passed by
+// systemd, with the name, or all of them if the name is empty, see
+// sd_listen_fds(3).
+func systemdListeners(name string) ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("LISTEN_FDS: %v", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		if name != "" && (i >= len(names) || names[i] != name) {
+			continue
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), "LISTEN_FD_"+strconv.Itoa(listenFdsStart+i))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+	}
+	return listeners, nil
+}
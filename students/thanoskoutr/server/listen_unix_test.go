@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The passed socket is owned by systemdListeners
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(start int) { listenFdsStart = start }(listenFdsStart)
+	listenFdsStart = fd
+
+	if _, err := systemdListeners(""); err == nil {
+		t.Error("expected an error without LISTEN_PID")
+	}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "http")
+	if _, err := systemdListeners("admin"); err == nil {
+		t.Error("expected an error for a missing name")
+	}
+	listeners := serve(t, Settings{Listen: []string{"systemd:http"}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "systemd")
+	}))
+	resp, err := http.Get("http://" + listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if data, _ := io.ReadAll(resp.Body); string(data) != "systemd" {
+		t.Errorf("wrong response: %q", data)
+	}
+}
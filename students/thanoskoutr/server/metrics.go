@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics counts the requests of a handler, and serves the counts in the
+// Prometheus text format, e.g.
+//
+//     urlshort_http_requests_total{code="302"} 1027
+//     urlshort_http_requests_in_flight 2
+//     urlshort_http_request_duration_seconds_sum 0.51
+//     urlshort_http_request_duration_seconds_count 1054
+type Metrics struct {
+	inFlight int64 // atomic
+
+	mu       sync.Mutex
+	codes    map[int]uint64
+	duration time.Duration
+	count    uint64
+}
+
+// NewMetrics will return Metrics without any requests.
+func NewMetrics() *Metrics {
+	return &Metrics{codes: make(map[int]uint64)}
+}
+
+// Handler will return the handler, counting its requests.
+func (m *Metrics) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&m.inFlight, 1)
+		defer atomic.AddInt64(&m.inFlight, -1)
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(sw, r)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.codes[sw.code]++
+		m.duration += time.Since(start)
+		m.count++
+	})
+}
+
+// ServeHTTP will serve the counts.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	counts := make(map[int]uint64, len(m.codes))
+	codes := make([]int, 0, len(m.codes))
+	for code, n := range m.codes {
+		counts[code] = n
+		codes = append(codes, code)
+	}
+	duration, count := m.duration, m.count
+	m.mu.Unlock()
+	sort.Ints(codes)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP urlshort_http_requests_total Requests by status code.")
+	fmt.Fprintln(w, "# TYPE urlshort_http_requests_total counter")
+	for _, code := range codes {
+		fmt.Fprintf(w, "urlshort_http_requests_total{code=\"%d\"} %d\n", code, counts[code])
+	}
+	fmt.Fprintln(w, "# HELP urlshort_http_request_duration_seconds Duration of the requests.")
+	fmt.Fprintln(w, "# TYPE urlshort_http_request_duration_seconds summary")
+	fmt.Fprintf(w, "urlshort_http_request_duration_seconds_sum %g\n", duration.Seconds())
+	fmt.Fprintf(w, "urlshort_http_request_duration_seconds_count %d\n", count)
+	fmt.Fprintln(w, "# HELP urlshort_http_requests_in_flight Requests being served.")
+	fmt.Fprintln(w, "# TYPE urlshort_http_requests_in_flight gauge")
+	fmt.Fprintf(w, "urlshort_http_requests_in_flight %d\n", atomic.LoadInt64(&m.inFlight))
+}
+
+// statusWriter is a ResponseWriter that keeps the status code.
+type statusWriter struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.code = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush will flush the response, if the ResponseWriter supports it, e.g.
+// for a proxy fallback.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,335 @@
+// Package server wraps http.Server with the settings of the urlshort
+// server, a graceful shutdown, and listeners on TCP addresses (with or
+// without TLS), Unix domain sockets and the sockets passed by systemd.
+//
+// The settings are read, from the lowest to the highest precedence,
+// from the Defaults, the server section of the config file, the
+// environment variables (see Env) and the flags (see Flags).
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings are the settings of a Server.
+//
+// A zero value is not set, so it keeps the value of a lower precedence,
+// see Merge. A negative timeout disables the timeout.
+type Settings struct {
+	// Addr is the TCP address to listen on, e.g. :8080, if Listen is
+	// not set.
+	Addr string `yaml:"addr"`
+	// Listen are the addresses to listen on, all at once, each one
+	// prefixed by its network, e.g. tls::8443 or unix:/run/urlshort.sock,
+	// or a TCP address, see NetworkTCP.
+	Listen []string `yaml:"listen"`
+	// TLSCert and TLSKey are the certificate and key files of the tls
+	// listeners, which are reloaded when they change.
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+	// ReadTimeout is the maximum duration for reading a request.
+	ReadTimeout time.Duration `yaml:"read_timeout"`
+	// ReadHeaderTimeout is the maximum duration for reading the
+	// headers of a request.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// WriteTimeout is the maximum duration for writing a response.
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// IdleTimeout is the maximum duration to wait for the next request
+	// of a keep-alive connection.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// MaxHeaderBytes is the maximum size of the headers of a request.
+	MaxHeaderBytes int `yaml:"max_header_bytes"`
+	// ShutdownTimeout is the maximum duration to wait for the active
+	// requests to finish on shutdown.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// Defaults are the default Settings.
+var Defaults = Settings{
+	Addr:              ":8080",
+	ReadTimeout:       10 * time.Second,
+	ReadHeaderTimeout: 5 * time.Second,
+	WriteTimeout:      10 * time.Second,
+	IdleTimeout:       2 * time.Minute,
+	MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+	ShutdownTimeout:   30 * time.Second,
+}
+
+// Merge will return the settings, overridden by the settings that are
+// set in the other Settings.
+func (s Settings) Merge(other Settings) Settings {
+	if other.Addr != "" {
+		s.Addr = other.Addr
+	}
+	if len(other.Listen) > 0 {
+		s.Listen = other.Listen
+	}
+	if other.TLSCert != "" {
+		s.TLSCert = other.TLSCert
+	}
+	if other.TLSKey != "" {
+		s.TLSKey = other.TLSKey
+	}
+	if other.ReadTimeout != 0 {
+		s.ReadTimeout = other.ReadTimeout
+	}
+	if other.ReadHeaderTimeout != 0 {
+		s.ReadHeaderTimeout = other.ReadHeaderTimeout
+	}
+	if other.WriteTimeout != 0 {
+		s.WriteTimeout = other.WriteTimeout
+	}
+	if other.IdleTimeout != 0 {
+		s.IdleTimeout = other.IdleTimeout
+	}
+	if other.MaxHeaderBytes != 0 {
+		s.MaxHeaderBytes = other.MaxHeaderBytes
+	}
+	if other.ShutdownTimeout != 0 {
+		s.ShutdownTimeout = other.ShutdownTimeout
+	}
+	return s
+}
+
+// setting is a timeout setting, with the name of its flag.
+type setting struct {
+	flag     string
+	usage    string
+	duration func(s *Settings) *time.Duration
+}
+
+// durations are the timeouts of the Settings.
+var durations = []setting{
+	{"read-timeout", "Maximum duration for reading a request",
+		func(s *Settings) *time.Duration { return &s.ReadTimeout }},
+	{"read-header-timeout", "Maximum duration for reading the headers of a request",
+		func(s *Settings) *time.Duration { return &s.ReadHeaderTimeout }},
+	{"write-timeout", "Maximum duration for writing a response",
+		func(s *Settings) *time.Duration { return &s.WriteTimeout }},
+	{"idle-timeout", "Maximum duration to wait for the next request of a keep-alive connection",
+		func(s *Settings) *time.Duration { return &s.IdleTimeout }},
+	{"shutdown-timeout", "Maximum duration to wait for the active requests on shutdown",
+		func(s *Settings) *time.Duration { return &s.ShutdownTimeout }},
+}
+
+// envName will return the environment variable of a flag, e.g.
+// URLSHORT_ADMIN_READ_TIMEOUT for admin-read-timeout.
+func envName(flag string) string {
+	return "URLSHORT_" + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// Env will return the settings of the environment variables that are
+// set: URLSHORT_ADDR, URLSHORT_LISTEN (separated by commas),
+// URLSHORT_TLS_CERT, URLSHORT_TLS_KEY, URLSHORT_MAX_HEADER_BYTES, and the
+// timeouts, e.g. URLSHORT_READ_TIMEOUT=5s, named like their flags.
+func Env(lookup func(key string) (string, bool)) (Settings, error) {
+	return PrefixEnv(lookup, "")
+}
+
+// PrefixEnv will return the settings of the environment variables of
+// the flags with the prefix, see PrefixFlags, e.g. URLSHORT_ADMIN_LISTEN.
+func PrefixEnv(lookup func(key string) (string, bool), prefix string) (Settings, error) {
+	var s Settings
+	if v, ok := lookup(envName(prefix + "addr")); ok {
+		s.Addr = v
+	}
+	if v, ok := lookup(envName(prefix + "listen")); ok && v != "" {
+		s.Listen = strings.Split(v, ",")
+	}
+	if v, ok := lookup(envName(prefix + "tls-cert")); ok {
+		s.TLSCert = v
+	}
+	if v, ok := lookup(envName(prefix + "tls-key")); ok {
+		s.TLSKey = v
+	}
+	maxHeaderBytes := envName(prefix + "max-header-bytes")
+	if v, ok := lookup(maxHeaderBytes); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return s, fmt.Errorf("%s: %v", maxHeaderBytes, err)
+		}
+		s.MaxHeaderBytes = n
+	}
+	for _, d := range durations {
+		name := envName(prefix + d.flag)
+		v, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		dur, err := time.ParseDuration(v)
+		if err != nil {
+			return s, fmt.Errorf("%s: %v", name, err)
+		}
+		*d.duration(&s) = dur
+	}
+	return s, nil
+}
+
+// Flags will define the flags of the settings, and return a function
+// that returns the settings of the flags that are set, after the flags
+// are parsed.
+func Flags(flags *flag.FlagSet) func() Settings {
+	return PrefixFlags(flags, "", Defaults)
+}
+
+// PrefixFlags will define the flags of the settings with the prefix,
+// e.g. admin-listen for the prefix admin-, showing the defaults, see
+// Flags.
+func PrefixFlags(flags *flag.FlagSet, prefix string, defaults Settings) func() Settings {
+	var values Settings
+	var listen listFlag
+	usage := func(flag string, usage string) string {
+		return usage + " (env " + envName(prefix+flag) + ")"
+	}
+	flags.StringVar(&values.Addr, prefix+"addr", defaults.Addr,
+		usage("addr", "TCP address to listen on, without -"+prefix+"listen"))
+	flags.Var(&listen, prefix+"listen", usage("listen", "Address to listen on, prefixed by its network: tcp (default), tls, unix or systemd,\n"+
+		"e.g. tls::8443 or unix:/run/urlshort.sock, can be repeated"))
+	flags.StringVar(&values.TLSCert, prefix+"tls-cert", defaults.TLSCert,
+		usage("tls-cert", "Certificate file of the tls listeners, reloaded when it changes"))
+	flags.StringVar(&values.TLSKey, prefix+"tls-key", defaults.TLSKey,
+		usage("tls-key", "Key file of the tls listeners, reloaded when it changes"))
+	flags.IntVar(&values.MaxHeaderBytes, prefix+"max-header-bytes", defaults.MaxHeaderBytes,
+		usage("max-header-bytes", "Maximum size of the headers of a request"))
+	for _, d := range durations {
+		flags.DurationVar(d.duration(&values), prefix+d.flag, *d.duration(&defaults), usage(d.flag, d.usage))
+	}
+	return func() Settings {
+		var s Settings
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case prefix + "addr":
+				s.Addr = values.Addr
+			case prefix + "listen":
+				s.Listen = listen
+			case prefix + "tls-cert":
+				s.TLSCert = values.TLSCert
+			case prefix + "tls-key":
+				s.TLSKey = values.TLSKey
+			case prefix + "max-header-bytes":
+				s.MaxHeaderBytes = values.MaxHeaderBytes
+			}
+			for _, d := range durations {
+				if f.Name == prefix+d.flag {
+					*d.duration(&s) = *d.duration(&values)
+				}
+			}
+		})
+		return s
+	}
+}
+
+// listFlag is a flag that can be repeated.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Server is an http.Server that shuts down gracefully.
+type Server struct {
+	settings Settings
+	srv      *http.Server
+
+	mu  sync.Mutex
+	tls *tls.Config // of the tls listeners, created by the first one
+}
+
+// New will return a Server for the handler, with the settings, where
+// the settings that are not set have their Defaults.
+func New(settings Settings, handler http.Handler) *Server {
+	settings = Defaults.Merge(settings)
+	return &Server{
+		settings: settings,
+		srv: &http.Server{
+			Addr:              settings.Addr,
+			Handler:           handler,
+			ReadTimeout:       timeout(settings.ReadTimeout),
+			ReadHeaderTimeout: timeout(settings.ReadHeaderTimeout),
+			WriteTimeout:      timeout(settings.WriteTimeout),
+			IdleTimeout:       timeout(settings.IdleTimeout),
+			MaxHeaderBytes:    settings.MaxHeaderBytes,
+		},
+	}
+}
+
+// timeout will return the timeout of http.Server for a setting, where 0
+// is no timeout.
+func timeout(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// Serve will serve the connections of the listeners until the context
+// is done, and then shut down gracefully: it stops accepting connections
+// and waits for the active requests to finish, for at most the shutdown
+// timeout, before closing their connections.
+//
+// If a listener fails, the server shuts down too. It returns nil after
+// a graceful shutdown, or else the error that stopped it.
+func (s *Server) Serve(ctx context.Context, listeners ...net.Listener) error {
+	if len(listeners) == 0 {
+		return errors.New("no listeners")
+	}
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errc <- s.srv.Serve(l)
+		}(l)
+	}
+	var serveErr error
+	pending := len(listeners)
+	select {
+	case serveErr = <-errc:
+		pending--
+		log.Printf("server: %v, shutting down", serveErr)
+	case <-ctx.Done():
+		log.Printf("server: shutting down, waiting up to %v for the active requests", s.settings.ShutdownTimeout)
+	}
+	shutdownCtx := context.Background()
+	if d := s.settings.ShutdownTimeout; d > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(shutdownCtx, d)
+		defer cancel()
+	}
+	if err := s.srv.Shutdown(shutdownCtx); err != nil {
+		s.srv.Close()
+		if serveErr == nil {
+			serveErr = fmt.Errorf("shutdown: %w", err)
+		}
+	}
+	for ; pending > 0; pending-- {
+		if err := <-errc; serveErr == nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErr = err
+		}
+	}
+	return serveErr
+}
+
+// ListenAndServe will listen on the addresses of the settings, and serve
+// the connections until the context is done, see Serve.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	listeners, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, listeners...)
+}
@@ -0,0 +1,357 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSettings(t *testing.T) {
+	file := Settings{Addr: ":9000", ReadTimeout: time.Second, WriteTimeout: 2 * time.Second}
+	vars := map[string]string{
+		"URLSHORT_ADDR":          ":9001",
+		"URLSHORT_WRITE_TIMEOUT": "3s",
+		"URLSHORT_IDLE_TIMEOUT":  "-1s",
+	}
+	env, err := Env(func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flagSettings := Flags(flags)
+	if err := flags.Parse([]string{"-addr", ":9002", "-max-header-bytes", "4096"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The flags override the environment, which overrides the file
+	got := Defaults.Merge(file).Merge(env).Merge(flagSettings())
+	expected := Settings{
+		Addr:              ":9002",
+		ReadTimeout:       time.Second,
+		ReadHeaderTimeout: Defaults.ReadHeaderTimeout,
+		WriteTimeout:      3 * time.Second,
+		IdleTimeout:       -time.Second,
+		MaxHeaderBytes:    4096,
+		ShutdownTimeout:   Defaults.ShutdownTimeout,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("wrong settings:\ngot  %+v\nwant %+v", got, expected)
+	}
+	if s := New(got, http.NotFoundHandler()); s.srv.IdleTimeout != 0 || s.srv.WriteTimeout != 3*time.Second {
+		t.Errorf("wrong server timeouts: %+v", s.srv)
+	}
+
+	// The settings of the admin server have their own flags and
+	// environment variables
+	admin, err := PrefixEnv(func(key string) (string, bool) {
+		return "127.0.0.1:9003,unix:admin.sock", key == "URLSHORT_ADMIN_LISTEN"
+	}, "admin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags = flag.NewFlagSet("test", flag.ContinueOnError)
+	Flags(flags)
+	adminFlags := PrefixFlags(flags, "admin-", Settings{Addr: "127.0.0.1:8081"})
+	if err := flags.Parse([]string{"-addr", ":9002", "-admin-write-timeout", "1m"}); err != nil {
+		t.Fatal(err)
+	}
+	expected = Settings{Listen: []string{"127.0.0.1:9003", "unix:admin.sock"}, WriteTimeout: time.Minute}
+	if got := admin.Merge(adminFlags()); !reflect.DeepEqual(got, expected) {
+		t.Errorf("wrong admin settings:\ngot  %+v\nwant %+v", got, expected)
+	}
+
+	for key, value := range map[string]string{"URLSHORT_READ_TIMEOUT": "5", "URLSHORT_MAX_HEADER_BYTES": "1k"} {
+		_, err := Env(func(k string) (string, bool) {
+			return value, k == key
+		})
+		if err == nil {
+			t.Errorf("expected an error for %s=%s", key, value)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := New(Settings{Addr: "127.0.0.1:0"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	}))
+	listeners, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := listeners[0]
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, l)
+	}()
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+
+	// The active request finishes before Serve returns
+	<-started
+	cancel()
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned before the active request finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if got := <-body; got != "done" {
+		t.Errorf("wrong response: %q", got)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+	if _, err := http.Get("http://" + l.Addr().String()); err == nil {
+		t.Error("the server accepts requests after the shutdown")
+	}
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	s := New(Settings{Addr: "127.0.0.1:0", ShutdownTimeout: 20 * time.Millisecond}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	listeners, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := listeners[0]
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, l)
+	}()
+	go http.Get("http://" + l.Addr().String())
+	<-started
+	cancel()
+	if err := <-served; err == nil {
+		t.Error("expected an error for a request active after the shutdown timeout")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	h := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gh" {
+			http.Redirect(w, r, "https://github.com", http.StatusFound)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	for _, path := range []string{"/gh", "/gh", "/missing"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`urlshort_http_requests_total{code="302"} 2`,
+		`urlshort_http_requests_total{code="404"} 1`,
+		`urlshort_http_request_duration_seconds_count 3`,
+		`urlshort_http_requests_in_flight 0`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, w.Body)
+		}
+	}
+}
+
+func TestParseListen(t *testing.T) {
+	for spec, expected := range map[string][2]string{
+		":8080":                   {NetworkTCP, ":8080"},
+		"localhost:8080":          {NetworkTCP, "localhost:8080"},
+		"tcp::8080":               {NetworkTCP, ":8080"},
+		"tls::8443":               {NetworkTLS, ":8443"},
+		"unix:/run/urlshort.sock": {NetworkUnix, "/run/urlshort.sock"},
+		"systemd":                 {NetworkSystemd, ""},
+		"systemd:http":            {NetworkSystemd, "http"},
+	} {
+		network, addr := parseListen(spec)
+		if network != expected[0] || addr != expected[1] {
+			t.Errorf("%s: got %s %q, want %s %q", spec, network, addr, expected[0], expected[1])
+		}
+	}
+}
+
+// writeCertificate will write a self-signed certificate and its key for
+// 127.0.0.1, with the serial number, to the files.
+func writeCertificate(t *testing.T, certFile string, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve will serve the listeners of the settings, until the test ends.
+func serve(t *testing.T, settings Settings, handler http.Handler) []net.Listener {
+	t.Helper()
+	s := New(settings, handler)
+	listeners, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, listeners...)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Errorf("Serve returned %v", err)
+		}
+	})
+	return listeners
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, 1)
+	defer func(interval time.Duration) { certCheckInterval = interval }(certCheckInterval)
+	certCheckInterval = 0
+
+	// A tls and a tcp listener at once
+	listeners := serve(t, Settings{
+		Listen:  []string{"tls:127.0.0.1:0", "127.0.0.1:0"},
+		TLSCert: certFile,
+		TLSKey:  keyFile,
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	if len(listeners) != 2 {
+		t.Fatalf("got %d listeners, want 2", len(listeners))
+	}
+
+	get := func(url string) (string, *big.Int) {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		defer client.CloseIdleConnections()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		var serial *big.Int
+		if resp.TLS != nil {
+			serial = resp.TLS.PeerCertificates[0].SerialNumber
+		}
+		return string(data), serial
+	}
+	proto, serial := get("https://" + listeners[0].Addr().String())
+	if proto != "HTTP/2.0" || serial.Int64() != 1 {
+		t.Errorf("got %s with certificate %v, want HTTP/2.0 with 1", proto, serial)
+	}
+	if proto, _ := get("http://" + listeners[1].Addr().String()); proto != "HTTP/1.1" {
+		t.Errorf("got %s, want HTTP/1.1", proto)
+	}
+
+	// A new certificate is served without a restart, and a bad one is
+	// ignored
+	writeCertificate(t, certFile, keyFile, 2)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if _, serial := get("https://" + listeners[0].Addr().String()); serial.Int64() != 2 {
+		t.Errorf("got certificate %v after the reload, want 2", serial)
+	}
+	if err := os.WriteFile(keyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	if _, serial := get("https://" + listeners[0].Addr().String()); serial.Int64() != 2 {
+		t.Errorf("got certificate %v after a bad reload, want 2", serial)
+	}
+
+	if _, err := New(Settings{Listen: []string{"tls:127.0.0.1:0"}}, http.NotFoundHandler()).Listen(); err == nil {
+		t.Error("expected an error for a tls listener without a certificate")
+	}
+}
+
+func TestServeUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urlshort.sock")
+	settings := Settings{Listen: []string{"unix:" + path}}
+	serve(t, settings, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "unix")
+	}))
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("http://urlshort/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if data, _ := io.ReadAll(resp.Body); string(data) != "unix" {
+		t.Errorf("wrong response: %q", data)
+	}
+
+	// The socket of a running server is not replaced
+	if _, err := New(settings, http.NotFoundHandler()).Listen(); err == nil {
+		t.Error("expected an error for a socket in use")
+	}
+}
@@ -0,0 +1,347 @@
+// Package ui implements a web UI for managing links, with plain HTML
+// forms that work without JavaScript.
+//
+// The UI lists the links of several sources (e.g. the Bolt Database and
+// the YAML and JSON files), in the order the redirects look them up, so
+// it shows which source serves each link and which links are shadowed
+// by another source. Links of sources that are not read-only can be
+// created, edited and deleted, with forms that carry the token of the
+// session, so other sites cannot submit them.
+package ui
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/urlshort"
+)
+
+// Prefix is the path the UI is served under.
+const Prefix = "/ui/"
+
+// csrfCookie is the cookie with the token of the session, that every
+// submitted form must have, see checkCSRF.
+const csrfCookie = "urlshort_csrf"
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+var templates = template.Must(template.ParseFS(templateFiles, "templates/*.html"))
+
+// UI is an http.Handler that serves the web UI under Prefix.
+type UI struct {
+	sources []urlshort.Source
+}
+
+// New will return a UI for the sources, in the order their links are
+// looked up, so a link of a source shadows the same link of the next ones.
+func New(sources ...urlshort.Source) *UI {
+	return &UI{sources: sources}
+}
+
+// link is a row of the list of links.
+type link struct {
+	Key      string
+	Record   database.Record
+	Source   int
+	Name     string
+	Kind     string
+	ReadOnly bool
+	Shadowed bool
+}
+
+// form is the data of the edit form.
+type form struct {
+	Key     string
+	Source  int
+	Record  database.Record
+	Tags    string
+	Error   string
+	Sources []urlshort.Source
+	CSRF    string
+}
+
+// ServeHTTP will route the request to the page of its path.
+func (u *UI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	page := strings.TrimPrefix(r.URL.Path, Prefix)
+	if page == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodPost && (!sameOrigin(r) || !checkCSRF(r)) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	var err error
+	switch {
+	case page == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		err = u.list(w, r)
+	case page == "edit" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		err = u.edit(w, r)
+	case page == "save" && r.Method == http.MethodPost:
+		err = u.save(w, r)
+	case page == "delete" && r.Method == http.MethodPost:
+		err = u.delete(w, r)
+	case page == "" || page == "edit" || page == "save" || page == "delete":
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("ui: %s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// list will show the links of all the sources that match the search.
+func (u *UI) list(w http.ResponseWriter, r *http.Request) error {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	var links []link
+	served := make(map[string]bool)
+	for i, src := range u.sources {
+		records, err := src.Store.List(r.Context())
+		if err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(records))
+		for key := range records {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			rec := records[key]
+			shadowed := served[key]
+			if !rec.Disabled {
+				served[key] = true
+			}
+			if !matches(key, rec, query) {
+				continue
+			}
+			links = append(links, link{
+				Key:      key,
+				Record:   rec,
+				Source:   i,
+				Name:     src.Name,
+				Kind:     src.Kind,
+				ReadOnly: src.ReadOnly,
+				Shadowed: shadowed,
+			})
+		}
+	}
+	sort.SliceStable(links, func(i, j int) bool {
+		return links[i].Key < links[j].Key
+	})
+	return render(w, http.StatusOK, "list.html", struct {
+		Query    string
+		Links    []link
+		Editable bool
+		CSRF     string
+	}{query, links, u.editable() >= 0, csrfToken(w, r)})
+}
+
+// matches reports whether the link contains the search words, in its
+// key, URL, description or tags.
+func matches(key string, rec database.Record, query string) bool {
+	text := strings.ToLower(strings.Join(append([]string{key, rec.Url, rec.Description}, rec.Tags...), " "))
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// edit will show the form for the link of the key, or for a new link.
+func (u *UI) edit(w http.ResponseWriter, r *http.Request) error {
+	f := form{Source: u.editable(), Sources: u.sources, CSRF: csrfToken(w, r)}
+	if key := r.URL.Query().Get("key"); key != "" {
+		src, err := u.source(r.URL.Query().Get("source"))
+		if err != nil {
+			return err
+		}
+		rec, err := u.sources[src].Store.Get(r.Context(), key)
+		if err != nil {
+			return err
+		}
+		f.Key, f.Source, f.Record = key, src, rec
+		f.Tags = strings.Join(rec.Tags, ", ")
+	}
+	if f.Source < 0 || u.sources[f.Source].ReadOnly {
+		http.Error(w, "source is read-only", http.StatusForbidden)
+		return nil
+	}
+	return render(w, http.StatusOK, "edit.html", f)
+}
+
+// save will create or change a link from the submitted form, and show
+// the form again with the error if the link is not valid.
+func (u *UI) save(w http.ResponseWriter, r *http.Request) error {
+	src, err := u.source(r.PostFormValue("source"))
+	if err != nil {
+		return err
+	}
+	if u.sources[src].ReadOnly {
+		http.Error(w, "source is read-only", http.StatusForbidden)
+		return nil
+	}
+	f := form{
+		Key:     r.PostFormValue("key"),
+		Source:  src,
+		Tags:    r.PostFormValue("tags"),
+		Sources: u.sources,
+		CSRF:    r.PostFormValue("csrf"),
+		Record: database.Record{
+			Host:        strings.TrimSpace(r.PostFormValue("host")),
+			Path:        strings.TrimSpace(r.PostFormValue("path")),
+			Url:         strings.TrimSpace(r.PostFormValue("url")),
+			Query:       r.PostFormValue("query"),
+			Description: strings.TrimSpace(r.PostFormValue("description")),
+			Disabled:    r.PostFormValue("enabled") == "",
+		},
+	}
+	for _, tag := range strings.Split(f.Tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			f.Record.Tags = append(f.Record.Tags, tag)
+		}
+	}
+	if status := r.PostFormValue("status"); status != "" {
+		f.Record.Status, err = strconv.Atoi(status)
+		if err != nil {
+			f.Error = "status must be a number"
+			return render(w, http.StatusUnprocessableEntity, "edit.html", f)
+		}
+	}
+	store := u.sources[src].Store
+	key := database.HostKey(f.Record.Host, f.Record.Path)
+	if err := urlshort.CheckRecord(key, f.Record); err != nil {
+		f.Error = err.Error()
+		return render(w, http.StatusUnprocessableEntity, "edit.html", f)
+	}
+	// Create, change or rename the link, in one step, so a new key does
+	// not replace another link, and a renamed link is never under both keys
+	switch {
+	case f.Key == "":
+		err = store.Insert(r.Context(), key, f.Record)
+	case key == f.Key:
+		err = store.Replace(r.Context(), key, f.Record)
+	default:
+		err = store.Rename(r.Context(), f.Key, key, f.Record)
+	}
+	if errors.Is(err, database.ErrExists) {
+		f.Error = "path " + key + " already exists"
+		return render(w, http.StatusUnprocessableEntity, "edit.html", f)
+	}
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, Prefix+"?q="+url.QueryEscape(key), http.StatusSeeOther)
+	return nil
+}
+
+// delete will remove the link of the submitted key.
+func (u *UI) delete(w http.ResponseWriter, r *http.Request) error {
+	src, err := u.source(r.PostFormValue("source"))
+	if err != nil {
+		return err
+	}
+	if u.sources[src].ReadOnly {
+		http.Error(w, "source is read-only", http.StatusForbidden)
+		return nil
+	}
+	if err := u.sources[src].Store.Delete(r.Context(), r.PostFormValue("key")); err != nil {
+		return err
+	}
+	http.Redirect(w, r, Prefix, http.StatusSeeOther)
+	return nil
+}
+
+// editable will return the index of the first source that is not
+// read-only, or -1.
+func (u *UI) editable() int {
+	for i, src := range u.sources {
+		if !src.ReadOnly {
+			return i
+		}
+	}
+	return -1
+}
+
+// source will return the index of the source of a form value.
+func (u *UI) source(value string) (int, error) {
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 || i >= len(u.sources) {
+		return 0, database.ErrNotFound
+	}
+	return i, nil
+}
+
+// csrfToken will return the token of the session of the request, and
+// start a session with a new token if it has none.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     Prefix,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// checkCSRF reports whether a form has the token of the session, which
+// other sites cannot read, so they cannot submit the forms of the UI.
+func checkCSRF(r *http.Request) bool {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	token := r.PostFormValue("csrf")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.Value)) == 1
+}
+
+// sameOrigin reports whether a form was submitted from the UI itself,
+// for browsers that send the Origin header, see checkCSRF for the others.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// render will execute the template of a page.
+func render(w http.ResponseWriter, status int, name string, data interface{}) error {
+	var b strings.Builder
+	if err := templates.ExecuteTemplate(&b, name, data); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_, err := w.Write([]byte(b.String()))
+	return err
+}
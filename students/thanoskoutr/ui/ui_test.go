@@ -0,0 +1,241 @@
+package ui
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/urlshort"
+)
+
+func newTestUI(t *testing.T) (*UI, *database.MemStore) {
+	ctx := context.Background()
+	bolt := database.NewMemStore()
+	bolt.Put(ctx, "/gh", database.Record{Url: "https://github.com", Tags: []string{"code"}})
+	yaml := database.NewMemStore()
+	yaml.Put(ctx, "/gh", database.Record{Url: "https://github.com/old"})
+	yaml.Put(ctx, "/gl", database.Record{Url: "https://gitlab.com", Description: "GitLab"})
+	return New(
+		urlshort.Source{Name: "urls.db", Kind: "bolt", Store: bolt},
+		urlshort.Source{Name: "urls.yaml", Kind: "yaml", Store: yaml, ReadOnly: true},
+	), bolt
+}
+
+// testToken is the CSRF token of the session of the forms of serve.
+const testToken = "test-token"
+
+func serve(u *UI, method string, target string, form url.Values) *httptest.ResponseRecorder {
+	var req *http.Request
+	if form != nil {
+		if _, ok := form["csrf"]; !ok {
+			form = cloneValues(form)
+			form.Set("csrf", testToken)
+		}
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: csrfCookie, Value: testToken})
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	rr := httptest.NewRecorder()
+	u.ServeHTTP(rr, req)
+	return rr
+}
+
+func cloneValues(v url.Values) url.Values {
+	c := make(url.Values, len(v))
+	for k, values := range v {
+		c[k] = append([]string(nil), values...)
+	}
+	return c
+}
+
+func TestUIList(t *testing.T) {
+	u, _ := newTestUI(t)
+	rr := serve(u, "GET", "/ui/", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	body := rr.Body.String()
+	for _, want := range []string{"bolt: urls.db", "yaml: urls.yaml (shadowed)", "https://gitlab.com", "/ui/edit?source=0&amp;key=%2fgh"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("list does not contain %q", want)
+		}
+	}
+	if strings.Contains(body, "/ui/edit?source=1") {
+		t.Error("list has edit links for a read-only source")
+	}
+
+	// Search in the descriptions and tags
+	body = serve(u, "GET", "/ui/?q=gitlab", nil).Body.String()
+	if !strings.Contains(body, "https://gitlab.com") || strings.Contains(body, "https://github.com") {
+		t.Errorf("wrong search results:\n%s", body)
+	}
+	body = serve(u, "GET", "/ui/?q=code", nil).Body.String()
+	if !strings.Contains(body, "https://github.com") || strings.Contains(body, "https://gitlab.com") {
+		t.Errorf("wrong search results:\n%s", body)
+	}
+}
+
+func TestUIEdit(t *testing.T) {
+	u, bolt := newTestUI(t)
+	ctx := context.Background()
+
+	// The form has the values of the link
+	rr := serve(u, "GET", "/ui/edit?source=0&key=/gh", nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `value="https://github.com"`) {
+		t.Errorf("wrong edit form: %v\n%s", rr.Code, rr.Body)
+	}
+	if rr := serve(u, "GET", "/ui/edit?source=1&key=/gl", nil); rr.Code != http.StatusForbidden {
+		t.Errorf("wrong status code for read-only source: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// Create a link
+	form := url.Values{
+		"source": {"0"}, "path": {"/new"}, "url": {"https://example.com/new"},
+		"status": {"301"}, "tags": {"a, b"}, "enabled": {"on"},
+	}
+	if rr := serve(u, "POST", "/ui/save", form); rr.Code != http.StatusSeeOther {
+		t.Fatalf("wrong status code: got %v want %v\n%s", rr.Code, http.StatusSeeOther, rr.Body)
+	}
+	rec, err := bolt.Get(ctx, "/new")
+	if err != nil || rec.Status != 301 || len(rec.Tags) != 2 || rec.Disabled {
+		t.Errorf("wrong saved record: %+v (%v)", rec, err)
+	}
+
+	// Rename it, and disable it
+	form.Set("key", "/new")
+	form.Set("path", "/renamed")
+	form.Del("enabled")
+	serve(u, "POST", "/ui/save", form)
+	if _, err := bolt.Get(ctx, "/new"); err == nil {
+		t.Error("old path was not removed")
+	}
+	if rec, _ := bolt.Get(ctx, "/renamed"); !rec.Disabled {
+		t.Errorf("wrong renamed record: %+v", rec)
+	}
+
+	// Invalid links are not saved, and the form shows the error
+	form.Set("url", "not a url")
+	rr = serve(u, "POST", "/ui/save", form)
+	if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), `class="error"`) {
+		t.Errorf("wrong response for invalid link: %v\n%s", rr.Code, rr.Body)
+	}
+	form.Set("url", "https://example.com")
+	form.Set("path", "/gh")
+	if rr := serve(u, "POST", "/ui/save", form); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("wrong status code for existing path: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+
+	// Delete it
+	if rr := serve(u, "POST", "/ui/delete", url.Values{"source": {"0"}, "key": {"/renamed"}}); rr.Code != http.StatusSeeOther {
+		t.Errorf("wrong status code: got %v want %v", rr.Code, http.StatusSeeOther)
+	}
+	if _, err := bolt.Get(ctx, "/renamed"); err == nil {
+		t.Error("link was not deleted")
+	}
+	if rr := serve(u, "POST", "/ui/delete", url.Values{"source": {"1"}, "key": {"/gl"}}); rr.Code != http.StatusForbidden {
+		t.Errorf("wrong status code for read-only source: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// Forms of other sites are rejected
+	req := httptest.NewRequest("POST", "/ui/delete", strings.NewReader("source=0&key=/gh&csrf="+testToken))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: testToken})
+	rr = httptest.NewRecorder()
+	u.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("wrong status code for cross-origin form: got %v want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestUIRename(t *testing.T) {
+	u, bolt := newTestUI(t)
+	ctx := context.Background()
+	bolt.Put(ctx, "/other", database.Record{Url: "https://example.com/other"})
+
+	// A rename to an existing path changes neither link
+	form := url.Values{"source": {"0"}, "key": {"/gh"}, "path": {"/other"}, "url": {"https://github.com/new"}, "enabled": {"on"}}
+	if rr := serve(u, "POST", "/ui/save", form); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("wrong status code for rename to existing path: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if rec, _ := bolt.Get(ctx, "/gh"); rec.Url != "https://github.com" {
+		t.Errorf("renamed link was changed: %+v", rec)
+	}
+	if rec, _ := bolt.Get(ctx, "/other"); rec.Url != "https://example.com/other" {
+		t.Errorf("existing link was replaced: %+v", rec)
+	}
+
+	// A rename keeps the creation time, under the new path only
+	created, _ := bolt.Get(ctx, "/gh")
+	form.Set("path", "/github")
+	if rr := serve(u, "POST", "/ui/save", form); rr.Code != http.StatusSeeOther {
+		t.Fatalf("wrong status code: got %v want %v\n%s", rr.Code, http.StatusSeeOther, rr.Body)
+	}
+	if _, err := bolt.Get(ctx, "/gh"); err == nil {
+		t.Error("old path was not removed")
+	}
+	if rec, _ := bolt.Get(ctx, "/github"); rec.Url != "https://github.com/new" || !rec.CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("wrong renamed record: %+v", rec)
+	}
+
+	// Editing a link that was deleted meanwhile does not create it again
+	form.Set("key", "/missing")
+	form.Set("path", "/missing")
+	if rr := serve(u, "POST", "/ui/save", form); rr.Code != http.StatusNotFound {
+		t.Errorf("wrong status code for a deleted link: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestUICSRF(t *testing.T) {
+	u, bolt := newTestUI(t)
+
+	// The pages start a session, and their forms have its token
+	rr := serve(u, "GET", "/ui/", nil)
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookie || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("wrong session cookies: %+v", cookies)
+	}
+	token := cookies[0].Value
+	if !strings.Contains(rr.Body.String(), `name="csrf" value="`+token+`"`) {
+		t.Errorf("list forms do not have the token %q:\n%s", token, rr.Body)
+	}
+	req := httptest.NewRequest("GET", "/ui/edit", nil)
+	req.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	u.ServeHTTP(rr, req)
+	if len(rr.Result().Cookies()) != 0 || !strings.Contains(rr.Body.String(), `name="csrf" value="`+token+`"`) {
+		t.Errorf("edit form does not keep the session token %q:\n%s", token, rr.Body)
+	}
+
+	// Forms without the token of the session are rejected, even without
+	// an Origin header
+	for name, tt := range map[string]struct {
+		cookie string
+		form   string
+	}{
+		"no token":     {token, "source=0&key=/gh"},
+		"wrong token":  {token, "source=0&key=/gh&csrf=guess"},
+		"no session":   {"", "source=0&key=/gh&csrf=" + token},
+		"empty tokens": {"", "source=0&key=/gh&csrf="},
+	} {
+		req := httptest.NewRequest("POST", "/ui/delete", strings.NewReader(tt.form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: csrfCookie, Value: tt.cookie})
+		}
+		rr := httptest.NewRecorder()
+		u.ServeHTTP(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("%s: wrong status code: got %v want %v", name, rr.Code, http.StatusForbidden)
+		}
+	}
+	if _, err := bolt.Get(context.Background(), "/gh"); err != nil {
+		t.Errorf("link was deleted by a forged form: %v", err)
+	}
+}
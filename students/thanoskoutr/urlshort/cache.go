@@ -0,0 +1,117 @@
+package urlshort
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+)
+
+// cacheItem is a cached Database lookup, found or not.
+type cacheItem struct {
+	key     string
+	rec     database.Record
+	found   bool
+	expires time.Time
+}
+
+// lruCache is a bounded cache of Database lookups.
+//
+// When the cache is full, the least recently used item is evicted.
+// Items expire after their time to live, which can be different for
+// keys that were found and keys that were not.
+//
+// Every removal starts a new generation of the cache, so a lookup that
+// was read from the Database before a removal is not cached after it.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	missTTL time.Duration
+	gen     uint64
+	ll      *list.List
+	items   map[string]*list.Element
+	timeNow func() time.Time
+}
+
+// newLRUCache will return a cache of the given size, where found keys
+// live for ttl and keys that were not found live for missTTL.
+func newLRUCache(size int, ttl time.Duration, missTTL time.Duration) *lruCache {
+	return &lruCache{
+		size:    size,
+		ttl:     ttl,
+		missTTL: missTTL,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+		timeNow: time.Now,
+	}
+}
+
+// get will return the cached lookup of the key, and whether it
+// was in the cache and not expired.
+func (c *lruCache) get(key string) (rec database.Record, found bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return database.Record{}, false, false
+	}
+	item := el.Value.(*cacheItem)
+	if c.timeNow().After(item.expires) {
+		c.removeElement(el)
+		return database.Record{}, false, false
+	}
+	c.ll.MoveToFront(el)
+	return item.rec, item.found, true
+}
+
+// generation will return the current generation of the cache.
+func (c *lruCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// add will cache the lookup of the key, unless the cache moved to
+// a new generation since the lookup was read.
+func (c *lruCache) add(key string, rec database.Record, found bool, gen uint64) {
+	ttl := c.ttl
+	if !found {
+		ttl = c.missTTL
+	}
+	if c.size <= 0 || ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	item := &cacheItem{key: key, rec: rec, found: found, expires: c.timeNow().Add(ttl)}
+	if el, ok := c.items[key]; ok {
+		el.Value = item
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(item)
+	if c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// remove will evict the key from the cache.
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// removeElement will evict an item. It must be called with the mutex held.
+func (c *lruCache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*cacheItem).key)
+}
@@ -0,0 +1,137 @@
+package urlshort
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+)
+
+// Classes of the user agents of the clicks.
+const (
+	AgentBrowser = "browser"
+	AgentMobile  = "mobile"
+	AgentBot     = "bot"
+	AgentCLI     = "cli"
+	AgentOther   = "other"
+)
+
+// ClickRecorder records the redirects of the handlers, see RecordClicks.
+//
+// database.Database is a ClickRecorder.
+type ClickRecorder interface {
+	RecordClick(c database.Click) error
+}
+
+// clickRecorderKey is the context key of the ClickRecorder of a request.
+type clickRecorderKey struct{}
+
+// RecordClicks will return a handler that records every redirect of the
+// handlers of h with the recorder, e.g. of a chain of handlers:
+//
+//     h := urlshort.RecordClicks(storeHandler, db)
+//
+// The fallback of the chain is not recorded.
+func RecordClicks(h http.Handler, rec ClickRecorder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clickRecorderKey{}, rec)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// redirect will redirect the request to the target, and record the
+// click, if the request has a ClickRecorder.
+func redirect(w http.ResponseWriter, r *http.Request, t target) {
+	http.Redirect(w, r, t.url, t.status)
+	rec, ok := r.Context().Value(clickRecorderKey{}).(ClickRecorder)
+	if !ok {
+		return
+	}
+	if err := rec.RecordClick(newClick(r, t)); err != nil {
+		log.Printf("urlshort: record click %s: %v", t.key, err)
+	}
+}
+
+// newClick will return the click of the redirect of the request to the
+// target.
+func newClick(r *http.Request, t target) database.Click {
+	c := database.Click{
+		Time:  time.Now().UTC(),
+		Key:   t.key,
+		Path:  r.URL.Path,
+		URL:   t.url,
+		Agent: AgentClass(r.UserAgent()),
+		IP:    AnonymizeIP(clientIP(r)),
+	}
+	if referer := r.Referer(); referer != "" {
+		if ref, err := url.Parse(referer); err == nil {
+			c.Referrer = normalizeHost(ref.Host)
+		}
+	}
+	return c
+}
+
+// agentClasses are the substrings of the lowercased user agents of each
+// class, in the order they are tried.
+var agentClasses = []struct {
+	class   string
+	needles []string
+}{
+	{AgentBot, []string{"bot", "crawler", "spider", "slurp", "facebookexternalhit", "preview"}},
+	{AgentCLI, []string{"curl/", "wget/", "httpie/", "python-requests/", "go-http-client/", "okhttp/"}},
+	{AgentMobile, []string{"mobile", "android", "iphone", "ipad"}},
+	{AgentBrowser, []string{"mozilla/", "opera/"}},
+}
+
+// AgentClass will return the class of a User-Agent header, one of
+// AgentBrowser, AgentMobile, AgentBot, AgentCLI or AgentOther.
+func AgentClass(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	for _, c := range agentClasses {
+		for _, needle := range c.needles {
+			if strings.Contains(ua, needle) {
+				return c.class
+			}
+		}
+	}
+	return AgentOther
+}
+
+// clientIP will return the address of the client of the request.
+//
+// Behind a local proxy, i.e. for requests from the loopback address or
+// on a Unix domain socket, it is the last address of X-Forwarded-For, the
+// one added by the proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsLoopback() {
+		return host
+	}
+	if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+		addrs := strings.Split(fwd[len(fwd)-1], ",")
+		return strings.TrimSpace(addrs[len(addrs)-1])
+	}
+	return host
+}
+
+// AnonymizeIP will zero the host part of an IP address, keeping its /24
+// network for IPv4 and its /48 network for IPv6, e.g. 192.0.2.0 for
+// 192.0.2.17. It returns an empty string for an invalid address.
+func AnonymizeIP(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
@@ -0,0 +1,246 @@
+package urlshort
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+)
+
+// DBOptions configures the cache of the handlers that query the Database.
+type DBOptions struct {
+	// CacheSize is the maximum number of cached lookups.
+	CacheSize int
+	// CacheTTL is how long a key that was found stays cached.
+	CacheTTL time.Duration
+	// MissTTL is how long a key that was not found stays cached.
+	MissTTL time.Duration
+}
+
+// DefaultDBOptions are the options used by DBHandler.
+var DefaultDBOptions = DBOptions{
+	CacheSize: 10000,
+	CacheTTL:  time.Minute,
+	MissTTL:   10 * time.Second,
+}
+
+// Source is a named set of links of a chain of handlers, e.g. for
+// listing and editing them in a UI.
+type Source struct {
+	// Name identifies the source, e.g. the name of its file.
+	Name string
+	// Kind is the type of the source, e.g. bolt, yaml, json or map.
+	Kind string
+	// Store has the links of the source.
+	Store database.Store
+	// ReadOnly is set for sources that cannot be changed, e.g. because
+	// they are loaded from a file.
+	ReadOnly bool
+}
+
+// dbResolver resolves requests against a Store, one key at a time.
+//
+// Templates cannot be looked up by key, so they are the only
+// entries of the Store that are kept in memory.
+type dbResolver struct {
+	store     database.Store
+	cache     *lruCache
+	templates *Handler
+}
+
+// NewDBHandler will return an http.HandlerFunc (which also
+// implements http.Handler) that will attempt to map any paths
+// to their corresponding URL, by looking them up in the Store
+// on every request. If the path is not provided in the Store,
+// then the fallback http.Handler will be called instead.
+//
+// Lookups are cached, found or not, as configured by the options.
+// If the Store is a database.Watcher (like database.Database), its
+// changes evict the changed keys from the cache, while other changes
+// (e.g. made by other processes) are seen once the cached lookups expire.
+// The Store is watched while it is open, use NewStoreHandler for a
+// handler that can stop watching it.
+//
+// The only errors that can be returned all related to getting
+// error from the Store.
+func NewDBHandler(store database.Store, fallback http.Handler, opts DBOptions) (http.HandlerFunc, error) {
+	h, err := NewStoreHandler(store, fallback, opts)
+	if err != nil {
+		return nil, err
+	}
+	return h.ServeHTTP, nil
+}
+
+// StoreHandler is the http.Handler of NewDBHandler, which is also
+// an Explainer.
+type StoreHandler struct {
+	resolver *dbResolver
+	fallback http.Handler
+	unwatch  func() // of a database.Watcher
+}
+
+// NewStoreHandler will return the handler of NewDBHandler, as a
+// StoreHandler.
+func NewStoreHandler(store database.Store, fallback http.Handler, opts DBOptions) (*StoreHandler, error) {
+	d := &dbResolver{
+		store:     store,
+		cache:     newLRUCache(opts.CacheSize, opts.CacheTTL, opts.MissTTL),
+		templates: &Handler{fallback: fallback},
+	}
+	h := &StoreHandler{resolver: d, fallback: fallback}
+	if w, ok := store.(database.Watcher); ok {
+		h.unwatch = w.Watch(d.invalidate)
+	}
+	// Read the templates from Store, save in the handler
+	err := d.templates.load(d.loadTemplates)
+	if err != nil {
+		h.Stop()
+		return nil, err
+	}
+	return h, nil
+}
+
+// Stop will stop watching the changes of the Store, if it is a
+// database.Watcher, so the handler can be garbage collected while the
+// Store is still used. The handler still serves the Store, but its
+// cached lookups are not evicted on changes anymore.
+func (h *StoreHandler) Stop() {
+	if h.unwatch != nil {
+		h.unwatch()
+	}
+}
+
+// ServeHTTP will redirect the request, if its path is in the Store,
+// or call the fallback http.Handler. Like for a Handler, the entries of
+// the Store and of its fallback are resolved together.
+func (h *StoreHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveChain(w, r, h)
+}
+
+// resolve will return the entry of the Store that redirects the
+// request, see source.
+func (h *StoreHandler) resolve(r *http.Request) (candidate, bool, error) {
+	return h.resolver.lookup(r)
+}
+
+// next will return the fallback, see source.
+func (h *StoreHandler) next() http.Handler {
+	return h.fallback
+}
+
+// Matches will return the entries of the Store that match the request,
+// see Explainer. The entries are looked up like ServeHTTP does, through
+// its cache.
+func (h *StoreHandler) Matches(r *http.Request) ([]Match, error) {
+	return h.resolver.matches(r)
+}
+
+// invalidate will evict a changed key from the cache, and update
+// the templates if the key is a template.
+func (d *dbResolver) invalidate(c database.Change) {
+	d.cache.remove(c.Key)
+	if _, path := database.SplitHostKey(c.Key); !isTemplate(path) {
+		return
+	}
+	if c.Deleted {
+		d.templates.Delete(c.Key)
+	} else {
+		d.templates.SetRecord(c.Key, c.Record)
+	}
+}
+
+// loadTemplates will read the templates from the Store.
+func (d *dbResolver) loadTemplates() (map[string]database.Record, error) {
+	ctx := context.Background()
+	templates := make(map[string]database.Record)
+	keep := func(key string, rec database.Record) error {
+		if _, path := database.SplitHostKey(key); isTemplate(path) {
+			templates[key] = rec
+		}
+		return nil
+	}
+	if it, ok := d.store.(database.Iterator); ok {
+		return templates, it.ForEach(ctx, keep)
+	}
+	records, err := d.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for key, rec := range records {
+		keep(key, rec)
+	}
+	return templates, nil
+}
+
+// lookup will return where to redirect the request, like the router,
+// see eachCandidate.
+func (d *dbResolver) lookup(r *http.Request) (candidate, bool, error) {
+	return firstCandidate(r, d.entries())
+}
+
+// entries will return a function that returns the entries of a host
+// in the Store, with the templates of the current routes.
+func (d *dbResolver) entries() func(host string) (entrySet, bool) {
+	templates := d.templates.currentRoutes()
+	return func(host string) (entrySet, bool) {
+		s := storeEntries{resolver: d, host: host}
+		if table, ok := templates.hosts[host]; ok {
+			s.templates = table.templates
+		}
+		return s, true
+	}
+}
+
+// storeEntries is the entries of a host in the Store of a dbResolver,
+// which are looked up one key at a time, see entrySet.
+type storeEntries struct {
+	resolver  *dbResolver
+	host      string
+	templates []*pathTemplate
+}
+
+func (s storeEntries) exactEntry(ctx context.Context, path string) (database.Record, bool, error) {
+	return s.get(ctx, path)
+}
+
+func (s storeEntries) pathTemplates() []*pathTemplate {
+	return s.templates
+}
+
+func (s storeEntries) prefixEntry(ctx context.Context, key string) (database.Record, bool, error) {
+	return s.get(ctx, key)
+}
+
+// get will return the entry of the path of the host.
+func (s storeEntries) get(ctx context.Context, path string) (database.Record, bool, error) {
+	key := database.HostKey(s.host, path)
+	rec, found, err := s.resolver.get(ctx, key)
+	if err != nil || !found {
+		return database.Record{}, false, err
+	}
+	return recordEntry(key, rec), true, nil
+}
+
+// get will look the key up in the cache, or else in the Store.
+//
+// Disabled records are not found.
+func (d *dbResolver) get(ctx context.Context, key string) (database.Record, bool, error) {
+	if rec, found, ok := d.cache.get(key); ok {
+		return rec, found, nil
+	}
+	gen := d.cache.generation()
+	rec, err := d.store.Get(ctx, key)
+	if errors.Is(err, database.ErrNotFound) {
+		d.cache.add(key, database.Record{}, false, gen)
+		return database.Record{}, false, nil
+	}
+	if err != nil {
+		return database.Record{}, false, err
+	}
+	// A disabled record is cached as a miss
+	found := !rec.Disabled
+	d.cache.add(key, rec, found, gen)
+	return rec, found, nil
+}
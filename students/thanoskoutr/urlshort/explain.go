@@ -0,0 +1,80 @@
+package urlshort
+
+import (
+	"net/http"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+)
+
+// Kinds of the entries that match a request.
+const (
+	// MatchExact is an entry of the exact path.
+	MatchExact = "exact"
+	// MatchTemplate is a path template, e.g. /gh/{user}.
+	MatchTemplate = "template"
+	// MatchPrefix is a prefix entry, e.g. /gh/*.
+	MatchPrefix = "prefix"
+)
+
+// Match is an entry that matches a request, and where it redirects it.
+type Match struct {
+	// Key is the key of the entry, see database.HostKey.
+	Key string `json:"key"`
+	// Kind is MatchExact, MatchTemplate or MatchPrefix.
+	Kind string `json:"kind"`
+	// URL is the URL the request is redirected to, with its query
+	// handled by the query policy of the entry.
+	URL string `json:"url"`
+	// Status is the status code of the redirect.
+	Status int `json:"status"`
+
+	rank rank
+}
+
+// Beats reports whether the entry of the match is more specific than
+// the entry of the other one, so it redirects the request instead of
+// it, even if they are in different sources of a chain. Between entries
+// that are as specific, the first one tried wins.
+func (m Match) Beats(other Match) bool {
+	return m.rank.beats(other.rank)
+}
+
+// Explainer is implemented by the handlers that can tell how they would
+// redirect a request, without redirecting it.
+type Explainer interface {
+	// Matches returns all the entries that match the request, in the
+	// order they are tried, so the request is redirected by the first
+	// one, unless an entry of another source beats it, see Match.Beats,
+	// and the others are shadowed by it.
+	Matches(r *http.Request) ([]Match, error)
+}
+
+// Matches will return the entries of the current mapping that match
+// the request, see Explainer.
+func (h *Handler) Matches(r *http.Request) ([]Match, error) {
+	return h.currentRoutes().matches(r), nil
+}
+
+// match will return the Match of the candidate.
+func (c candidate) match() Match {
+	return Match{
+		Key:    database.HostKey(c.entry.Host, c.entry.Path),
+		Kind:   c.kind,
+		URL:    c.target.url,
+		Status: c.target.status,
+		rank:   c.rank,
+	}
+}
+
+// matches will return the entries that match the request, in the
+// order of lookup.
+func (rt *router) matches(r *http.Request) []Match {
+	matches, _ := allMatches(r, rt.entries)
+	return matches
+}
+
+// matches will return the entries of the Store that match the request,
+// in the order of lookup, like lookup.
+func (d *dbResolver) matches(r *http.Request) ([]Match, error) {
+	return allMatches(r, d.entries())
+}
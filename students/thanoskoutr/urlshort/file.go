@@ -0,0 +1,182 @@
+package urlshort
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+)
+
+// FileHandler is a Handler for the paths of a mapping file, in one of
+// the Formats, that reloads the file when it changes.
+//
+// A reload swaps in the new mapping atomically, so requests are served
+// by either the old or the new mapping. If the new file cannot be parsed
+// or has an invalid entry (e.g. an unsafe URL, a path without a leading
+// "/", or an invalid template, status code or query policy), the old
+// mapping keeps being served, and the error is kept until the next
+// successful reload, see Status.
+//
+// Every load validates the file, see Validate. The problems found are
+// kept in the Status. A file with an error is treated like a file that
+// cannot be parsed, and in strict mode so is a file with any problem.
+type FileHandler struct {
+	*Handler
+	name string
+	enc  string
+	opts FileOptions
+
+	mu       sync.Mutex // serializes the reloads
+	modTime  time.Time
+	size     int64
+	sum      [sha256.Size]byte
+	loadedAt time.Time
+	format   string
+	diags    []Diagnostic
+	err      error
+}
+
+// FileOptions configures the validation of the file of a FileHandler.
+type FileOptions struct {
+	// Strict rejects a file with any problem, even a warning.
+	Strict bool
+}
+
+// FileStatus is the state of the file of a FileHandler.
+type FileStatus struct {
+	Name        string       `json:"name"`
+	Format      string       `json:"format"`
+	LoadedAt    time.Time    `json:"loaded_at"`
+	Error       string       `json:"error,omitempty"`
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// NewFileHandler will read the file, in one of the Formats (or, if enc
+// is empty, in the format detected on every load, see DetectFormat), and
+// return a FileHandler for its paths. If the path is not provided in the
+// file, then the fallback http.Handler will be called instead.
+//
+// The only errors that can be returned all related to reading the file,
+// or having invalid data in it, see Validate (or any problem in strict
+// mode).
+func NewFileHandler(name string, enc string, fallback http.Handler, opts FileOptions) (*FileHandler, error) {
+	f := &FileHandler{
+		Handler: &Handler{fallback: fallback},
+		name:    name,
+		enc:     enc,
+		opts:    opts,
+	}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload will read the file again, and swap in its mapping if it
+// changed. It reports whether the mapping was swapped.
+//
+// The file is only read if its modification time or size changed, and
+// only parsed if its content changed.
+func (f *FileHandler) Reload() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changed, err := f.reload()
+	f.err = err
+	return changed, err
+}
+
+// reload will read and parse the file. It must be called with the mutex held.
+func (f *FileHandler) reload() (bool, error) {
+	info, err := os.Stat(f.name)
+	if err != nil {
+		return false, err
+	}
+	if !f.loadedAt.IsZero() && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		// Unchanged since the last reload, keep its error if it failed
+		return false, f.err
+	}
+	data, err := os.ReadFile(f.name)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(data)
+	f.modTime, f.size = info.ModTime(), info.Size()
+	if !f.loadedAt.IsZero() && bytes.Equal(sum[:], f.sum[:]) {
+		return false, nil
+	}
+	enc := f.enc
+	if enc == "" {
+		enc = DetectFormat(f.name, data)
+	}
+	diags := Validate(f.name, data, enc)
+	if f.opts.Strict && len(diags) > 0 {
+		return false, fmt.Errorf("%s: %d problems, first: %v", f.name, len(diags), diags[0])
+	}
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			return false, fmt.Errorf("%v", d)
+		}
+	}
+	records, err := ParseRecords(data, enc)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", f.name, err)
+	}
+	entries := make(map[string]database.Record, len(records))
+	for key, rec := range records {
+		entries[key] = recordEntry(key, rec)
+	}
+	if _, err := newRouter(entries); err != nil {
+		return false, fmt.Errorf("%s: %v", f.name, err)
+	}
+	f.ReplaceRecords(records)
+	f.format = enc
+	f.diags = diags
+	f.sum = sum
+	f.loadedAt = time.Now()
+	return true, nil
+}
+
+// Status will return when the file was last loaded, the problems found
+// in it, and the error of the last reload, if it failed.
+func (f *FileHandler) Status() FileStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := FileStatus{Name: f.name, Format: f.format, LoadedAt: f.loadedAt, Diagnostics: f.diags}
+	if f.err != nil {
+		s.Error = f.err.Error()
+	}
+	return s
+}
+
+// Watch will reload the file every interval, until the context is done.
+//
+// Reloads and failed reloads are logged, a failure only once until
+// the file changes.
+func (f *FileHandler) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastErr string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed, err := f.Reload()
+		switch {
+		case err != nil && err.Error() != lastErr:
+			log.Printf("urlshort: reload failed, serving the previous version: %v", err)
+			lastErr = err.Error()
+		case err == nil && changed:
+			log.Printf("urlshort: reloaded %s", f.name)
+			lastErr = ""
+		}
+	}
+}
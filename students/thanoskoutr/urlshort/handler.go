@@ -1,12 +1,9 @@
 package urlshort
 
 import (
-	"encoding/json"
-	"fmt"
 	"net/http"
 
 	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
-	"gopkg.in/yaml.v2"
 )
 
 // MapHandler will return an http.HandlerFunc (which also
@@ -15,11 +12,47 @@ import (
 // that each key in the map points to, in string format).
 // If the path is not provided in the map, then the fallback
 // http.Handler will be called instead.
+//
+// A path ending in "/*" is a prefix entry, that matches every path under it:
+//
+//     "/gh/*": "https://github.com/*"
+//
+// redirects /gh/golang/go?tab=readme to https://github.com/golang/go?tab=readme.
+// When several prefix entries match, the longest one wins.
+//
+// A path with named segments is a template, whose parameters are
+// bound to the segments of the path and rendered (escaped) in the URL:
+//
+//     "/jira/{ticket}":         "https://jira.example.com/browse/{ticket}"
+//     "/docs/{version=latest}": "https://docs.example.com/{version}"
+//     "/src/{rest...}":         "https://cs.example.com/{rest}"
+//
+// An exact path always wins over a template, and a template always wins
+// over a prefix entry. Invalid templates are matched as exact paths,
+// see YAMLHandler and JSONHandler for handlers that report them.
+//
+// A path can be scoped to a host, by prefixing it with the host name:
+//
+//     "go.example.com/pkg":   "https://pkg.go.dev"
+//     "docs.example.com/pkg": "https://docs.example.com/packages"
+//
+// Paths scoped to the host of the request are tried first, and paths
+// that are not scoped to a host serve every host.
 func MapHandler(pathsToUrls map[string]string, fallback http.Handler) http.HandlerFunc {
+	pathMap := make(map[string]database.Record)
+	for key, url := range pathsToUrls {
+		pathMap[key] = recordEntry(key, database.Record{Url: url})
+	}
+	routes, _ := newRouter(pathMap)
+	return mapHandler(routes, fallback)
+}
+
+// mapHandler will return an http.HandlerFunc that redirects the paths
+// of the router, or calls the fallback http.Handler.
+func mapHandler(routes *router, fallback http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		shortPath := r.URL.Path
-		if url, ok := pathsToUrls[shortPath]; ok {
-			http.Redirect(w, r, url, http.StatusFound)
+		if c, ok := routes.lookup(r); ok {
+			redirect(w, r, c.target)
 
 		} else {
 			fallback.ServeHTTP(w, r)
@@ -27,40 +60,45 @@ func MapHandler(pathsToUrls map[string]string, fallback http.Handler) http.Handl
 	}
 }
 
-// pathUrl represents the schema of the YAML file, containing paths and their URLs.
-type pathUrl struct {
-	Url  string
-	Path string
-}
-
-// parseEncoding will parse an encoded file to validate it.
-func parseEncoded(data []byte, enc string) ([]pathUrl, error) {
-	var pathUrls []pathUrl
-	var err error
-	// Select encoding scheme
-	switch enc {
-	case "yaml":
-		err = yaml.Unmarshal(data, &pathUrls)
-	case "json":
-		err = json.Unmarshal(data, &pathUrls)
-	default:
-		return nil, fmt.Errorf("%s encoding not supported", enc)
-	}
+// parseEncoded will parse an encoded file to validate it.
+//
+// The file is a list of database.Record, containing paths and their URLs,
+// in one of the Formats (e.g. "yaml" or "json"). Optionally, an entry can
+// set the host it is scoped to, the status code to redirect with (301,
+// 302, 303, 307 or 308, 302 by default), the query policy for the query
+// string of the request (drop, append, merge or replace), whether it is
+// enabled and its metadata.
+func parseEncoded(data []byte, enc string) ([]database.Record, error) {
+	pathUrls, _, err := decode(data, enc)
 	if err != nil {
 		return nil, err
 	}
 	return pathUrls, nil
 }
 
-// buildMap will convert the parsed data in a YAML file to map.
-func buildMap(pathUrls []pathUrl) map[string]string {
-	pathUrlMap := make(map[string]string)
+// buildMap will convert the parsed data in a YAML file to map,
+// keyed by the path scoped to its host.
+func buildMap(pathUrls []database.Record) map[string]database.Record {
+	pathUrlMap := make(map[string]database.Record)
 	for _, pathUrlItem := range pathUrls {
-		pathUrlMap[pathUrlItem.Path] = pathUrlItem.Url
+		key := database.HostKey(pathUrlItem.Host, pathUrlItem.Path)
+		pathUrlMap[key] = pathUrlItem
 	}
 	return pathUrlMap
 }
 
+// ParseRecords will parse the provided data, in one of the Formats (e.g.
+// enc is "yaml" or "json"), to a map of its entries, keyed by their path
+// scoped to their host, see database.HostKey. The entries have the
+// fields of YAMLHandler and JSONHandler.
+func ParseRecords(data []byte, enc string) (map[string]database.Record, error) {
+	parsed, err := parseEncoded(data, enc)
+	if err != nil {
+		return nil, err
+	}
+	return buildMap(parsed), nil
+}
+
 // YAMLHandler will parse the provided YAML and then return
 // an http.HandlerFunc (which also implements http.Handler)
 // that will attempt to map any paths to their corresponding
@@ -71,16 +109,27 @@ func buildMap(pathUrls []pathUrl) map[string]string {
 //
 //     - path: /some-path
 //       url: https://www.some-url.com/demo
+//       host: go.example.com
+//       status: 301
+//       query: merge
+//       enabled: true
+//       description: Some demo
+//       tags: [demo]
+//
+// The path can also be a prefix entry or a template, see MapHandler.
 //
 // The only errors that can be returned all related to having
-// invalid YAML data.
+// invalid YAML data, invalid templates, status codes or query policies.
 func YAMLHandler(yml []byte, fallback http.Handler) (http.HandlerFunc, error) {
 	parsedYAML, err := parseEncoded(yml, "yaml")
 	if err != nil {
 		return nil, err
 	}
-	pathMap := buildMap(parsedYAML)
-	return MapHandler(pathMap, fallback), nil
+	routes, err := newRouter(buildMap(parsedYAML))
+	if err != nil {
+		return nil, err
+	}
+	return mapHandler(routes, fallback), nil
 }
 
 // JSONHandler will parse the provided JSON and then return
@@ -94,40 +143,47 @@ func YAMLHandler(yml []byte, fallback http.Handler) (http.HandlerFunc, error) {
 //    [
 //      {
 //        "url": "https://www.some-url.com/demo",
-//        "path": "/some-path"
+//        "path": "/some-path",
+//        "host": "go.example.com",
+//        "status": 301,
+//        "query": "merge",
+//        "enabled": true,
+//        "description": "Some demo",
+//        "tags": ["demo"]
 //      },
 //    ]
 //
+// The path can also be a prefix entry or a template, see MapHandler.
+//
 // The only errors that can be returned all related to having
-// invalid JSON data.
+// invalid JSON data, invalid templates, status codes or query policies.
 func JSONHandler(jsonBlob []byte, fallback http.Handler) (http.HandlerFunc, error) {
 	parsedJSON, err := parseEncoded(jsonBlob, "json")
 	if err != nil {
 		return nil, err
 	}
-	pathMap := buildMap(parsedJSON)
-	return MapHandler(pathMap, fallback), nil
+	routes, err := newRouter(buildMap(parsedJSON))
+	if err != nil {
+		return nil, err
+	}
+	return mapHandler(routes, fallback), nil
 }
 
-// DBHandler will query the Database and then return
-// an http.HandlerFunc (which also implements http.Handler)
-// that will attempt to map any paths to their corresponding
-// URL. If the path is not provided in the Database, then the
-// fallback http.Handler will be called instead.
+// DBHandler will query the Database (or any other database.Store)
+// and then return an http.HandlerFunc (which also implements
+// http.Handler) that will attempt to map any paths to their
+// corresponding URL. If the path is not provided in the Database,
+// then the fallback http.Handler will be called instead.
+//
+// Database is expected to be in key-value pair format, where
+// the value is either a plain URL or a database.Record, and the
+// key is a path, optionally scoped to a host (see database.HostKey).
 //
-// Database is expected to be in key-value pair format.
+// The paths are looked up in the Database on every request, with
+// the DefaultDBOptions cache, see NewDBHandler.
 //
 // The only errors that can be returned all related to getting
 // error from the Database.
-func DBHandler(db *database.Database, fallback http.Handler) (http.HandlerFunc, error) {
-	pathMap := make(map[string]string)
-	// Read all entries from Database, save in a map
-	entries, err := database.GetEntriesDB(db)
-	if err != nil {
-		return nil, err
-	}
-	for k, v := range entries {
-		pathMap[k] = v
-	}
-	return MapHandler(pathMap, fallback), nil
+func DBHandler(store database.Store, fallback http.Handler) (http.HandlerFunc, error) {
+	return NewDBHandler(store, fallback, DefaultDBOptions)
 }
@@ -1,9 +1,23 @@
 package urlshort
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+	"gopkg.in/yaml.v2"
 )
 
 // Wrong testcases
@@ -18,6 +32,132 @@ var pathsToUrls = map[string]string{
 	"/yaml-godoc":     "https://godoc.org/gopkg.in/yaml.v2",
 }
 
+// Testcases prefix entries
+var prefixPathsToUrls = map[string]string{
+	"/gh/*":           "https://github.com/*",
+	"/gh/gophercises": "https://gophercises.com",
+	"/gh/golang/*":    "https://go.googlesource.com/*",
+	"/docs/*":         "https://pkg.go.dev",
+	"/search/*":       "https://www.google.com/search?q=*",
+}
+
+// Requests and the URLs they are expected to be redirected to
+var prefixRequests = map[string]string{
+	"/gh/thanoskoutr/urlshort": "https://github.com/thanoskoutr/urlshort",
+	"/gh/gophercises":          "https://gophercises.com",
+	"/gh/golang/go":            "https://go.googlesource.com/go",
+	"/gh":                      "https://github.com/",
+	"/gh/a%20b?tab=readme":     "https://github.com/a%20b?tab=readme",
+	"/docs/net/http":           "https://pkg.go.dev/net/http",
+	"/docs":                    "https://pkg.go.dev",
+	"/search/golang?hl=en":     "https://www.google.com/search?q=golang&hl=en",
+}
+
+// Testcases path templates
+var templateYmls = `
+- path: /jira/{ticket}
+  url: https://jira.example.com/browse/{ticket}
+- path: /jira/new
+  url: https://jira.example.com/secure/CreateIssue.jspa
+- path: /docs/{pkg}/{version=latest}
+  url: https://docs.example.com/{version}/{pkg}
+- path: /src/{repo}/{rest...}
+  url: https://cs.example.com/{repo}/+/main/{rest}
+- path: /search/{term}
+  url: https://www.google.com/search?q={term}
+- path: /blob/{branch=main}/{rest...}
+  url: https://git.example.com/{branch}/{rest}
+`
+
+// Requests and the URLs they are expected to be redirected to
+var templateRequests = map[string]string{
+	"/jira/GO-123":              "https://jira.example.com/browse/GO-123",
+	"/jira/new":                 "https://jira.example.com/secure/CreateIssue.jspa",
+	"/jira/a%2Fb":               "https://jira.example.com/browse/a%2Fb",
+	"/docs/http":                "https://docs.example.com/latest/http",
+	"/docs/http/v1.2":           "https://docs.example.com/v1.2/http",
+	"/src/go/src/net/http":      "https://cs.example.com/go/+/main/src/net/http",
+	"/src/go":                   "https://cs.example.com/go/+/main/",
+	"/src/go/a%20b/c":           "https://cs.example.com/go/+/main/a%20b/c",
+	"/search/go%20templates%3F": "https://www.google.com/search?q=go+templates%3F",
+	"/blob":                     "https://git.example.com/main/",
+	"/blob/":                    "https://git.example.com/main/",
+	"/blob/dev/a/b":             "https://git.example.com/dev/a/b",
+}
+
+// Templates that cannot be parsed
+var invalidTemplates = []string{
+	"/a/{rest...}/b",
+	"/a/{b=c}/d",
+	"/a/{b}/{b}",
+	"/a/b{c}",
+	"/a/{}",
+}
+
+// Testcases status codes and query policies
+var policyJSONBlob = `
+[
+  {"path": "/permanent", "url": "https://example.com/docs", "status": 301},
+  {"path": "/drop", "url": "https://example.com/?ref=short", "query": "drop"},
+  {"path": "/append", "url": "https://example.com/?ref=short", "query": "append", "status": 307},
+  {"path": "/merge", "url": "https://example.com/?ref=short&lang=en#top", "query": "merge", "status": 308},
+  {"path": "/replace", "url": "https://example.com/?ref=short", "query": "replace", "status": 303},
+  {"path": "/campaign/*", "url": "https://example.com/*?ref=short", "query": "drop"}
+]
+`
+
+// Requests and the status and URLs they are expected to be redirected to
+var policyRequests = []struct {
+	path   string
+	status int
+	url    string
+}{
+	{"/permanent?utm_source=mail", http.StatusMovedPermanently, "https://example.com/docs"},
+	{"/drop?utm_source=mail", http.StatusFound, "https://example.com/?ref=short"},
+	{"/append?utm_source=mail", http.StatusTemporaryRedirect, "https://example.com/?ref=short&utm_source=mail"},
+	{"/append", http.StatusTemporaryRedirect, "https://example.com/?ref=short"},
+	{"/merge?ref=mail&utm_source=mail", http.StatusPermanentRedirect, "https://example.com/?lang=en&ref=mail&utm_source=mail#top"},
+	{"/replace?utm_source=mail", http.StatusSeeOther, "https://example.com/?utm_source=mail"},
+	{"/replace", http.StatusSeeOther, "https://example.com/"},
+	{"/campaign/spring?utm_source=mail", http.StatusFound, "https://example.com/spring?ref=short"},
+}
+
+// Entries with invalid status codes or query policies
+var invalidPolicies = []string{
+	`[{"path": "/a", "url": "https://example.com", "status": 200}]`,
+	`[{"path": "/a", "url": "https://example.com", "status": 404}]`,
+	`[{"path": "/a", "url": "https://example.com", "query": "keep"}]`,
+}
+
+// Testcases host-scoped paths
+var hostPathsToUrls = map[string]string{
+	"go.example.com/pkg":   "https://pkg.go.dev",
+	"docs.example.com/pkg": "https://docs.example.com/packages",
+	"go.example.com/x/*":   "https://pkg.go.dev/golang.org/x/*",
+	"/pkg":                 "https://example.com/pkg",
+	"/about":               "https://example.com/about",
+}
+
+// Requests and the URLs they are expected to be redirected to
+var hostRequests = map[string]string{
+	"http://go.example.com/pkg":      "https://pkg.go.dev",
+	"http://GO.example.com:8080/pkg": "https://pkg.go.dev",
+	"http://docs.example.com/pkg":    "https://docs.example.com/packages",
+	"http://l.example.com/pkg":       "https://example.com/pkg",
+	"http://go.example.com/about":    "https://example.com/about",
+	"http://go.example.com/x/net":    "https://pkg.go.dev/golang.org/x/net",
+	"/pkg":                           "https://example.com/pkg",
+}
+
+// Testcases host field in YAMLHandler
+var hostYmls = `
+- path: /pkg
+  host: go.example.com
+  url: https://pkg.go.dev
+- path: /pkg
+  url: https://example.com/pkg
+`
+
 // Testcases YAMLHandler
 var ymls = `
 - path: /urlshort-godoc
@@ -80,6 +220,200 @@ func TestMapHandler(t *testing.T) {
 	}
 }
 
+func TestMapHandlerPrefix(t *testing.T) {
+	// Run tests for all testcases
+	for path, url := range prefixRequests {
+		resp := runMapHandler(t, prefixPathsToUrls, path)
+
+		// Check the status code is what we expect.
+		if status := resp.StatusCode; status != http.StatusFound {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v",
+				path, status, http.StatusFound)
+		}
+
+		// Check the header to see if redirection is what we expect.
+		header := resp.Header
+		if len(header["Location"]) <= 0 {
+			t.Fatalf("handler returned empty Location header: got %v",
+				header["Location"])
+		}
+		if header["Location"][0] != url {
+			t.Errorf("handler returned wrong url for %s: got %v want %v",
+				path, header["Location"][0], url)
+		}
+	}
+	// Run tests for wrong testcases
+	for _, path := range []string{"/ghost", "/gh-pages", "/"} {
+		resp := runMapHandler(t, prefixPathsToUrls, path)
+
+		// Check the status code is what we expect.
+		if status := resp.StatusCode; status != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v",
+				path, status, http.StatusNotFound)
+		}
+	}
+}
+
+func TestYAMLHandlerTemplate(t *testing.T) {
+	// Run tests for all testcases
+	for path, url := range templateRequests {
+		resp := runEncodingHandler(t, []byte(templateYmls), "yaml", path)
+
+		// Check the status code is what we expect.
+		if status := resp.StatusCode; status != http.StatusFound {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v",
+				path, status, http.StatusFound)
+		}
+
+		// Check the header to see if redirection is what we expect.
+		header := resp.Header
+		if len(header["Location"]) <= 0 {
+			t.Fatalf("handler returned empty Location header: got %v",
+				header["Location"])
+		}
+		if header["Location"][0] != url {
+			t.Errorf("handler returned wrong url for %s: got %v want %v",
+				path, header["Location"][0], url)
+		}
+	}
+	// Run tests for wrong testcases
+	for _, path := range []string{"/jira", "/jira/GO-123/comments", "/docs", "/src"} {
+		resp := runEncodingHandler(t, []byte(templateYmls), "yaml", path)
+
+		// Check the status code is what we expect.
+		if status := resp.StatusCode; status != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v",
+				path, status, http.StatusNotFound)
+		}
+	}
+	// Check invalid templates are reported
+	for _, path := range invalidTemplates {
+		yml := "- path: " + path + "\n  url: https://example.com\n"
+		if _, err := YAMLHandler([]byte(yml), http.HandlerFunc(fallback)); err == nil {
+			t.Errorf("handler accepted invalid template: %s", path)
+		}
+	}
+}
+
+func TestJSONHandlerPolicy(t *testing.T) {
+	// Run tests for all testcases
+	for _, tc := range policyRequests {
+		resp := runEncodingHandler(t, []byte(policyJSONBlob), "json", tc.path)
+
+		// Check the status code is what we expect.
+		if status := resp.StatusCode; status != tc.status {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v",
+				tc.path, status, tc.status)
+		}
+
+		// Check the header to see if redirection is what we expect.
+		header := resp.Header
+		if len(header["Location"]) <= 0 {
+			t.Fatalf("handler returned empty Location header: got %v",
+				header["Location"])
+		}
+		if header["Location"][0] != tc.url {
+			t.Errorf("handler returned wrong url for %s: got %v want %v",
+				tc.path, header["Location"][0], tc.url)
+		}
+	}
+	// Check invalid entries are reported
+	for _, blob := range invalidPolicies {
+		if _, err := JSONHandler([]byte(blob), http.HandlerFunc(fallback)); err == nil {
+			t.Errorf("handler accepted invalid entry: %s", blob)
+		}
+	}
+}
+
+func TestMapHandlerHost(t *testing.T) {
+	// Run tests for all testcases
+	for path, url := range hostRequests {
+		resp := runMapHandler(t, hostPathsToUrls, path)
+
+		// Check the header to see if redirection is what we expect.
+		header := resp.Header
+		if len(header["Location"]) <= 0 {
+			t.Fatalf("handler returned empty Location header for %s: got %v",
+				path, header["Location"])
+		}
+		if header["Location"][0] != url {
+			t.Errorf("handler returned wrong url for %s: got %v want %v",
+				path, header["Location"][0], url)
+		}
+	}
+	// Run tests for wrong testcases
+	for _, path := range []string{"http://l.example.com/x/net", "/x/net"} {
+		resp := runMapHandler(t, hostPathsToUrls, path)
+
+		// Check the status code is what we expect.
+		if status := resp.StatusCode; status != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code for %s: got %v want %v",
+				path, status, http.StatusNotFound)
+		}
+	}
+	// Check the host field of the YAML entries
+	for path, url := range map[string]string{
+		"http://go.example.com/pkg": "https://pkg.go.dev",
+		"http://l.example.com/pkg":  "https://example.com/pkg",
+	} {
+		resp := runEncodingHandler(t, []byte(hostYmls), "yaml", path)
+		if location := resp.Header.Get("Location"); location != url {
+			t.Errorf("handler returned wrong url for %s: got %v want %v",
+				path, location, url)
+		}
+	}
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	// Entries with metadata, one of them disabled
+	yml := `
+- path: /enabled
+  url: https://example.com/enabled
+  description: An enabled link
+  tags: [docs, demo]
+  created_by: thanoskoutr
+- path: /disabled
+  url: https://example.com/disabled
+  enabled: false
+`
+	records, err := parseEncoded([]byte(yml), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Disabled || !records[1].Disabled {
+		t.Fatalf("wrong enabled flags: got %+v", records)
+	}
+	if records[0].Description != "An enabled link" || len(records[0].Tags) != 2 ||
+		records[0].CreatedBy != "thanoskoutr" {
+		t.Errorf("wrong metadata: got %+v", records[0])
+	}
+
+	// Disabled entries are not redirected
+	if status := runEncodingHandler(t, []byte(yml), "yaml", "/disabled").StatusCode; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code for disabled entry: got %v want %v",
+			status, http.StatusNotFound)
+	}
+
+	// Metadata survives writing and reading back, in both encodings
+	ymlOut, err := yaml.Marshal(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonOut, err := json.Marshal(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for enc, data := range map[string][]byte{"yaml": ymlOut, "json": jsonOut} {
+		parsed, err := parseEncoded(data, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parsed, records) {
+			t.Errorf("%s round trip changed the records: got %+v want %+v", enc, parsed, records)
+		}
+	}
+}
+
 func TestYAMLHandler(t *testing.T) {
 	// Run tests for all testcases
 	for path, url := range pathsToUrls {
@@ -160,7 +494,817 @@ func TestJSONHandler(t *testing.T) {
 	}
 }
 
+func TestHandler(t *testing.T) {
+	h := NewHandler(pathsToUrls, http.HandlerFunc(fallback))
+
+	// Add, change and delete paths
+	h.Set("/gh/*", "https://github.com/*")
+	h.Set("/yaml-godoc", "https://pkg.go.dev/gopkg.in/yaml.v2")
+	h.Delete("/urlshort-godoc")
+	expected := map[string]string{
+		"/gh/golang/go":   "https://github.com/golang/go",
+		"/yaml-godoc":     "https://pkg.go.dev/gopkg.in/yaml.v2",
+		"/urlshort-godoc": "",
+	}
+	for path, url := range expected {
+		if location := runHandler(t, h, path).Header.Get("Location"); location != url {
+			t.Errorf("handler returned wrong url for %s: got %v want %v",
+				path, location, url)
+		}
+	}
+
+	// Replace the whole mapping
+	h.Replace(map[string]string{"/new": "https://example.com/new"})
+	expected = map[string]string{
+		"/new":          "https://example.com/new",
+		"/gh/golang/go": "",
+	}
+	for path, url := range expected {
+		if location := runHandler(t, h, path).Header.Get("Location"); location != url {
+			t.Errorf("handler returned wrong url for %s: got %v want %v",
+				path, location, url)
+		}
+	}
+
+	// Read and write concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				h.Set(fmt.Sprintf("/%d/%d", i, j), "https://example.com")
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				runHandler(t, h, "/new")
+			}
+		}()
+	}
+	wg.Wait()
+	if location := runHandler(t, h, "/7/99").Header.Get("Location"); location != "https://example.com" {
+		t.Errorf("handler lost a concurrent change: got %v", location)
+	}
+
+	// The zero value is an empty mapping
+	var zero Handler
+	if status := runHandler(t, &zero, "/new").StatusCode; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+	if matches, err := zero.Matches(httptest.NewRequest(http.MethodGet, "/new", nil)); len(matches) != 0 || err != nil {
+		t.Errorf("wrong matches of the zero value: %v (%v)", matches, err)
+	}
+	zero.Set("/new", "https://example.com/new")
+	if location := runHandler(t, &zero, "/new").Header.Get("Location"); location != "https://example.com/new" {
+		t.Errorf("handler returned wrong url: got %v want %v", location, "https://example.com/new")
+	}
+	if rec, ok := zero.Record("/new"); !ok || rec.Url != "https://example.com/new" {
+		t.Errorf("wrong record of /new: %+v (%v)", rec, ok)
+	}
+	zero.Delete("/new")
+	if _, ok := zero.Record("/new"); ok {
+		t.Errorf("deleted record of /new is still found")
+	}
+	if status := runHandler(t, &zero, "/new").StatusCode; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestDBHandler(t *testing.T) {
+	db, err := database.SetupDB(filepath.Join(t.TempDir(), "urls.db"), "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := database.PutMapEntriesDB(db, pathsToUrls); err != nil {
+		t.Fatal(err)
+	}
+	h, err := DBHandler(db, http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, url := range pathsToUrls {
+		if location := runHandler(t, h, path).Header.Get("Location"); location != url {
+			t.Errorf("handler returned wrong url for %s: got %v want %v",
+				path, location, url)
+		}
+	}
+
+	// Changes to the Database are served without a restart
+	if err := database.PutEntryDB(db, "/new", "https://example.com/new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.DeleteEntryDB(db, "/yaml-godoc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.PutMapEntriesDB(db, prefixPathsToUrls); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.PutMapEntriesDB(db, hostPathsToUrls); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.PutEntryDB(db, "/jira/{ticket}", "https://jira.example.com/browse/{ticket}"); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"/new":                        "https://example.com/new",
+		"/yaml-godoc":                 "",
+		"/jira/GO-1":                  "https://jira.example.com/browse/GO-1",
+		"http://go.example.com/pkg":   "https://pkg.go.dev",
+		"http://go.example.com/x/net": "https://pkg.go.dev/golang.org/x/net",
+		"http://l.example.com/x/net":  "",
+	}
+	for path, url := range prefixRequests {
+		expected[path] = url
+	}
+	for path, url := range expected {
+		if location := runHandler(t, h, path).Header.Get("Location"); location != url {
+			t.Errorf("handler returned wrong url for %s: got %v want %v",
+				path, location, url)
+		}
+	}
+}
+
+func TestDBHandlerMemStore(t *testing.T) {
+	ctx := context.Background()
+	store := database.NewMemStore()
+	store.Put(ctx, "/jira/{ticket}", database.Record{Url: "https://jira.example.com/browse/{ticket}"})
+	h, err := DBHandler(store, http.HandlerFunc(fallback))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Changes to the Store are served without a restart
+	store.Put(ctx, "/gh/*", database.Record{Url: "https://github.com/*", Status: http.StatusMovedPermanently})
+	store.Put(ctx, "/new", database.Record{Url: "https://example.com/new"})
+	expected := map[string]string{
+		"/jira/GO-1":    "https://jira.example.com/browse/GO-1",
+		"/gh/golang/go": "https://github.com/golang/go",
+		"/new":          "https://example.com/new",
+	}
+	for path, url := range expected {
+		if location := runHandler(t, h, path).Header.Get("Location"); location != url {
+			t.Errorf("handler returned wrong url for %s: got %v want %v",
+				path, location, url)
+		}
+	}
+	store.Delete(ctx, "/new")
+	if status := runHandler(t, h, "/new").StatusCode; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestDBHandlerCache(t *testing.T) {
+	db, err := database.SetupDB(filepath.Join(t.TempDir(), "urls.db"), "URL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	opts := DBOptions{CacheSize: 10, CacheTTL: time.Hour, MissTTL: time.Hour}
+	h, err := NewDBHandler(db, http.HandlerFunc(fallback), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := runHandler(t, h, "/other").StatusCode; status != http.StatusNotFound {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	// A change made by another process is not seen, while the miss is cached
+	err = db.BoltDB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(db.Bucket)).Put([]byte("/other"), []byte("https://example.com/other"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := runHandler(t, h, "/other").StatusCode; status != http.StatusNotFound {
+		t.Errorf("handler did not cache the miss: got %v want %v", status, http.StatusNotFound)
+	}
+
+	// A change made through the database package evicts the key
+	if err := database.PutEntryDB(db, "/other", "https://example.com/changed"); err != nil {
+		t.Fatal(err)
+	}
+	if location := runHandler(t, h, "/other").Header.Get("Location"); location != "https://example.com/changed" {
+		t.Errorf("handler returned wrong url: got %v want %v", location, "https://example.com/changed")
+	}
+
+	// A stopped handler does not watch the changes anymore
+	sh, err := NewStoreHandler(db, http.HandlerFunc(fallback), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runHandler(t, sh, "/other")
+	sh.Stop()
+	if err := database.PutEntryDB(db, "/other", "https://example.com/again"); err != nil {
+		t.Fatal(err)
+	}
+	if location := runHandler(t, sh, "/other").Header.Get("Location"); location != "https://example.com/changed" {
+		t.Errorf("stopped handler returned wrong url: got %v want %v", location, "https://example.com/changed")
+	}
+	if location := runHandler(t, h, "/other").Header.Get("Location"); location != "https://example.com/again" {
+		t.Errorf("handler returned wrong url: got %v want %v", location, "https://example.com/again")
+	}
+}
+
+func TestChainedHandlers(t *testing.T) {
+	ctx := context.Background()
+	store := database.NewMemStore()
+	store.Put(ctx, "/gh/golang/*", database.Record{Url: "https://go.dev/*"})
+	store.Put(ctx, "/dup", database.Record{Url: "https://example.com/store"})
+	inner := NewHandler(map[string]string{
+		"/gh/exact":           "https://exact.example.com",
+		"go.example.com/gh/*": "https://pkg.go.dev/*",
+	}, http.HandlerFunc(fallback))
+	mid, err := NewStoreHandler(store, inner, DefaultDBOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer := NewHandler(map[string]string{
+		"/gh/*": "https://github.com/*",
+		"/dup":  "https://example.com/outer",
+	}, mid)
+
+	// The most specific entry of all the handlers redirects, and the
+	// first handler wins between entries that are as specific
+	requests := map[string]string{
+		"/gh/exact":                         "https://exact.example.com",
+		"/gh/golang/net":                    "https://go.dev/net",
+		"/gh/other":                         "https://github.com/other",
+		"/dup":                              "https://example.com/outer",
+		"http://go.example.com/gh/golang/x": "https://pkg.go.dev/golang/x",
+	}
+	for path, url := range requests {
+		if location := runHandler(t, outer, path).Header.Get("Location"); location != url {
+			t.Errorf("%s: handler returned wrong url: got %v want %v", path, location, url)
+		}
+	}
+	if status := runHandler(t, outer, "/nope").StatusCode; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	now := time.Now()
+	c := newLRUCache(2, time.Minute, time.Second)
+	c.timeNow = func() time.Time { return now }
+
+	// The least recently used key is evicted
+	c.add("/a", database.Record{Url: "https://example.com/a"}, true, c.generation())
+	c.add("/b", database.Record{}, false, c.generation())
+	c.get("/a")
+	c.add("/c", database.Record{Url: "https://example.com/c"}, true, c.generation())
+	if _, _, ok := c.get("/b"); ok {
+		t.Errorf("cache did not evict the least recently used key")
+	}
+	if rec, found, ok := c.get("/a"); !ok || !found || rec.Url != "https://example.com/a" {
+		t.Errorf("cache returned wrong lookup: got %+v %v %v", rec, found, ok)
+	}
+
+	// Misses expire before the found keys
+	c.add("/b", database.Record{}, false, c.generation())
+	now = now.Add(2 * time.Second)
+	if _, _, ok := c.get("/b"); ok {
+		t.Errorf("cache did not expire the miss")
+	}
+	if _, _, ok := c.get("/a"); !ok {
+		t.Errorf("cache expired the found key too early")
+	}
+	now = now.Add(time.Minute)
+	if _, _, ok := c.get("/a"); ok {
+		t.Errorf("cache did not expire the found key")
+	}
+
+	// A lookup read before a removal is not cached
+	gen := c.generation()
+	c.remove("/c")
+	c.add("/c", database.Record{Url: "https://example.com/stale"}, true, gen)
+	if _, _, ok := c.get("/c"); ok {
+		t.Errorf("cache added a stale lookup")
+	}
+}
+
 // Create a fallback Handler to pass to other Handlers
+func TestCheckRecord(t *testing.T) {
+	tests := []struct {
+		key   string
+		rec   database.Record
+		valid bool
+	}{
+		{"/gh/*", database.Record{Url: "https://github.com/*"}, true},
+		{"go.example.com/pkg", database.Record{Url: "https://pkg.go.dev", Status: 308}, true},
+		{"/jira/{ticket}", database.Record{Url: "https://jira.example.com/browse/{ticket}"}, true},
+		{"gh", database.Record{Url: "https://github.com"}, false},
+		{"gh/x", database.Record{Path: "gh/x", Url: "https://github.com"}, false},
+		{"example.com/a/x", database.Record{Host: "example.com/a", Path: "/x", Url: "https://github.com"}, false},
+		{"example.com/x", database.Record{Host: "example.com", Path: "/x", Url: "https://github.com"}, true},
+		{"/gh", database.Record{}, false},
+		{"/gh", database.Record{Url: "github.com"}, false},
+		{"/gh", database.Record{Url: "ftp://github.com"}, false},
+		{"/gh", database.Record{Url: "https://github.com", Status: 200}, false},
+		{"/gh", database.Record{Url: "https://github.com", Query: "keep"}, false},
+		{"/jira/{ticket}", database.Record{Url: "https://jira.example.com/browse/{id}"}, false},
+	}
+	for _, tt := range tests {
+		if err := CheckRecord(tt.key, tt.rec); (err == nil) != tt.valid {
+			t.Errorf("CheckRecord(%s, %+v) = %v, want valid %v", tt.key, tt.rec, err, tt.valid)
+		}
+	}
+}
+
+func TestFileHandler(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "urls.yaml")
+	write := func(data string) {
+		if err := os.WriteFile(name, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	location := func(h http.Handler, path string) string {
+		return runHandler(t, h, path).Header.Get("Location")
+	}
+	write("- path: /gh\n  url: https://github.com\n")
+	h, err := NewFileHandler(name, "yaml", http.HandlerFunc(fallback), FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := location(h, "/gh"); got != "https://github.com" {
+		t.Errorf("handler returned wrong url: got %v want %v", got, "https://github.com")
+	}
+
+	// An unchanged file is not reloaded
+	if changed, err := h.Reload(); changed || err != nil {
+		t.Errorf("unchanged file reloaded: %v %v", changed, err)
+	}
+
+	// A changed file is swapped in
+	write("- path: /gl\n  url: https://gitlab.com\n  status: 301\n")
+	if changed, err := h.Reload(); !changed || err != nil {
+		t.Errorf("changed file not reloaded: %v %v", changed, err)
+	}
+	if got := location(h, "/gl"); got != "https://gitlab.com" {
+		t.Errorf("handler returned wrong url: got %v want %v", got, "https://gitlab.com")
+	}
+	if status := runHandler(t, h, "/gh").StatusCode; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	// An invalid file is not swapped in, and its error is kept
+	write("- path: /gl\n  url: https://gitlab.com/broken\n  status: 200\n")
+	for i := 0; i < 2; i++ {
+		if _, err := h.Reload(); err == nil {
+			t.Error("expected an error for an invalid file")
+		}
+	}
+	if got := location(h, "/gl"); got != "https://gitlab.com" {
+		t.Errorf("handler returned wrong url: got %v want %v", got, "https://gitlab.com")
+	}
+	if status := h.Status(); status.Error == "" || status.Name != name {
+		t.Errorf("wrong status: %+v", status)
+	}
+
+	// Fixing the file clears the error
+	write("- path: /gl\n  url: https://gitlab.com/fixed\n")
+	if _, err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if status := h.Status(); status.Error != "" {
+		t.Errorf("wrong status: %+v", status)
+	}
+	if got := location(h, "/gl"); got != "https://gitlab.com/fixed" {
+		t.Errorf("handler returned wrong url: got %v want %v", got, "https://gitlab.com/fixed")
+	}
+
+	// A missing file is an error
+	if _, err := NewFileHandler(name+".missing", "yaml", http.HandlerFunc(fallback), FileOptions{}); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	yml := `# links
+- path: gh
+  url: https://github.com
+- path: /x
+  url: javascript:alert(1)
+  colour: red
+- path: /gh/*
+  url: https://github.com/*
+  status: 200
+- url: ""
+  path: /gh/*
+  query: keep
+`
+	jsn := `[
+  {"path": "/a", "url": "https://a.example.com"},
+  {
+    "path": "/a",
+    "url": "ftp://x",
+    "extra": 1
+  }
+]`
+	tml := `[[links]]
+path = "/a"
+url = "https://a.example.com"
+
+[[links]]
+  path = "/a"
+  url = "ftp://x"
+  extra = 1
+`
+	tests := []struct {
+		name     string
+		data     string
+		enc      string
+		expected []string
+	}{
+		{"urls.yaml", yml, "yaml", []string{
+			`urls.yaml:2:3: error: path "gh" must start with /`,
+			`urls.yaml:5:3: error: url "javascript:alert(1)" has the unsafe scheme javascript`,
+			`urls.yaml:6:3: warning: unknown field "colour"`,
+			`urls.yaml:9:3: error: status 200 is not a redirect status`,
+			`urls.yaml:10:3: error: url is missing`,
+			`urls.yaml:11:3: error: duplicate path "/gh/*", first defined at line 7`,
+			`urls.yaml:12:3: error: unknown query policy "keep"`,
+		}},
+		{"urls.json", jsn, "json", []string{
+			`urls.json:4:5: error: duplicate path "/a", first defined at line 2`,
+			`urls.json:5:5: error: url "ftp://x" is not an absolute http or https URL`,
+			`urls.json:6:5: warning: unknown field "extra"`,
+		}},
+		{"urls.toml", tml, "toml", []string{
+			`urls.toml:6:3: error: duplicate path "/a", first defined at line 2`,
+			`urls.toml:7:3: error: url "ftp://x" is not an absolute http or https URL`,
+			`urls.toml:8:3: warning: unknown field "extra"`,
+		}},
+		{"bad.yaml", "- path: /a\n  url: [x\n", "yaml", []string{
+			`bad.yaml:2: error: yaml: line 2: did not find expected ',' or ']'`,
+		}},
+		{"bad.json", "[{\"path\": \"/a\",\n \"url\": }]", "json", []string{
+			`bad.json:2:9: error: invalid character '}' looking for beginning of value`,
+		}},
+		{"urls.yaml", templateYmls, "yaml", nil},
+		{"urls.json", policyJSONBlob, "json", nil},
+	}
+	for _, tt := range tests {
+		diags := Validate(tt.name, []byte(tt.data), tt.enc)
+		var got []string
+		for _, d := range diags {
+			got = append(got, d.String())
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("wrong diagnostics for %s:\ngot  %q\nwant %q", tt.name, got, tt.expected)
+		}
+	}
+	if HasErrors(Validate("urls.json", []byte(`[{"path": "/a", "url": "https://a.example.com", "extra": 1}]`), "json")) {
+		t.Error("unknown fields should only be warnings")
+	}
+}
+
+func TestFileHandlerStrict(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "urls.yaml")
+	data := "- path: /gh\n  url: https://github.com\n  colour: red\n"
+	if err := os.WriteFile(name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Warnings are kept in the status, or refused in strict mode
+	h, err := NewFileHandler(name, "yaml", http.HandlerFunc(fallback), FileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diags := h.Status().Diagnostics; len(diags) != 1 || diags[0].Line != 3 {
+		t.Errorf("wrong diagnostics: %v", diags)
+	}
+	if _, err := NewFileHandler(name, "yaml", http.HandlerFunc(fallback), FileOptions{Strict: true}); err == nil {
+		t.Error("expected an error in strict mode")
+	}
+
+	// Errors are refused in every mode
+	for _, data := range []string{
+		"- path: /gh\n  url: https://github.com\n- path: /x\n  url: javascript:alert(1)\n",
+		"- path: /gh\n  url: https://github.com\n- path: nolead\n  url: https://example.com\n",
+		"- path: /gh\n  url: https://github.com\n- path: /gh\n  url: https://gitlab.com\n",
+	} {
+		if err := os.WriteFile(name, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewFileHandler(name, "yaml", http.HandlerFunc(fallback), FileOptions{}); err == nil {
+			t.Errorf("expected an error for:\n%s", data)
+		}
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"urls.yml", "", "yaml"},
+		{"URLS.JSON", "", "json"},
+		{"urls.jsonl", "", "ndjson"},
+		{"urls.csv", "- path: /a", "csv"},
+		{"urls", "- path: /a\n  url: https://a.example.com\n", "yaml"},
+		{"urls", "  [{\"path\": \"/a\"}]", "json"},
+		{"urls", "{\"path\": \"/a\"}\n", "ndjson"},
+		{"urls", "path,url\n/a,https://a.example.com\n", "csv"},
+		{"urls", "/a,https://a.example.com,301\n/b,https://b.example.com\n", "csv"},
+		{"urls", "url, path, status\nhttps://a.example.com,/a,301\n", "csv"},
+		{"urls", "- path: /a\n  tags: [a, b]\n", "yaml"},
+		{"urls", "path: /a, url: https://a.example.com\n", "yaml"},
+		{"urls", "/a\thttps://a.example.com\n", "tsv"},
+		{"urls", "[[links]]\npath = \"/a\"\n", "toml"},
+		// The comment lines are skipped
+		{"urls", "# links, owned by infra\n- path: /a\n  url: https://a.example.com\n", "yaml"},
+		{"urls", "\n  # links, owned by infra\n\n[[links]]\npath = \"/a\"\n", "toml"},
+		{"urls", "# links, owned by infra\npath,url\n/a,https://a.example.com\n", "csv"},
+		{"-", "", "yaml"},
+	}
+	for _, tt := range tests {
+		if got := DetectFormat(tt.name, []byte(tt.data)); got != tt.expected {
+			t.Errorf("DetectFormat(%q, %q) = %q, want %q", tt.name, tt.data, got, tt.expected)
+		}
+	}
+}
+
+func TestLoader(t *testing.T) {
+	expected := map[string]database.Record{
+		"/gh": {Path: "/gh", Url: "https://github.com", Status: 301, Tags: []string{"code", "go"}},
+		"/go": {Path: "/go", Url: "https://go.dev"},
+	}
+	tests := []struct {
+		enc  string
+		data string
+	}{
+		{"yaml", "- path: /gh\n  url: https://github.com\n  status: 301\n  tags: [code, go]\n- path: /go\n  url: https://go.dev\n"},
+		{"json", `[{"path": "/gh", "url": "https://github.com", "status": 301, "tags": ["code", "go"]}, {"path": "/go", "url": "https://go.dev"}]`},
+		{"ndjson", "{\"path\": \"/gh\", \"url\": \"https://github.com\", \"status\": 301, \"tags\": [\"code\", \"go\"]}\n\n{\"path\": \"/go\", \"url\": \"https://go.dev\"}\n"},
+		{"csv", "url,path,status,tags\nhttps://github.com,/gh,301,\"code, go\"\nhttps://go.dev,/go,,\n"},
+		{"tsv", "path\turl\tstatus\ttags\n/gh\thttps://github.com\t301\tcode,go\n/go\thttps://go.dev\t\t\n"},
+		{"toml", "# links\n[[links]]\npath = \"/gh\"\nurl = \"https://github.com\" # GitHub\nstatus = 301\ntags = [\"code\", \"go\"]\n\n[[links]]\npath = \"/go\"\nurl = \"https://go.dev\"\n"},
+		{"toml", "[[links]]\npath = '/gh'\nurl = \"\"\"https://github.com\"\"\"\nstatus = 0x12d\ntags = [\n  \"code\",\n  \"go\",\n]\n[[links]]\n\"path\" = \"/go\"\nurl = 'https://go.dev'\n"},
+	}
+	for _, tt := range tests {
+		records, err := ParseRecords([]byte(tt.data), tt.enc)
+		if err != nil {
+			t.Errorf("%s: %v", tt.enc, err)
+			continue
+		}
+		if !reflect.DeepEqual(records, expected) {
+			t.Errorf("%s: wrong records:\ngot  %+v\nwant %+v", tt.enc, records, expected)
+		}
+		if diags := Validate("urls", []byte(tt.data), tt.enc); len(diags) > 0 {
+			t.Errorf("%s: unexpected diagnostics: %v", tt.enc, diags)
+		}
+	}
+
+	// Without a header row the columns are path, url and status
+	records, err := ParseRecords([]byte("/gh,https://github.com,301\n/go,https://go.dev\n"), "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := records["/gh"]; rec.Url != "https://github.com" || rec.Status != 301 || records["/go"].Url != "https://go.dev" {
+		t.Errorf("wrong records without a header: %+v", records)
+	}
+
+	// Errors are reported at their line
+	bad := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"bad.csv", "path,url,status\n/a,https://a.example.com,301\n/b,https://b.example.com,moved\n", "bad.csv:3"},
+		{"bad.ndjson", "{\"path\": \"/a\", \"url\": \"https://a.example.com\"}\n{\"path\": \"/b\",\n", "bad.ndjson:2"},
+		{"bad.toml", "[[links]]\npath = \"/a\"\nurl = https://a.example.com\n", "bad.toml:3"},
+		{"twice.toml", "[[links]]\npath = \"/a\"\npath = \"/b\"\n", "twice.toml:3"},
+	}
+	for _, tt := range bad {
+		diags := Validate(tt.name, []byte(tt.data), "")
+		if len(diags) != 1 || !strings.HasPrefix(diags[0].String(), tt.expected+":") {
+			t.Errorf("wrong diagnostics for %s: %v", tt.name, diags)
+		}
+	}
+
+	name := filepath.Join(t.TempDir(), "urls")
+	if err := os.WriteFile(name, []byte(tests[3].data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	records, format, err := LoadFile(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "csv" || !reflect.DeepEqual(records, expected) {
+		t.Errorf("wrong file loaded as %s: %+v", format, records)
+	}
+	if err := os.WriteFile(name, []byte("/gh,https://github.com,301\n/go,https://go.dev\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	records, format, err = LoadFile(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := records["/gh"]; format != "csv" || rec.Url != "https://github.com" || rec.Status != 301 {
+		t.Errorf("wrong headerless file loaded as %s: %+v", format, records)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	records := map[string]database.Record{
+		"/gh":                 {Url: "https://github.com"},
+		"/gh/{user}":          {Url: "https://github.com/{user}", Status: http.StatusMovedPermanently},
+		"/gh/*":               {Url: "https://github.com/*"},
+		"/*":                  {Url: "https://example.com/*"},
+		"go.example.com/gh/*": {Url: "https://pkg.go.dev/*"},
+		"/off":                {Url: "https://example.com/off", Disabled: true},
+	}
+	h := NewHandler(nil, http.HandlerFunc(fallback))
+	h.ReplaceRecords(records)
+	store := database.NewMemStore()
+	for key, rec := range records {
+		store.Put(context.Background(), key, rec)
+	}
+	sh, err := NewStoreHandler(store, http.HandlerFunc(fallback), DefaultDBOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host     string
+		path     string
+		expected []string
+	}{
+		{"", "/gh", []string{"exact /gh https://github.com", "prefix /gh/* https://github.com/", "prefix /* https://example.com/gh"}},
+		{"", "/gh/golang?tab=1", []string{"template /gh/{user} https://github.com/golang", "prefix /gh/* https://github.com/golang?tab=1", "prefix /* https://example.com/gh/golang?tab=1"}},
+		{"go.example.com", "/gh/x", []string{"prefix go.example.com/gh/* https://pkg.go.dev/x", "template /gh/{user} https://github.com/x", "prefix /gh/* https://github.com/x", "prefix /* https://example.com/gh/x"}},
+		{"", "/off", []string{"prefix /* https://example.com/off"}},
+	}
+	for _, explainer := range []Explainer{h, sh} {
+		for _, tt := range tests {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Host = tt.host
+			matches, err := explainer.Matches(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, m := range matches {
+				got = append(got, m.Kind+" "+m.Key+" "+m.URL)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("%T: wrong matches for %s%s:\ngot  %q\nwant %q", explainer, tt.host, tt.path, got, tt.expected)
+			}
+			// The first match is where the handler redirects
+			rr := httptest.NewRecorder()
+			explainer.(http.Handler).ServeHTTP(rr, req)
+			if loc := rr.Header().Get("Location"); len(matches) > 0 && (loc != matches[0].URL || rr.Code != matches[0].Status) {
+				t.Errorf("%T: %s%s redirected to %d %q, explained as %+v", explainer, tt.host, tt.path, rr.Code, loc, matches[0])
+			}
+		}
+	}
+}
+
+// clickLog is a ClickRecorder that keeps the clicks in memory
+type clickLog struct {
+	mu     sync.Mutex
+	clicks []database.Click
+}
+
+func (l *clickLog) RecordClick(c database.Click) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clicks = append(l.clicks, c)
+	return nil
+}
+
+func TestRecordClicks(t *testing.T) {
+	h := NewHandler(map[string]string{"/gh/*": "https://github.com/*"}, http.HandlerFunc(fallback))
+	store := database.NewMemStore()
+	store.Put(context.Background(), "/yaml", database.Record{Url: "https://yaml.org"})
+	sh, err := NewStoreHandler(store, h, DefaultDBOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log clickLog
+	chain := RecordClicks(sh, &log)
+
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/yaml", nil),
+		httptest.NewRequest(http.MethodGet, "/gh/golang?tab=1", nil),
+		httptest.NewRequest(http.MethodGet, "/missing", nil),
+	}
+	requests[0].RemoteAddr = "192.0.2.17:4242"
+	requests[0].Header.Set("Referer", "https://News.example.com/item?id=1")
+	requests[0].Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0")
+	// Behind a local proxy the client is the address it forwards
+	requests[1].RemoteAddr = "127.0.0.1:4242"
+	requests[1].Header.Set("X-Forwarded-For", "203.0.113.9, 2001:db8:1234:5678::1")
+	requests[1].Header.Set("User-Agent", "curl/8.0.1")
+	for _, req := range requests {
+		chain.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// The fallback is not recorded
+	if len(log.clicks) != 2 {
+		t.Fatalf("got %d clicks, want 2: %+v", len(log.clicks), log.clicks)
+	}
+	for i, expected := range []database.Click{
+		{Key: "/yaml", Path: "/yaml", URL: "https://yaml.org", Referrer: "news.example.com", Agent: AgentBrowser, IP: "192.0.2.0"},
+		{Key: "/gh/*", Path: "/gh/golang", URL: "https://github.com/golang?tab=1", Agent: AgentCLI, IP: "2001:db8:1234::"},
+	} {
+		got := log.clicks[i]
+		if time.Since(got.Time) > time.Minute {
+			t.Errorf("wrong time of click %d: %v", i, got.Time)
+		}
+		got.Time = time.Time{}
+		if got != expected {
+			t.Errorf("wrong click %d:\ngot  %+v\nwant %+v", i, got, expected)
+		}
+	}
+
+	// Without a recorder nothing is recorded
+	sh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/yaml", nil))
+	if len(log.clicks) != 2 {
+		t.Errorf("recorded a click without a recorder")
+	}
+}
+
+// BenchmarkRedirectClicks compares the redirects of concurrent requests
+// without recording their clicks, recording each one in its own
+// transaction, and queueing them to a database.ClickWriter
+func BenchmarkRedirectClicks(b *testing.B) {
+	h := NewHandler(map[string]string{"/gh/*": "https://github.com/*"}, http.HandlerFunc(fallback))
+	run := func(b *testing.B, handler http.Handler) {
+		var total, count int64
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			req := httptest.NewRequest(http.MethodGet, "/gh/golang/go", nil)
+			req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0")
+			var elapsed time.Duration
+			var n int64
+			for pb.Next() {
+				rr := httptest.NewRecorder()
+				start := time.Now()
+				handler.ServeHTTP(rr, req)
+				elapsed += time.Since(start)
+				n++
+				if rr.Code != http.StatusFound {
+					b.Errorf("got status %d", rr.Code)
+					return
+				}
+			}
+			atomic.AddInt64(&total, int64(elapsed))
+			atomic.AddInt64(&count, n)
+		})
+		// The latency of a redirect, without the time of the background
+		// writes, which ns/op includes with a single CPU
+		b.ReportMetric(float64(total)/float64(count), "ns/redirect")
+	}
+	setup := func(b *testing.B) *database.Database {
+		db, err := database.SetupDB(filepath.Join(b.TempDir(), "urls.db"), "URL")
+		if err != nil {
+			b.Fatal(err)
+		}
+		return db
+	}
+	b.Run("none", func(b *testing.B) {
+		run(b, h)
+	})
+	b.Run("transaction", func(b *testing.B) {
+		db := setup(b)
+		defer db.Close()
+		run(b, RecordClicks(h, db))
+	})
+	b.Run("batched", func(b *testing.B) {
+		db := setup(b)
+		defer db.Close()
+		w := database.NewClickWriter(db, database.DefaultClickOptions)
+		defer w.Close()
+		run(b, RecordClicks(h, w))
+	})
+}
+
+func TestAgentClass(t *testing.T) {
+	for ua, expected := range map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/120.0": AgentBrowser,
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148":      AgentMobile,
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":  AgentBot,
+		"Wget/1.21.4": AgentCLI,
+		"":            AgentOther,
+	} {
+		if got := AgentClass(ua); got != expected {
+			t.Errorf("AgentClass(%q) = %s, want %s", ua, got, expected)
+		}
+	}
+	for addr, expected := range map[string]string{
+		"192.0.2.17":     "192.0.2.0",
+		"2001:db8::1":    "2001:db8::",
+		"::ffff:1.2.3.4": "1.2.3.0",
+		"unix":           "",
+	} {
+		if got := AnonymizeIP(addr); got != expected {
+			t.Errorf("AnonymizeIP(%q) = %q, want %q", addr, got, expected)
+		}
+	}
+}
+
 func fallback(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "fallback handler", http.StatusNotFound)
 }
@@ -219,3 +1363,14 @@ func runEncodingHandler(t *testing.T, data []byte, enc string, path string) *htt
 	// Return Response: StatusCode, Header, Body
 	return resp.Result()
 }
+
+// Run a Handler with the given path
+func runHandler(t *testing.T, handler http.Handler, path string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	return resp.Result()
+}
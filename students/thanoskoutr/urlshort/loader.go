@@ -0,0 +1,408 @@
+package urlshort
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+	"gopkg.in/yaml.v2"
+)
+
+// Formats of the mapping files.
+//
+// Every format has the fields of YAMLHandler, as:
+//
+//     yaml    a list of mappings
+//     json    an array of objects
+//     ndjson  an object per line
+//     csv     a row per entry, under a header row with the field names
+//     tsv     like csv, separated by tabs
+//     toml    an array of tables, e.g. [[links]]
+//
+// In csv and tsv files the tags are separated by commas, and without a
+// header row the columns are path, url and status.
+var Formats = []string{"yaml", "json", "ndjson", "csv", "tsv", "toml"}
+
+// extensions maps the file extensions to their formats.
+var extensions = map[string]string{
+	".yaml":   "yaml",
+	".yml":    "yaml",
+	".json":   "json",
+	".ndjson": "ndjson",
+	".jsonl":  "ndjson",
+	".csv":    "csv",
+	".tsv":    "tsv",
+	".toml":   "toml",
+}
+
+// decoders decode the entries of a format, with their positions, if known.
+var decoders = map[string]func(data []byte) ([]database.Record, []entryPositions, error){
+	"yaml":   decodeYAML,
+	"json":   decodeJSON,
+	"ndjson": decodeNDJSON,
+	"csv":    func(data []byte) ([]database.Record, []entryPositions, error) { return decodeCSV(data, ',') },
+	"tsv":    func(data []byte) ([]database.Record, []entryPositions, error) { return decodeCSV(data, '\t') },
+	"toml":   decodeTOML,
+}
+
+// positionError is an error at a position of a file.
+type positionError struct {
+	pos position
+	err error
+}
+
+func (e *positionError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.pos.line, e.err)
+}
+
+func (e *positionError) Unwrap() error {
+	return e.err
+}
+
+// DetectFormat will return the format of a mapping file, from the
+// extension of its name or else from its data.
+//
+// The blank lines and the # comment lines at the start of the data are
+// skipped. Data starting with "[[" is toml, with "[" json and with "{"
+// ndjson. A first line with a tab is tsv, and a first line with a comma
+// is csv if it is a header row, a row starting with a path (e.g.
+// /gh,https://github.com) or has no colon. Anything else is yaml.
+func DetectFormat(name string, data []byte) string {
+	if format, ok := extensions[strings.ToLower(filepath.Ext(name))]; ok {
+		return format
+	}
+	text := skipComments(strings.TrimPrefix(string(data), "\ufeff"))
+	firstLine := text
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		firstLine = text[:i]
+	}
+	switch {
+	case strings.HasPrefix(text, "[["), isTOMLKey(firstLine):
+		return "toml"
+	case strings.HasPrefix(text, "["):
+		return "json"
+	case strings.HasPrefix(text, "{"):
+		return "ndjson"
+	case strings.Contains(firstLine, "\t"):
+		return "tsv"
+	case strings.Contains(firstLine, ","):
+		row := strings.Split(firstLine, ",")
+		first := strings.Trim(strings.TrimSpace(row[0]), `"`)
+		if isHeader(row) || strings.HasPrefix(first, "/") || !strings.Contains(firstLine, ":") {
+			return "csv"
+		}
+	}
+	return "yaml"
+}
+
+// skipComments will return the text from its first line that is not
+// blank or a # comment, without its indentation.
+func skipComments(text string) string {
+	for text != "" {
+		line := text
+		rest := ""
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			line, rest = text[:i], text[i+1:]
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			return strings.TrimLeft(text, " \t")
+		}
+		text = rest
+	}
+	return ""
+}
+
+// LoadFile will read a mapping file, in the format of its extension or
+// data (see DetectFormat), or in the format, if not empty, and return
+// its entries, keyed like ParseRecords, and the format it was read in.
+func LoadFile(name string, format string) (map[string]database.Record, string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, "", err
+	}
+	if format == "" {
+		format = DetectFormat(name, data)
+	}
+	records, err := ParseRecords(data, format)
+	if err != nil {
+		return nil, format, fmt.Errorf("%s: %v", name, err)
+	}
+	return records, format, nil
+}
+
+// decode will decode the entries of a mapping file in the format.
+func decode(data []byte, format string) ([]database.Record, []entryPositions, error) {
+	dec, ok := decoders[format]
+	if !ok {
+		return nil, nil, fmt.Errorf("%s encoding not supported", format)
+	}
+	return dec(data)
+}
+
+// decodeYAML will decode a YAML list of entries.
+func decodeYAML(data []byte) ([]database.Record, []entryPositions, error) {
+	var records []database.Record
+	if err := yaml.Unmarshal(data, &records); err != nil {
+		return nil, nil, err
+	}
+	positions, _ := yamlPositions(data)
+	return records, positions, nil
+}
+
+// decodeJSON will decode a JSON array of entries.
+func decodeJSON(data []byte) ([]database.Record, []entryPositions, error) {
+	var records []database.Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, nil, err
+	}
+	positions, _ := jsonPositions(data, false)
+	return records, positions, nil
+}
+
+// decodeNDJSON will decode a JSON object per line. Empty lines are skipped.
+func decodeNDJSON(data []byte) ([]database.Record, []entryPositions, error) {
+	var records []database.Record
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var rec database.Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			pos := errorPosition(line, err)
+			pos.line = i + 1
+			return nil, nil, &positionError{pos: pos, err: err}
+		}
+		records = append(records, rec)
+	}
+	positions, _ := jsonPositions(data, true)
+	return records, positions, nil
+}
+
+// csvColumns are the columns of a csv or tsv file without a header row.
+var csvColumns = []string{"path", "url", "status"}
+
+// decodeCSV will decode a row per entry, separated by the comma.
+func decodeCSV(data []byte, comma rune) ([]database.Record, []entryPositions, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = comma
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	if comma == '\t' {
+		r.LazyQuotes = true
+	}
+	var records []database.Record
+	var positions []entryPositions
+	var columns []string
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return nil, nil, &positionError{pos: position{line: parseErr.Line, column: parseErr.Column}, err: parseErr.Err}
+			}
+			return nil, nil, err
+		}
+		if columns == nil {
+			columns = csvColumns
+			if isHeader(row) {
+				columns = make([]string, len(row))
+				for i, name := range row {
+					columns[i] = strings.ToLower(strings.TrimSpace(name))
+				}
+				continue
+			}
+		}
+		line, _ := r.FieldPos(0)
+		p := entryPositions{start: position{line: line, column: 1}, fields: make(map[string]position)}
+		fields := make(map[string]interface{})
+		for i, value := range row {
+			if i >= len(columns) {
+				return nil, nil, &positionError{pos: p.start, err: fmt.Errorf("row has %d fields, the header has %d", len(row), len(columns))}
+			}
+			line, column := r.FieldPos(i)
+			p.fields[columns[i]] = position{line: line, column: column}
+			if value = strings.TrimSpace(value); value == "" {
+				continue
+			}
+			v, err := fieldValue(columns[i], value)
+			if err != nil {
+				return nil, nil, &positionError{pos: position{line: line, column: column}, err: err}
+			}
+			fields[columns[i]] = v
+		}
+		rec, err := recordFromFields(fields)
+		if err != nil {
+			return nil, nil, &positionError{pos: p.start, err: err}
+		}
+		records = append(records, rec)
+		positions = append(positions, p)
+	}
+	return records, positions, nil
+}
+
+// isHeader reports whether a row is a header row: it has the path
+// and url columns.
+func isHeader(row []string) bool {
+	var path, url bool
+	for _, name := range row {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "path":
+			path = true
+		case "url":
+			url = true
+		}
+	}
+	return path && url
+}
+
+// fieldValue will convert the text of a csv or tsv field to its type.
+func fieldValue(name string, value string) (interface{}, error) {
+	switch name {
+	case "status", "version":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q is not a number", name, value)
+		}
+		return n, nil
+	case "enabled":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("enabled %q is not a boolean", value)
+		}
+		return b, nil
+	case "tags":
+		var tags []string
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		return tags, nil
+	}
+	return value, nil
+}
+
+// recordFromFields will convert the fields of an entry to a Record,
+// through its JSON encoding.
+func recordFromFields(fields map[string]interface{}) (database.Record, error) {
+	var rec database.Record
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal(data, &rec)
+	return rec, err
+}
+
+// isTOMLKey reports whether a line is a TOML key = value pair.
+func isTOMLKey(line string) bool {
+	i := strings.Index(line, "=")
+	if i <= 0 {
+		return false
+	}
+	key := strings.TrimSpace(line[:i])
+	return key != "" && !strings.ContainsAny(key, " \t,:")
+}
+
+// decodeTOML will decode the arrays of tables, a table per entry, e.g.
+// [[links]]. Entries of different arrays are in the order of the first
+// table of each array.
+func decodeTOML(data []byte) ([]database.Record, []entryPositions, error) {
+	var doc map[string]interface{}
+	md, err := toml.Decode(string(data), &doc)
+	if err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			pos := offsetPosition(data, parseErr.Position.Start)
+			pos.line = parseErr.Position.Line
+			return nil, nil, &positionError{pos: pos, err: errors.New(parseErr.Message)}
+		}
+		return nil, nil, err
+	}
+	tables := tomlPositions(data)
+	var records []database.Record
+	var positions []entryPositions
+	seen := make(map[string]bool)
+	for _, key := range md.Keys() {
+		if len(key) != 1 || seen[key[0]] {
+			continue
+		}
+		name := key[0]
+		seen[name] = true
+		entries, ok := doc[name].([]map[string]interface{})
+		if !ok {
+			pos := position{}
+			if p, ok := tables[name]; ok && len(p) > 0 {
+				pos = p[0].start
+			}
+			return nil, nil, &positionError{pos: pos, err: fmt.Errorf("only arrays of tables are supported, got %s", name)}
+		}
+		for i, fields := range entries {
+			p := entryPositions{fields: make(map[string]position)}
+			if i < len(tables[name]) {
+				p = tables[name][i]
+			}
+			rec, err := recordFromFields(fields)
+			if err != nil {
+				return nil, nil, &positionError{pos: p.start, err: err}
+			}
+			records = append(records, rec)
+			positions = append(positions, p)
+		}
+	}
+	return records, positions, nil
+}
+
+// tomlKey matches a "key =" at the start of a line of a TOML table.
+var tomlKey = regexp.MustCompile(`^"?([A-Za-z0-9_-]+)"?\s*=`)
+
+// tomlPositions will find the positions of the tables of the arrays of
+// tables of a TOML document, by name, and of their keys, by scanning its
+// lines instead of parsing them.
+//
+// A [[name]] header line starts a table, and the first "key =" line of
+// each key after it, up to the next header line, is the position of the
+// key. The keys of the other tables, e.g. after a [name] header, are
+// skipped, and dotted keys or keys of inline tables are not found.
+func tomlPositions(data []byte) map[string][]entryPositions {
+	tables := make(map[string][]entryPositions)
+	var fields map[string]position
+	for i, line := range strings.Split(string(data), "\n") {
+		text := strings.TrimSpace(line)
+		pos := position{line: i + 1, column: len(line) - len(strings.TrimLeft(line, " \t")) + 1}
+		switch {
+		case strings.HasPrefix(text, "[["):
+			name := strings.TrimSpace(strings.TrimPrefix(text, "[["))
+			if end := strings.Index(name, "]]"); end >= 0 {
+				name = strings.TrimSpace(name[:end])
+			}
+			p := entryPositions{start: pos, fields: make(map[string]position)}
+			tables[name] = append(tables[name], p)
+			fields = p.fields
+		case strings.HasPrefix(text, "["):
+			fields = nil
+		case fields != nil:
+			if m := tomlKey.FindStringSubmatch(text); m != nil {
+				if _, ok := fields[m[1]]; !ok {
+					fields[m[1]] = pos
+				}
+			}
+		}
+	}
+	return tables
+}
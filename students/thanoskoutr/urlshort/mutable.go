@@ -0,0 +1,175 @@
+package urlshort
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+)
+
+// Handler is an http.Handler that will attempt to map any paths
+// to their corresponding URL, like MapHandler, but whose mapping
+// can be changed while it is serving requests.
+//
+// Reads never block: every change builds a new copy of the mapping,
+// which replaces the current one atomically. Changes are serialized,
+// so Handler is meant for mappings that are read much more often than
+// they are written.
+//
+// The zero value is a Handler with an empty mapping, whose fallback is
+// http.NotFoundHandler.
+type Handler struct {
+	fallback http.Handler
+
+	mu      sync.Mutex                 // serializes the changes of the mapping
+	entries map[string]database.Record // current mapping, never modified in place
+	routes  atomic.Value               // *router built from entries
+}
+
+// NewHandler will return a Handler for the paths of the map, with the
+// same path syntax as MapHandler. If the path is not provided in the
+// map, then the fallback http.Handler will be called instead.
+func NewHandler(pathsToUrls map[string]string, fallback http.Handler) *Handler {
+	h := &Handler{fallback: fallback}
+	h.Replace(pathsToUrls)
+	return h
+}
+
+// ServeHTTP will redirect the request, if its path is in the
+// current mapping, or call the fallback http.Handler.
+//
+// If the fallback is a Handler, a FileHandler or a StoreHandler, the
+// entries of the mapping and of the fallback (and of its own fallback)
+// are resolved together, and the most specific one redirects the
+// request, e.g. an exact path of the fallback wins over a prefix entry
+// of the mapping. Between entries that are as specific, the mapping wins.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveChain(w, r, h)
+}
+
+// resolve will return the entry of the current mapping that redirects
+// the request, see source.
+func (h *Handler) resolve(r *http.Request) (candidate, bool, error) {
+	c, ok := h.currentRoutes().lookup(r)
+	return c, ok, nil
+}
+
+// next will return the fallback, see source.
+func (h *Handler) next() http.Handler {
+	if h.fallback == nil {
+		return http.NotFoundHandler()
+	}
+	return h.fallback
+}
+
+// currentRoutes will return the router of the current mapping, which is
+// empty for the zero Handler.
+func (h *Handler) currentRoutes() *router {
+	if routes, ok := h.routes.Load().(*router); ok {
+		return routes
+	}
+	return &router{}
+}
+
+// Records will return a copy of the current mapping.
+func (h *Handler) Records() map[string]database.Record {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	records := make(map[string]database.Record, len(h.entries))
+	for k, v := range h.entries {
+		records[k] = v
+	}
+	return records
+}
+
+// Record will return the record of a key of the current mapping, if
+// it has one.
+func (h *Handler) Record(key string) (database.Record, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rec, ok := h.entries[key]
+	return rec, ok
+}
+
+// Set will add a path to the mapping, or change its URL.
+func (h *Handler) Set(path string, url string) {
+	h.SetRecord(path, database.Record{Url: url})
+}
+
+// SetRecord will add a path to the mapping, or change its record.
+func (h *Handler) SetRecord(path string, rec database.Record) {
+	h.update(func(entries map[string]database.Record) {
+		entries[path] = recordEntry(path, rec)
+	})
+}
+
+// Delete will remove a path from the mapping.
+func (h *Handler) Delete(path string) {
+	h.update(func(entries map[string]database.Record) {
+		delete(entries, path)
+	})
+}
+
+// Replace will replace the whole mapping with the paths of the map.
+func (h *Handler) Replace(pathsToUrls map[string]string) {
+	records := make(map[string]database.Record, len(pathsToUrls))
+	for path, url := range pathsToUrls {
+		records[path] = database.Record{Url: url}
+	}
+	h.ReplaceRecords(records)
+}
+
+// ReplaceRecords will replace the whole mapping with the paths
+// and records of the map.
+func (h *Handler) ReplaceRecords(records map[string]database.Record) {
+	h.load(func() (map[string]database.Record, error) {
+		return records, nil
+	})
+}
+
+// load will replace the whole mapping with the records returned by
+// the function, which is called with the mutex held, so changes made
+// while loading are applied after the loaded records.
+func (h *Handler) load(records func() (map[string]database.Record, error)) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	recs, err := records()
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]database.Record, len(recs))
+	for path, rec := range recs {
+		entries[path] = recordEntry(path, rec)
+	}
+	h.swap(entries)
+	return nil
+}
+
+// update will apply a change to a copy of the current mapping,
+// and then swap it in.
+func (h *Handler) update(change func(entries map[string]database.Record)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := make(map[string]database.Record, len(h.entries)+1)
+	for k, v := range h.entries {
+		entries[k] = v
+	}
+	change(entries)
+	h.swap(entries)
+}
+
+// swap will build the router of the mapping and make it the current one.
+// It must be called with the mutex held.
+func (h *Handler) swap(entries map[string]database.Record) {
+	routes, _ := newRouter(entries)
+	h.entries = entries
+	h.routes.Store(routes)
+}
+
+// recordEntry will set the host and the path of the record
+// from its key, to make it an entry of the mapping.
+func recordEntry(key string, rec database.Record) database.Record {
+	rec.Host, rec.Path = database.SplitHostKey(key)
+	return rec
+}
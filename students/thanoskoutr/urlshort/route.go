@@ -0,0 +1,565 @@
+package urlshort
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+)
+
+// wildcard is the suffix that marks a path as a prefix entry, and the
+// placeholder in its URL that is replaced by the unmatched part of the path.
+const wildcard = "*"
+
+// Query policies, for what to do with the query string of a request.
+const (
+	// QueryDrop ignores the query of the request.
+	QueryDrop = "drop"
+	// QueryAppend appends the query of the request to the query of the URL.
+	QueryAppend = "append"
+	// QueryMerge merges the query of the request into the query of the URL,
+	// the request values override the URL values with the same name.
+	QueryMerge = "merge"
+	// QueryReplace replaces the query of the URL with the query of the request.
+	QueryReplace = "replace"
+)
+
+// redirectStatus lists the status codes that an entry can redirect with.
+var redirectStatus = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// target represents where and how a request is redirected.
+type target struct {
+	key    string // of the entry, see database.HostKey
+	url    string
+	status int
+}
+
+// candidate is an entry that matches a request, with where it redirects
+// the request, and its rank against the candidates of other sources.
+type candidate struct {
+	kind   string // MatchExact, MatchTemplate or MatchPrefix
+	entry  database.Record
+	target target
+	rank   rank
+}
+
+// rank orders the candidates of a request: the entries scoped to the host
+// of the request first, then the exact paths, the templates from the
+// most to the least specific one, and the prefix entries from the
+// longest to the shortest prefix. It is the order of lookup of a route
+// table, so the sources of a chain are resolved like a single table.
+type rank struct {
+	scoped bool
+	kind   int // 2 for exact paths, 1 for templates and 0 for prefixes
+	// literals and segments of a template, or length of a prefix
+	literals int
+	segments int
+}
+
+// beats reports whether a candidate of the rank is more specific than
+// one of the other rank. Candidates of the same rank do not beat each
+// other, so the first one found wins.
+func (a rank) beats(b rank) bool {
+	if a.scoped != b.scoped {
+		return a.scoped
+	}
+	if a.kind != b.kind {
+		return a.kind > b.kind
+	}
+	if a.literals != b.literals {
+		return a.literals > b.literals
+	}
+	return a.segments > b.segments
+}
+
+// exactCandidate will return the candidate of an exact path.
+func exactCandidate(entry database.Record, u *url.URL, scoped bool) candidate {
+	return candidate{
+		kind:   MatchExact,
+		entry:  entry,
+		target: newTarget(entry.Url, entry, QueryDrop, u.RawQuery),
+		rank:   rank{scoped: scoped, kind: 2},
+	}
+}
+
+// templateCandidate will return the candidate of a template, if it
+// matches the URL.
+func templateCandidate(tmpl *pathTemplate, u *url.URL, scoped bool) (candidate, bool) {
+	params, ok := tmpl.match(u.EscapedPath())
+	if !ok {
+		return candidate{}, false
+	}
+	return candidate{
+		kind:   MatchTemplate,
+		entry:  tmpl.entry,
+		target: newTarget(tmpl.render(params), tmpl.entry, QueryDrop, u.RawQuery),
+		rank:   rank{scoped: scoped, kind: 1, literals: tmpl.literals, segments: len(tmpl.segments)},
+	}, true
+}
+
+// prefixCandidate will return the candidate of a prefix entry, if it
+// matches the URL.
+func prefixCandidate(prefix string, entry database.Record, u *url.URL, scoped bool) (candidate, bool) {
+	t, ok := prefixTarget(prefix, entry, u)
+	if !ok {
+		return candidate{}, false
+	}
+	return candidate{
+		kind:   MatchPrefix,
+		entry:  entry,
+		target: t,
+		rank:   rank{scoped: scoped, literals: len(prefix)},
+	}, true
+}
+
+// router holds a route table per host.
+//
+// Entries that are not scoped to a host are kept in the default table,
+// under the empty host, and serve every host.
+type router struct {
+	hosts map[string]*routeTable
+}
+
+// newRouter will group the entries by host and build their route tables.
+//
+// The keys of the entries are paths, optionally scoped to a host,
+// see database.HostKey.
+func newRouter(entries map[string]database.Record) (*router, error) {
+	var firstErr error
+	byHost := make(map[string]map[string]database.Record)
+	for key, entry := range entries {
+		host, path := database.SplitHostKey(key)
+		host = normalizeHost(host)
+		if byHost[host] == nil {
+			byHost[host] = make(map[string]database.Record)
+		}
+		byHost[host][path] = entry
+	}
+	rt := &router{hosts: make(map[string]*routeTable)}
+	for host, hostEntries := range byHost {
+		table, err := newRouteTable(hostEntries)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		rt.hosts[host] = table
+	}
+	return rt, firstErr
+}
+
+// lookup will return the entry that redirects the request, see
+// eachCandidate.
+func (rt *router) lookup(r *http.Request) (candidate, bool) {
+	c, ok, _ := firstCandidate(r, rt.entries)
+	return c, ok
+}
+
+// entries will return the route table of the host, if any.
+func (rt *router) entries(host string) (entrySet, bool) {
+	table, ok := rt.hosts[host]
+	return table, ok
+}
+
+// entrySet is the entries of a host in a source, that the candidates
+// of a request are looked up in, e.g. a routeTable.
+type entrySet interface {
+	// exactEntry returns the enabled entry of the exact path, if any.
+	exactEntry(ctx context.Context, path string) (database.Record, bool, error)
+	// pathTemplates returns the path templates, from the most to the
+	// least specific one.
+	pathTemplates() []*pathTemplate
+	// prefixEntry returns the enabled prefix entry of the key, e.g.
+	// /gh/*, if any.
+	prefixEntry(ctx context.Context, key string) (database.Record, bool, error)
+}
+
+// eachCandidate will call yield for the entries that match the request,
+// in the order of lookup, until yield returns false, with the entries
+// of the hosts returned by entries. The first error of the entries
+// stops the lookup, and is returned.
+//
+// The entries of the host of the request are tried first, and the
+// entries of the default host after them. For each host, the exact path
+// is tried first, then the templates, then the prefix entries from the
+// longest to the shortest prefix, so the first candidate is the one
+// that redirects the request.
+//
+// For a prefix entry the unmatched suffix of the path is put in place
+// of the wildcard of the URL (or appended to it, if it has no wildcard).
+// The query of the request is handled by the query policy of the entry.
+// By default it is dropped for exact paths and templates, and appended
+// for prefix entries.
+func eachCandidate(r *http.Request, entries func(host string) (entrySet, bool), yield func(candidate) bool) error {
+	hosts := []string{""}
+	if host := normalizeHost(r.Host); host != "" {
+		hosts = []string{host, ""}
+	}
+	ctx, u := r.Context(), r.URL
+	for _, host := range hosts {
+		set, ok := entries(host)
+		if !ok {
+			continue
+		}
+		scoped := host != ""
+		entry, found, err := set.exactEntry(ctx, u.Path)
+		if err != nil {
+			return err
+		}
+		if found && !yield(exactCandidate(entry, u, scoped)) {
+			return nil
+		}
+		for _, tmpl := range set.pathTemplates() {
+			if c, ok := templateCandidate(tmpl, u, scoped); ok && !yield(c) {
+				return nil
+			}
+		}
+		for _, key := range prefixKeys(u.Path) {
+			entry, found, err := set.prefixEntry(ctx, key)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+			c, ok := prefixCandidate(strings.TrimSuffix(key, wildcard), entry, u, scoped)
+			if ok && !yield(c) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// firstCandidate will return the entry that redirects the request, the
+// first candidate of eachCandidate.
+func firstCandidate(r *http.Request, entries func(host string) (entrySet, bool)) (candidate, bool, error) {
+	var first candidate
+	var found bool
+	err := eachCandidate(r, entries, func(c candidate) bool {
+		first, found = c, true
+		return false
+	})
+	return first, found, err
+}
+
+// allMatches will return the entries that match the request, all the
+// candidates of eachCandidate, and the error that stopped the lookup.
+func allMatches(r *http.Request, entries func(host string) (entrySet, bool)) ([]Match, error) {
+	var matches []Match
+	err := eachCandidate(r, entries, func(c candidate) bool {
+		matches = append(matches, c.match())
+		return true
+	})
+	return matches, err
+}
+
+// source is implemented by the handlers of the sources of a chain, which
+// are chained through their fallback, e.g. a Handler for a map, whose
+// fallback is a FileHandler, whose fallback is a StoreHandler.
+type source interface {
+	http.Handler
+	// resolve returns the entry of the source that redirects the
+	// request, if any.
+	resolve(r *http.Request) (candidate, bool, error)
+	// next returns the fallback of the source.
+	next() http.Handler
+}
+
+// resolveChain will return the entry that redirects the request, from
+// the source and the sources chained after it, and the first handler
+// after them, which serves the request if no entry does.
+//
+// The most specific entry of all the sources wins, see rank, like if
+// they were a single route table, e.g. an exact path of the last source
+// wins over a prefix entry of the first one. Between entries of the same
+// rank, e.g. the same key in two sources, the first source wins.
+//
+// The error of a source is returned along with the entry of the other
+// sources, if any.
+func resolveChain(r *http.Request, src source) (candidate, bool, http.Handler, error) {
+	var best candidate
+	var found bool
+	var firstErr error
+	var h http.Handler = src
+	for {
+		s, ok := h.(source)
+		if !ok {
+			return best, found, h, firstErr
+		}
+		c, ok, err := s.resolve(r)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if ok && (!found || c.rank.beats(best.rank)) {
+			best, found = c, true
+		}
+		h = s.next()
+	}
+}
+
+// serveChain will redirect the request with the entry of the chain of
+// sources that redirects it, see resolveChain, or else call the handler
+// after them.
+//
+// A source that fails makes the request fail with a 500, unless an
+// entry of another source redirects it.
+func serveChain(w http.ResponseWriter, r *http.Request, src source) {
+	c, ok, fallback, err := resolveChain(r, src)
+	if err != nil {
+		log.Printf("urlshort: lookup %s%s: %v", r.Host, r.URL.Path, err)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	if ok {
+		redirect(w, r, c.target)
+	} else {
+		fallback.ServeHTTP(w, r)
+	}
+}
+
+// normalizeHost will lowercase the host and strip its port.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// routeTable holds the exact paths, the path templates and the prefix
+// entries of a mapping, see entrySet.
+//
+// Templates are kept sorted from the most to the least specific one, so
+// the first one that matches is the most specific one. Prefix entries
+// are kept by key, e.g. /gh/* -> https://github.com/*.
+type routeTable struct {
+	exact     map[string]database.Record
+	templates []*pathTemplate
+	prefixes  map[string]database.Record
+}
+
+// newRouteTable will split the paths of a mapping to exact paths,
+// path templates and prefix entries.
+//
+// Disabled entries are left out. A template that cannot be parsed is kept
+// as an exact path, and an entry with an unknown status or query policy
+// uses the default one. The first such error is returned along with the
+// table.
+func newRouteTable(entries map[string]database.Record) (*routeTable, error) {
+	var firstErr error
+	t := &routeTable{exact: make(map[string]database.Record), prefixes: make(map[string]database.Record)}
+	for path, entry := range entries {
+		if entry.Disabled {
+			continue
+		}
+		if err := checkEntry(path, entry); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			entry.Status, entry.Query = 0, ""
+		}
+		if isTemplate(path) {
+			tmpl, err := parseTemplate(path, entry)
+			if err == nil {
+				t.templates = append(t.templates, tmpl)
+				continue
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if strings.HasSuffix(path, "/"+wildcard) {
+			t.prefixes[path] = entry
+			continue
+		}
+		t.exact[path] = entry
+	}
+	sort.Slice(t.templates, func(i, j int) bool {
+		a, b := t.templates[i], t.templates[j]
+		if a.literals != b.literals {
+			return a.literals > b.literals
+		}
+		if len(a.segments) != len(b.segments) {
+			return len(a.segments) > len(b.segments)
+		}
+		return a.path < b.path
+	})
+	return t, firstErr
+}
+
+// CheckRecord will validate a Record before it is stored under the key,
+// see database.HostKey.
+//
+// The path of the key, and of the Record if set, must start with a "/",
+// and the host of the Record must not contain one, so the key is not
+// split elsewhere, e.g. path gh/x would be the path /x of the host gh.
+// The URL must be an absolute http or https URL, and the status, the
+// query policy and the template (if the path is one) must be valid, like
+// the handlers expect them.
+func CheckRecord(key string, rec database.Record) error {
+	if !strings.Contains(key, "/") {
+		return fmt.Errorf("path %q: must start with /", key)
+	}
+	if rec.Path != "" && !strings.HasPrefix(rec.Path, "/") {
+		return fmt.Errorf("path %q: must start with /", rec.Path)
+	}
+	if strings.Contains(rec.Host, "/") {
+		return fmt.Errorf("host %q: must not contain /", rec.Host)
+	}
+	_, path := database.SplitHostKey(key)
+	if rec.Url == "" {
+		return fmt.Errorf("path %q: url is empty", path)
+	}
+	u, err := url.Parse(rec.Url)
+	if err != nil {
+		return fmt.Errorf("path %q: %v", path, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("path %q: url %q is not an absolute http or https URL", path, rec.Url)
+	}
+	if err := checkEntry(path, rec); err != nil {
+		return err
+	}
+	if isTemplate(path) {
+		_, err := parseTemplate(path, rec)
+		return err
+	}
+	return nil
+}
+
+// checkEntry will validate the status and the query policy of an entry.
+func checkEntry(path string, entry database.Record) error {
+	if entry.Status != 0 && !redirectStatus[entry.Status] {
+		return fmt.Errorf("path %q: status %d is not a redirect status", path, entry.Status)
+	}
+	switch entry.Query {
+	case "", QueryDrop, QueryAppend, QueryMerge, QueryReplace:
+		return nil
+	}
+	return fmt.Errorf("path %q: unknown query policy %q", path, entry.Query)
+}
+
+func (t *routeTable) exactEntry(ctx context.Context, path string) (database.Record, bool, error) {
+	entry, ok := t.exact[path]
+	return entry, ok, nil
+}
+
+func (t *routeTable) pathTemplates() []*pathTemplate {
+	return t.templates
+}
+
+func (t *routeTable) prefixEntry(ctx context.Context, key string) (database.Record, bool, error) {
+	entry, ok := t.prefixes[key]
+	return entry, ok, nil
+}
+
+// prefixTarget will return where to redirect the requested URL,
+// if it matches the prefix of a prefix entry.
+func prefixTarget(prefix string, entry database.Record, u *url.URL) (target, bool) {
+	// A prefix entry also matches its own path without the trailing slash
+	if u.Path != strings.TrimSuffix(prefix, "/") && !strings.HasPrefix(u.Path, prefix) {
+		return target{}, false
+	}
+	rest := strings.TrimPrefix(u.Path, prefix)
+	if rest == u.Path {
+		rest = ""
+	}
+	rest = (&url.URL{Path: rest}).EscapedPath()
+	dest := expandWildcard(entry.Url, rest)
+	return newTarget(dest, entry, QueryAppend, u.RawQuery), true
+}
+
+// prefixKeys will return the paths of the prefix entries that can
+// match the path, from the longest to the shortest prefix, e.g.
+// /gh/golang/go/*, /gh/golang/*, /gh/* and /* for /gh/golang/go.
+func prefixKeys(path string) []string {
+	var keys []string
+	if !strings.HasSuffix(path, "/") {
+		keys = append(keys, path+"/"+wildcard)
+	}
+	for i := strings.LastIndex(path, "/"); i >= 0; i = strings.LastIndex(path, "/") {
+		path = path[:i]
+		keys = append(keys, path+"/"+wildcard)
+	}
+	return keys
+}
+
+// newTarget will apply the status and the query policy of the entry
+// to the URL to redirect to.
+func newTarget(dest string, entry database.Record, defaultQuery string, rawQuery string) target {
+	status := entry.Status
+	if status == 0 {
+		status = http.StatusFound
+	}
+	policy := entry.Query
+	if policy == "" {
+		policy = defaultQuery
+	}
+	return target{
+		key:    database.HostKey(entry.Host, entry.Path),
+		url:    applyQuery(dest, policy, rawQuery),
+		status: status,
+	}
+}
+
+// expandWildcard will put the suffix in place of the wildcard of the URL,
+// or join it to the URL path if there is no wildcard.
+func expandWildcard(dest string, suffix string) string {
+	if strings.Contains(dest, wildcard) {
+		return strings.Replace(dest, wildcard, suffix, 1)
+	}
+	if suffix == "" {
+		return dest
+	}
+	return strings.TrimSuffix(dest, "/") + "/" + suffix
+}
+
+// applyQuery will combine the query of the URL with the raw query
+// string of the request, according to the query policy.
+func applyQuery(dest string, policy string, rawQuery string) string {
+	if policy == QueryDrop || (rawQuery == "" && policy != QueryReplace) {
+		return dest
+	}
+	// Split the fragment and the query off the URL
+	fragment := ""
+	if i := strings.Index(dest, "#"); i >= 0 {
+		dest, fragment = dest[:i], dest[i:]
+	}
+	destQuery := ""
+	if i := strings.Index(dest, "?"); i >= 0 {
+		dest, destQuery = dest[:i], dest[i+1:]
+	}
+	switch policy {
+	case QueryAppend:
+		if destQuery != "" {
+			rawQuery = destQuery + "&" + rawQuery
+		}
+	case QueryMerge:
+		values, err := url.ParseQuery(destQuery)
+		reqValues, reqErr := url.ParseQuery(rawQuery)
+		if err != nil || reqErr != nil {
+			// Keep both, rather than losing the malformed parts
+			rawQuery = destQuery + "&" + rawQuery
+			break
+		}
+		for k, v := range reqValues {
+			values[k] = v
+		}
+		rawQuery = values.Encode()
+	}
+	if rawQuery != "" {
+		dest += "?" + rawQuery
+	}
+	return dest + fragment
+}
@@ -0,0 +1,202 @@
+package urlshort
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+)
+
+// segment is a single segment of a path template.
+//
+// It is either a literal segment, or a named parameter written as:
+//
+//     {name}         required parameter
+//     {name=value}   optional parameter, with a default value
+//     {name...}      catch-all parameter, matches the rest of the path
+type segment struct {
+	literal  string
+	name     string
+	def      string
+	optional bool
+	catchAll bool
+}
+
+// pathTemplate represents a path with named segments and the entry
+// whose URL they are rendered into, e.g.
+// /jira/{ticket} -> https://jira.example.com/browse/{ticket}
+type pathTemplate struct {
+	path     string
+	entry    database.Record
+	segments []segment
+	literals int
+}
+
+// isTemplate reports whether the path declares named segments.
+func isTemplate(path string) bool {
+	return strings.Contains(path, "{")
+}
+
+// parseTemplate will parse a path template and check that every
+// parameter used in the URL is declared in the path.
+func parseTemplate(path string, entry database.Record) (*pathTemplate, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("template %q: path must start with /", path)
+	}
+	t := &pathTemplate{path: path, entry: entry}
+	names := make(map[string]bool)
+	parts := strings.Split(path[1:], "/")
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("template %q: segment %q must be a whole {parameter}", path, part)
+			}
+			if len(t.segments) > 0 && t.segments[len(t.segments)-1].optional {
+				return nil, fmt.Errorf("template %q: optional parameters must be at the end", path)
+			}
+			t.segments = append(t.segments, segment{literal: part})
+			t.literals++
+			continue
+		}
+		seg := segment{name: part[1 : len(part)-1]}
+		switch {
+		case strings.HasSuffix(seg.name, "..."):
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("template %q: catch-all parameter must be the last segment", path)
+			}
+			seg.name = strings.TrimSuffix(seg.name, "...")
+			seg.catchAll = true
+		case strings.Contains(seg.name, "="):
+			kv := strings.SplitN(seg.name, "=", 2)
+			seg.name, seg.def, seg.optional = kv[0], kv[1], true
+		default:
+			if len(t.segments) > 0 && t.segments[len(t.segments)-1].optional {
+				return nil, fmt.Errorf("template %q: optional parameters must be at the end", path)
+			}
+		}
+		if seg.name == "" {
+			return nil, fmt.Errorf("template %q: parameter without a name", path)
+		}
+		if names[seg.name] {
+			return nil, fmt.Errorf("template %q: parameter %q declared twice", path, seg.name)
+		}
+		names[seg.name] = true
+		t.segments = append(t.segments, seg)
+	}
+	for _, name := range templateParams(entry.Url) {
+		if !names[name] {
+			return nil, fmt.Errorf("template %q: url uses undeclared parameter %q", path, name)
+		}
+	}
+	return t, nil
+}
+
+// templateParams will return the names of the parameters used in the URL.
+func templateParams(dest string) []string {
+	var names []string
+	for {
+		start := strings.Index(dest, "{")
+		if start < 0 {
+			return names
+		}
+		end := strings.Index(dest[start:], "}")
+		if end < 0 {
+			return names
+		}
+		names = append(names, dest[start+1:start+end])
+		dest = dest[start+end+1:]
+	}
+}
+
+// match will bind the segments of the escaped path to the template
+// parameters.
+//
+// The path is split before unescaping, so an escaped slash stays in its
+// segment. The values of a catch-all parameter are kept segment by
+// segment, so they can be escaped separately.
+func (t *pathTemplate) match(escapedPath string) (map[string][]string, bool) {
+	if !strings.HasPrefix(escapedPath, "/") {
+		return nil, false
+	}
+	parts := strings.Split(escapedPath[1:], "/")
+	// Treat a trailing slash as a missing segment
+	if len(parts) > 0 && parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, false
+		}
+		parts[i] = unescaped
+	}
+	params := make(map[string][]string)
+	for i, seg := range t.segments {
+		if seg.catchAll {
+			// After optional parameters, the rest of the path may be missing
+			if i >= len(parts) {
+				params[seg.name] = nil
+			} else {
+				params[seg.name] = parts[i:]
+			}
+			return params, true
+		}
+		if i >= len(parts) {
+			if !seg.optional {
+				return nil, false
+			}
+			params[seg.name] = []string{seg.def}
+			continue
+		}
+		if seg.name == "" {
+			if parts[i] != seg.literal {
+				return nil, false
+			}
+			continue
+		}
+		if parts[i] == "" {
+			return nil, false
+		}
+		params[seg.name] = []string{parts[i]}
+	}
+	if len(parts) > len(t.segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+// render will put the escaped parameter values in place of the
+// parameters of the URL.
+//
+// Values in the path of the URL are path escaped, values in the query
+// of the URL are query escaped.
+func (t *pathTemplate) render(params map[string][]string) string {
+	var b strings.Builder
+	dest := t.entry.Url
+	inQuery := false
+	for {
+		start := strings.Index(dest, "{")
+		end := strings.Index(dest, "}")
+		if start < 0 || end < start {
+			b.WriteString(dest)
+			return b.String()
+		}
+		b.WriteString(dest[:start])
+		if strings.Contains(dest[:start], "?") {
+			inQuery = true
+		}
+		values := params[dest[start+1:end]]
+		for i, v := range values {
+			if i > 0 {
+				b.WriteString("/")
+			}
+			if inQuery {
+				b.WriteString(url.QueryEscape(v))
+			} else {
+				b.WriteString(url.PathEscape(v))
+			}
+		}
+		dest = dest[end+1:]
+	}
+}
@@ -0,0 +1,334 @@
+package urlshort
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/thanoskoutr/urlshort/students/thanoskoutr/database"
+)
+
+// Severities of a Diagnostic.
+const (
+	// SeverityError marks an entry that fails the load of the file.
+	SeverityError = "error"
+	// SeverityWarning marks an entry that is served, but is likely wrong.
+	SeverityWarning = "warning"
+)
+
+// unsafeSchemes are the URL schemes that must never be redirected to.
+var unsafeSchemes = []string{"javascript:", "data:", "vbscript:", "file:"}
+
+// knownFields are the fields of an entry of a mapping file.
+var knownFields = map[string]bool{
+	"version": true, "path": true, "host": true, "url": true,
+	"status": true, "query": true, "enabled": true, "description": true,
+	"tags": true, "created_by": true, "created_at": true, "updated_at": true,
+}
+
+// Diagnostic is a problem found in a mapping file.
+//
+// Line and Column are 1-based, and 0 when the position is not known.
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// String will format the Diagnostic like a compiler error, e.g.
+// urls.yaml:3:5: error: path "gh" must start with /
+func (d Diagnostic) String() string {
+	pos := d.File
+	if d.Line > 0 {
+		pos += ":" + strconv.Itoa(d.Line)
+		if d.Column > 0 {
+			pos += ":" + strconv.Itoa(d.Column)
+		}
+	}
+	return pos + ": " + d.Severity + ": " + d.Message
+}
+
+// HasErrors reports whether any of the diagnostics is an error.
+func HasErrors(diags []Diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// position is a line and column in a file.
+type position struct {
+	line, column int
+}
+
+// entryPositions are the positions of an entry and of its fields.
+type entryPositions struct {
+	start  position
+	fields map[string]position
+}
+
+// field will return the position of a field, or of the entry if the
+// field is not in the file.
+func (p entryPositions) field(name string) position {
+	if pos, ok := p.fields[name]; ok {
+		return pos
+	}
+	return p.start
+}
+
+// Validate will check a mapping file, in one of the Formats (or the
+// format detected from its name and data, if enc is empty), and return
+// every problem found, sorted by position. The name of the file is only
+// used in the diagnostics.
+//
+// Besides the syntax, it checks that every entry has a path starting
+// with a "/", a safe absolute http or https URL, a valid status code,
+// query policy and template, that no path is defined twice, and it
+// warns about unknown fields.
+func Validate(name string, data []byte, enc string) []Diagnostic {
+	if enc == "" {
+		enc = DetectFormat(name, data)
+	}
+	records, positions, err := decode(data, enc)
+	if err != nil {
+		pos := errorPosition(data, err)
+		var posErr *positionError
+		if errors.As(err, &posErr) {
+			err = posErr.err
+		}
+		return []Diagnostic{{File: name, Line: pos.line, Column: pos.column, Severity: SeverityError, Message: err.Error()}}
+	}
+	if len(positions) != len(records) {
+		// Entries were not found where expected (e.g. YAML flow style)
+		positions = make([]entryPositions, len(records))
+	}
+	var diags []Diagnostic
+	report := func(pos position, severity string, format string, a ...interface{}) {
+		diags = append(diags, Diagnostic{
+			File:     name,
+			Line:     pos.line,
+			Column:   pos.column,
+			Severity: severity,
+			Message:  fmt.Sprintf(format, a...),
+		})
+	}
+	seen := make(map[string]position)
+	for i, rec := range records {
+		p := positions[i]
+		for field, pos := range p.fields {
+			if !knownFields[field] {
+				report(pos, SeverityWarning, "unknown field %q", field)
+			}
+		}
+		checkRecordFields(rec, p, report)
+		if rec.Path == "" {
+			continue
+		}
+		key := database.HostKey(rec.Host, rec.Path)
+		if first, ok := seen[key]; ok {
+			report(p.field("path"), SeverityError, "duplicate path %q, first defined at line %d", key, first.line)
+		} else {
+			seen[key] = p.field("path")
+		}
+	}
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].Line != diags[j].Line {
+			return diags[i].Line < diags[j].Line
+		}
+		return diags[i].Column < diags[j].Column
+	})
+	return diags
+}
+
+// checkRecordFields will report the problems of the fields of an entry.
+func checkRecordFields(rec database.Record, p entryPositions, report func(position, string, string, ...interface{})) {
+	switch {
+	case rec.Path == "":
+		report(p.start, SeverityError, "path is missing")
+	case !strings.HasPrefix(rec.Path, "/"):
+		report(p.field("path"), SeverityError, "path %q must start with /", rec.Path)
+	case isTemplate(rec.Path):
+		if _, err := parseTemplate(rec.Path, rec); err != nil {
+			report(p.field("path"), SeverityError, "%v", err)
+		}
+	}
+	if rec.Url == "" {
+		report(p.field("url"), SeverityError, "url is missing")
+	} else if scheme := unsafeScheme(rec.Url); scheme != "" {
+		report(p.field("url"), SeverityError, "url %q has the unsafe scheme %s", rec.Url, scheme)
+	} else if u, err := url.Parse(rec.Url); err != nil {
+		report(p.field("url"), SeverityError, "url %q: %v", rec.Url, err)
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		report(p.field("url"), SeverityError, "url %q is not an absolute http or https URL", rec.Url)
+	}
+	if rec.Status != 0 && !redirectStatus[rec.Status] {
+		report(p.field("status"), SeverityError, "status %d is not a redirect status", rec.Status)
+	}
+	switch rec.Query {
+	case "", QueryDrop, QueryAppend, QueryMerge, QueryReplace:
+	default:
+		report(p.field("query"), SeverityError, "unknown query policy %q", rec.Query)
+	}
+}
+
+// unsafeScheme will return the unsafe scheme of the URL, if it has one.
+func unsafeScheme(dest string) string {
+	dest = strings.ToLower(strings.TrimSpace(dest))
+	for _, scheme := range unsafeSchemes {
+		if strings.HasPrefix(dest, scheme) {
+			return strings.TrimSuffix(scheme, ":")
+		}
+	}
+	return ""
+}
+
+// yamlLine matches the line number in the errors of the YAML parser.
+var yamlLine = regexp.MustCompile(`line (\d+)`)
+
+// errorPosition will return the position of a parsing error.
+func errorPosition(data []byte, err error) position {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var posErr *positionError
+	switch {
+	case errors.As(err, &posErr):
+		return posErr.pos
+	case errors.As(err, &syntaxErr):
+		// The offset is after the invalid character
+		if syntaxErr.Offset > 0 {
+			return offsetPosition(data, int(syntaxErr.Offset)-1)
+		}
+		return offsetPosition(data, 0)
+	case errors.As(err, &typeErr):
+		return offsetPosition(data, int(typeErr.Offset))
+	}
+	if m := yamlLine.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return position{line: line}
+	}
+	return position{}
+}
+
+// offsetPosition will return the position of a byte offset of the data.
+func offsetPosition(data []byte, offset int) position {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := offset - bytes.LastIndexByte(before, '\n')
+	return position{line: line, column: column}
+}
+
+// yamlField matches a "key:" at the start of a line of a YAML mapping.
+var yamlField = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_-]*)\s*:(\s|$)`)
+
+// yamlPositions will find the positions of the entries of a YAML list of
+// mappings, and of their fields, by scanning its lines.
+//
+// Only the block style is supported, the entries of a flow style list are
+// not found.
+func yamlPositions(data []byte) ([]entryPositions, error) {
+	var entries []entryPositions
+	itemIndent, fieldIndent := -1, -1
+	for i, line := range strings.Split(string(data), "\n") {
+		text := strings.TrimRight(line, " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		indent := len(text) - len(trimmed)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if itemIndent < 0 && strings.HasPrefix(trimmed, "-") {
+			itemIndent = indent
+		}
+		if indent == itemIndent && (trimmed == "-" || strings.HasPrefix(trimmed, "- ")) {
+			entries = append(entries, entryPositions{
+				start:  position{line: i + 1, column: indent + 1},
+				fields: make(map[string]position),
+			})
+			// The first field can be on the line of the dash
+			rest := strings.TrimLeft(strings.TrimPrefix(trimmed, "-"), " ")
+			fieldIndent = -1
+			if rest != "" {
+				fieldIndent = len(text) - len(rest)
+				trimmed, indent = rest, fieldIndent
+			} else {
+				continue
+			}
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		if fieldIndent < 0 {
+			fieldIndent = indent
+		}
+		if indent != fieldIndent {
+			continue
+		}
+		if m := yamlField.FindStringSubmatch(trimmed); m != nil {
+			fields := entries[len(entries)-1].fields
+			if _, ok := fields[m[1]]; !ok {
+				fields[m[1]] = position{line: i + 1, column: indent + 1}
+			}
+		}
+	}
+	return entries, nil
+}
+
+// jsonPositions will find the positions of the entries of a JSON array
+// of objects, or of a stream of objects, and of their fields, from the
+// offsets of the decoder.
+func jsonPositions(data []byte, stream bool) ([]entryPositions, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// next is the offset of the next token
+	next := func() int {
+		off := int(dec.InputOffset())
+		for off < len(data) && strings.IndexByte(" \t\r\n,:", data[off]) >= 0 {
+			off++
+		}
+		return off
+	}
+	if !stream {
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+	var entries []entryPositions
+	for dec.More() {
+		p := entryPositions{start: offsetPosition(data, next()), fields: make(map[string]position)}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		for dec.More() {
+			off := next()
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			if name, ok := tok.(string); ok {
+				if _, ok := p.fields[name]; !ok {
+					p.fields[name] = offsetPosition(data, off)
+				}
+			}
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		entries = append(entries, p)
+	}
+	return entries, nil
+}